@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -33,14 +34,32 @@ var (
 	// with the signature func(string, string) that can be used to set the
 	// value of an environment variable
 	ctxOSSetenvKey = interface{}("os.Setenev")
+
+	// ctxLoggerKey is an interface-wrapped key used to access the
+	// request-scoped logger injected into an incoming context via the
+	// GoCSI logger injection interceptor.
+	ctxLoggerKey = interface{}("x-csi-logger")
 )
 
 type lookupEnvFunc func(string) (string, bool)
 type setenvFunc func(string, string) error
 
 // GetRequestID inspects the context for gRPC metadata and returns
-// its request ID if available.
+// its request ID if available. A false value is returned if the request
+// ID is not numeric. Please use GetRequestIDString to get request IDs
+// that may be strings, ex. UUIDs.
 func GetRequestID(ctx context.Context) (uint64, bool) {
+	if szID, ok := GetRequestIDString(ctx); ok {
+		if id, err := strconv.ParseUint(szID, 10, 64); err == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// GetRequestIDString inspects the context for gRPC metadata and returns
+// its request ID if available.
+func GetRequestIDString(ctx context.Context) (string, bool) {
 	var (
 		szID   []string
 		szIDOK bool
@@ -53,13 +72,29 @@ func GetRequestID(ctx context.Context) (uint64, bool) {
 		szID, szIDOK = md[RequestIDKey]
 	}
 
-	if szIDOK && len(szID) == 1 {
-		if id, err := strconv.ParseUint(szID[0], 10, 64); err == nil {
-			return id, true
-		}
+	if szIDOK && len(szID) == 1 && szID[0] != "" {
+		return szID[0], true
 	}
 
-	return 0, false
+	return "", false
+}
+
+// WithLogger returns a new Context with the provided logger.
+func WithLogger(ctx context.Context, l *log.Entry) context.Context {
+	return context.WithValue(ctx, ctxLoggerKey, l)
+}
+
+// GetLogger returns the context's request-scoped logger. The logger is
+// pre-populated with fields that identify the request, such as the request
+// ID, the full method, and the volume ID, so that log entries written by
+// storage plug-ins correlate with the GoCSI request and response logs. If
+// the context does not have a logger then a logger without any fields is
+// returned.
+func GetLogger(ctx context.Context) *log.Entry {
+	if l, ok := ctx.Value(ctxLoggerKey).(*log.Entry); ok {
+		return l
+	}
+	return log.NewEntry(log.StandardLogger())
 }
 
 // WithEnviron returns a new Context with the provided environment variable
@@ -83,6 +83,17 @@ func flagWithSpecValidation(fs *flag.FlagSet, addr *bool, def string) {
         against the CSI specification.`)
 }
 
+// flagWithAggregatedViolations adds the --with-aggregated-violations flag
+// to the specified flagset.
+func flagWithAggregatedViolations(fs *flag.FlagSet, addr *bool, def string) {
+	fs.BoolVar(
+		addr,
+		"with-aggregated-violations",
+		defBool(def),
+		`Reports all of a request's spec violations instead of only the first
+        one. Enabling this option also enables --with-spec-validation.`)
+}
+
 // flagWithRequiresCreds adds the flag --with-requires-creds
 // to the provided flagset.
 func flagWithRequiresCreds(fs *flag.FlagSet, addr *bool, def string) {
@@ -41,11 +41,17 @@ func getClientInterceptorsDialOpt() grpc.DialOption {
 
 	// Configure the spec validator.
 	root.withSpecValidator = root.withSpecValidator ||
+		root.withAggregateViolation ||
 		root.withRequiresCreds ||
 		root.withRequiresVolContext ||
 		root.withRequiresPubContext
 	if root.withSpecValidator {
 		var specOpts []specvalidator.Option
+		if root.withAggregateViolation {
+			specOpts = append(specOpts,
+				specvalidator.WithAggregatedViolations())
+			log.Debug("enabled spec validator opt: aggregated violations")
+		}
 		if root.withRequiresCreds {
 			specOpts = append(specOpts,
 				specvalidator.WithRequiresControllerCreateVolumeSecrets(),
@@ -53,7 +59,10 @@ func getClientInterceptorsDialOpt() grpc.DialOption {
 				specvalidator.WithRequiresControllerPublishVolumeSecrets(),
 				specvalidator.WithRequiresControllerUnpublishVolumeSecrets(),
 				specvalidator.WithRequiresNodeStageVolumeSecrets(),
-				specvalidator.WithRequiresNodePublishVolumeSecrets())
+				specvalidator.WithRequiresNodePublishVolumeSecrets(),
+				specvalidator.WithRequiresControllerCreateSnapshotSecrets(),
+				specvalidator.WithRequiresControllerDeleteSnapshotSecrets(),
+				specvalidator.WithRequiresControllerExpandVolumeSecrets())
 			log.Debug("enabled spec validator opt: requires creds")
 		}
 		if root.withRequiresVolContext {
@@ -11,9 +11,11 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/golang/protobuf/ptypes"
 	"github.com/rexray/gocsi/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
 )
@@ -38,6 +40,7 @@ var root struct {
 	withRepLogging bool
 
 	withSpecValidator      bool
+	withAggregateViolation bool
 	withRequiresCreds      bool
 	withRequiresVolContext bool
 	withRequiresPubContext bool
@@ -167,6 +170,7 @@ func Execute() {
 		if stat, ok := status.FromError(err); ok {
 			exitCode = int(stat.Code())
 			fmt.Fprintln(os.Stderr, stat.Message())
+			printStatusDetails(os.Stderr, stat)
 		} else {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 		}
@@ -175,6 +179,28 @@ func Execute() {
 	}
 }
 
+// printStatusDetails prints the google.rpc.BadRequest field violations
+// included in a gRPC status's details, one violation per line, and the
+// retry delay of a google.rpc.RetryInfo detail.
+func printStatusDetails(w io.Writer, stat *status.Status) {
+	for _, d := range stat.Details() {
+		switch td := d.(type) {
+		case *errdetails.BadRequest:
+			if len(td.FieldViolations) == 0 {
+				continue
+			}
+			fmt.Fprintln(w, "\nField violations:")
+			for _, fv := range td.FieldViolations {
+				fmt.Fprintf(w, "  %s: %s\n", fv.Field, fv.Description)
+			}
+		case *errdetails.RetryInfo:
+			if d, err := ptypes.Duration(td.RetryDelay); err == nil {
+				fmt.Fprintf(w, "\nRetry after: %s\n", d)
+			}
+		}
+	}
+}
+
 func init() {
 	setHelpAndUsage(RootCmd)
 
@@ -208,6 +234,11 @@ func init() {
 		&root.withSpecValidator,
 		"false")
 
+	flagWithAggregatedViolations(
+		RootCmd.PersistentFlags(),
+		&root.withAggregateViolation,
+		"false")
+
 	RootCmd.PersistentFlags().BoolVarP(
 		&root.insecure,
 		"insecure",
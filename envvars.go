@@ -92,6 +92,11 @@ const (
 	// response logging to STDOUT.
 	EnvVarRepLogging = "X_CSI_REP_LOGGING"
 
+	// EnvVarLoggingRepStatus is the name of the environment variable
+	// used to determine whether or not the gRPC result code and the
+	// duration of each RPC are logged with its response.
+	EnvVarLoggingRepStatus = "X_CSI_LOG_REP_STATUS"
+
 	// EnvVarLoggingDisableVolCtx is the name of the environment variable
 	// used to disable the logging of the VolumeContext field when request or
 	// response logging is enabled.
@@ -100,10 +105,45 @@ const (
 	// of the VolumeContext field
 	EnvVarLoggingDisableVolCtx = "X_CSI_LOG_DISABLE_VOL_CTX"
 
+	// EnvVarLoggingRedactKeys is the name of the environment variable
+	// used to specify a comma-separated list of regular expressions. When
+	// request or response logging is enabled, the values of map entries,
+	// ex. Parameters or VolumeContext, with keys that match one of the
+	// patterns are logged as "***".
+	EnvVarLoggingRedactKeys = "X_CSI_LOG_REDACT_KEYS"
+
+	// EnvVarLoggingSlowRPCThreshold is the name of the environment variable
+	// used to specify a time.Duration string. RPCs that take longer than
+	// this duration to complete are logged at the WARN level, even if
+	// response logging is disabled.
+	EnvVarLoggingSlowRPCThreshold = "X_CSI_LOG_SLOW_RPC_THRESHOLD"
+
+	// EnvVarLoggingExcludeMethods is the name of the environment variable
+	// used to specify a comma-separated list of methods that are excluded
+	// from request and response logging, ex. Probe,NodeGetCapabilities.
+	EnvVarLoggingExcludeMethods = "X_CSI_LOG_EXCLUDE_METHODS"
+
+	// EnvVarLoggingMaxListLen is the name of the environment variable used
+	// to specify the maximum number of elements logged for each list in a
+	// request or response. Longer lists are truncated. A value of zero, the
+	// default, disables truncation.
+	EnvVarLoggingMaxListLen = "X_CSI_LOG_MAX_LIST_LEN"
+
+	// EnvVarLoggingAsJSON is the name of the environment variable used to
+	// determine whether or not complete requests and responses are logged
+	// as JSON objects instead of lists of their top-level fields.
+	EnvVarLoggingAsJSON = "X_CSI_LOG_AS_JSON"
+
 	// EnvVarReqIDInjection is the name of the environment variable
 	// used to determine whether or not to enable request ID injection.
 	EnvVarReqIDInjection = "X_CSI_REQ_ID_INJECTION"
 
+	// EnvVarReqIDUpstreamKey is the name of the environment variable used
+	// to specify a gRPC metadata key, ex. a CO's correlation ID key, whose
+	// value is adopted as the request ID. The upstream key takes precedence
+	// over the "csi.requestid" key.
+	EnvVarReqIDUpstreamKey = "X_CSI_REQ_ID_UPSTREAM_KEY"
+
 	// EnvVarSpecValidation is the name of the environment variable
 	// used to determine whether or not to enable validation of CSI
 	// request and response messages. Setting X_CSI_SPEC_VALIDATION=true
@@ -122,11 +162,66 @@ const (
 	// a code of "Internal."
 	EnvVarSpecRepValidation = "X_CSI_SPEC_REP_VALIDATION"
 
+	// EnvVarSpecCrossValidation is the name of the environment variable
+	// used to determine whether or not to validate that CSI responses
+	// honor their requests.
+	EnvVarSpecCrossValidation = "X_CSI_SPEC_CROSS_VALIDATION"
+
+	// EnvVarSpecAggregateViolations is the name of the environment
+	// variable used to determine whether or not all of a CSI request's
+	// spec violations are reported instead of only the first one.
+	EnvVarSpecAggregateViolations = "X_CSI_SPEC_AGGREGATE_VIOLATIONS"
+
+	// EnvVarSpecTopology is the name of the environment variable used to
+	// determine whether or not CSI topology fields are validated. If
+	// unset, topology fields are validated if the SP advertises the
+	// VOLUME_ACCESSIBILITY_CONSTRAINTS capability.
+	EnvVarSpecTopology = "X_CSI_SPEC_TOPOLOGY"
+
+	// EnvVarSpecRemapErrCodes is the name of the environment variable used
+	// to determine whether or not errors with codes the CSI spec does not
+	// permit an RPC to return are replaced with errors with a code of
+	// "Internal."
+	EnvVarSpecRemapErrCodes = "X_CSI_SPEC_REP_REMAP_ERR_CODES"
+
+	// EnvVarSpecAudit is the name of the environment variable used to
+	// determine whether or not CSI request and response violations are
+	// only logged instead of failing the RPC.
+	EnvVarSpecAudit = "X_CSI_SPEC_AUDIT"
+
+	// EnvVarSupportedAccessModes is the name of the environment variable
+	// used to specify a comma-separated list of the access modes supported
+	// by the SP, ex. SINGLE_NODE_WRITER.
+	EnvVarSupportedAccessModes = "X_CSI_SUPPORTED_ACCESS_MODES"
+
+	// EnvVarSupportedAccessTypes is the name of the environment variable
+	// used to specify a comma-separated list of the access types supported
+	// by the SP: block, mount.
+	EnvVarSupportedAccessTypes = "X_CSI_SUPPORTED_ACCESS_TYPES"
+
+	// EnvVarSupportedFsTypes is the name of the environment variable
+	// used to specify a comma-separated list of the filesystem types
+	// supported by the SP.
+	EnvVarSupportedFsTypes = "X_CSI_SUPPORTED_FS_TYPES"
+
+	// EnvVarSupportedMountFlags is the name of the environment variable
+	// used to specify a comma-separated list of the mount flags allowed
+	// by the SP.
+	EnvVarSupportedMountFlags = "X_CSI_SUPPORTED_MOUNT_FLAGS"
+
 	// EnvVarDisableFieldLen is the name of the environment variable used
 	// to determine whether or not to disable validation of CSI request and
 	// response field lengths against the permitted lenghts defined in the spec
 	EnvVarDisableFieldLen = "X_CSI_SPEC_DISABLE_LEN_CHECK"
 
+	// EnvVarFieldLenMaxString is the name of the environment variable used
+	// to specify the maximum size of CSI message string fields.
+	EnvVarFieldLenMaxString = "X_CSI_SPEC_LEN_MAX_STRING"
+
+	// EnvVarFieldLenMaxMap is the name of the environment variable used
+	// to specify the maximum size of CSI message map fields.
+	EnvVarFieldLenMaxMap = "X_CSI_SPEC_LEN_MAX_MAP"
+
 	// EnvVarRequireStagingTargetPath is the name of the environment variable
 	// used to determine whether or not the NodePublishVolume request field
 	// StagingTargetPath is required.
@@ -179,6 +274,77 @@ const (
 	// for the eponymous RPC.
 	EnvVarCredsNodePubVol = "X_CSI_REQUIRE_CREDS_NODE_PUB_VOL"
 
+	// EnvVarCredsCreateSnap is the name of the environment
+	// variable used to determine whether or not user credentials are required
+	// for the eponymous RPC.
+	EnvVarCredsCreateSnap = "X_CSI_REQUIRE_CREDS_CREATE_SNAP"
+
+	// EnvVarCredsDeleteSnap is the name of the environment
+	// variable used to determine whether or not user credentials are required
+	// for the eponymous RPC.
+	EnvVarCredsDeleteSnap = "X_CSI_REQUIRE_CREDS_DELETE_SNAP"
+
+	// EnvVarCredsCtrlrExpandVol is the name of the environment
+	// variable used to determine whether or not user credentials are required
+	// for the eponymous RPC.
+	EnvVarCredsCtrlrExpandVol = "X_CSI_REQUIRE_CREDS_CTRLR_EXPAND_VOL"
+
+	// EnvVarSecretsDir is the name of the environment variable used to
+	// specify a directory from which secrets are read and injected into
+	// requests that have no secrets. Each file in the directory is a secret
+	// whose key is the file's name and whose value is the file's contents.
+	// This value may be overridden for specific RPCs.
+	EnvVarSecretsDir = "X_CSI_SECRETS_DIR"
+
+	// EnvVarSecretsStatInterval is the name of the environment variable
+	// used to specify the minimum interval between checks of the secrets
+	// directories for changes.
+	EnvVarSecretsStatInterval = "X_CSI_SECRETS_STAT_INTERVAL"
+
+	// EnvVarSecretsDirCreateVol is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirCreateVol = "X_CSI_SECRETS_DIR_CREATE_VOL"
+
+	// EnvVarSecretsDirDeleteVol is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirDeleteVol = "X_CSI_SECRETS_DIR_DELETE_VOL"
+
+	// EnvVarSecretsDirCtrlrPubVol is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirCtrlrPubVol = "X_CSI_SECRETS_DIR_CTRLR_PUB_VOL"
+
+	// EnvVarSecretsDirCtrlrUnpubVol is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirCtrlrUnpubVol = "X_CSI_SECRETS_DIR_CTRLR_UNPUB_VOL"
+
+	// EnvVarSecretsDirValidateVolCaps is the name of the environment
+	// variable used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirValidateVolCaps = "X_CSI_SECRETS_DIR_VALIDATE_VOL_CAPS"
+
+	// EnvVarSecretsDirCreateSnap is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirCreateSnap = "X_CSI_SECRETS_DIR_CREATE_SNAP"
+
+	// EnvVarSecretsDirDeleteSnap is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirDeleteSnap = "X_CSI_SECRETS_DIR_DELETE_SNAP"
+
+	// EnvVarSecretsDirListSnap is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirListSnap = "X_CSI_SECRETS_DIR_LIST_SNAP"
+
+	// EnvVarSecretsDirCtrlrExpandVol is the name of the environment
+	// variable used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirCtrlrExpandVol = "X_CSI_SECRETS_DIR_CTRLR_EXPAND_VOL"
+
+	// EnvVarSecretsDirNodeStgVol is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirNodeStgVol = "X_CSI_SECRETS_DIR_NODE_STG_VOL"
+
+	// EnvVarSecretsDirNodePubVol is the name of the environment variable
+	// used to specify the secrets directory for the eponymous RPC.
+	EnvVarSecretsDirNodePubVol = "X_CSI_SECRETS_DIR_NODE_PUB_VOL"
+
 	// EnvVarSerialVolAccess is the name of the environment variable
 	// used to determine whether or not to enable serial volume access.
 	EnvVarSerialVolAccess = "X_CSI_SERIAL_VOL_ACCESS"
@@ -187,6 +353,56 @@ const (
 	// used to specify the timeout for obtaining a volume lock.
 	EnvVarSerialVolAccessTimeout = "X_CSI_SERIAL_VOL_ACCESS_TIMEOUT"
 
+	// EnvVarSerialVolAccessRetryDelay is the name of the environment
+	// variable used to specify the retry delay suggested to clients when
+	// an operation is pending for a volume.
+	EnvVarSerialVolAccessRetryDelay = "X_CSI_SERIAL_VOL_ACCESS_RETRY_DELAY"
+
+	// EnvVarSerialVolAccessLockModes is the name of the environment
+	// variable used to specify the modes in which the serial volume
+	// access middleware obtains volume locks for RPCs.
+	EnvVarSerialVolAccessLockModes = "X_CSI_SERIAL_VOL_ACCESS_LOCK_MODES"
+
+	// EnvVarSerialVolAccessLockGranularity is the name of the environment
+	// variable used to specify the resources on which the serial volume
+	// access middleware serializes RPCs.
+	EnvVarSerialVolAccessLockGranularity = "X_CSI_SERIAL_VOL_ACCESS_LOCK_GRANULARITY"
+
+	// EnvVarSerialVolAccessSkipNodeStg is the name of the environment
+	// variable used to determine whether or not to exclude the NodeStageVolume
+	// RPC from serial volume access.
+	EnvVarSerialVolAccessSkipNodeStg = "X_CSI_SERIAL_VOL_ACCESS_SKIP_NODE_STG_VOL"
+
+	// EnvVarSerialVolAccessSkipNodeUnstg is the name of the environment
+	// variable used to determine whether or not to exclude the NodeUnstageVolume
+	// RPC from serial volume access.
+	EnvVarSerialVolAccessSkipNodeUnstg = "X_CSI_SERIAL_VOL_ACCESS_SKIP_NODE_UNSTG_VOL"
+
+	// EnvVarSerialVolAccessSkipCtrlrExpandVol is the name of the environment
+	// variable used to determine whether or not to exclude the ControllerExpandVolume
+	// RPC from serial volume access.
+	EnvVarSerialVolAccessSkipCtrlrExpandVol = "X_CSI_SERIAL_VOL_ACCESS_SKIP_CTRLR_EXPAND_VOL"
+
+	// EnvVarSerialVolAccessSkipNodeExpandVol is the name of the environment
+	// variable used to determine whether or not to exclude the NodeExpandVolume
+	// RPC from serial volume access.
+	EnvVarSerialVolAccessSkipNodeExpandVol = "X_CSI_SERIAL_VOL_ACCESS_SKIP_NODE_EXPAND_VOL"
+
+	// EnvVarSerialVolAccessSkipCreateSnap is the name of the environment
+	// variable used to determine whether or not to exclude the CreateSnapshot
+	// RPC from serial volume access.
+	EnvVarSerialVolAccessSkipCreateSnap = "X_CSI_SERIAL_VOL_ACCESS_SKIP_CREATE_SNAP"
+
+	// EnvVarSerialVolAccessFlockDir is the name of the environment
+	// variable that defines the directory in which the flock lock
+	// provider creates its lock files.
+	EnvVarSerialVolAccessFlockDir = "X_CSI_SERIAL_VOL_ACCESS_FLOCK_DIR"
+
+	// EnvVarSerialVolAccessDebugAddr is the name of the environment
+	// variable that defines the address of a debug HTTP endpoint that
+	// reports the volume locks that are held or waited for.
+	EnvVarSerialVolAccessDebugAddr = "X_CSI_SERIAL_VOL_ACCESS_DEBUG_ADDR"
+
 	// EnvVarSerialVolAccessEtcdDomain is the name of the environment
 	// variable that defines the lock provider's concurrency domain.
 	EnvVarSerialVolAccessEtcdDomain = "X_CSI_SERIAL_VOL_ACCESS_ETCD_DOMAIN"
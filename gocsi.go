@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
@@ -27,6 +28,7 @@ import (
 	"google.golang.org/grpc"
 
 	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/middleware/specvalidator"
 	"github.com/rexray/gocsi/utils"
 )
 
@@ -192,10 +194,30 @@ type StoragePlugin struct {
 	// EnvVars is a list of default environment variables and values.
 	EnvVars []string
 
+	// SupportedVolumeCapabilities is an optional description of the volume
+	// capabilities supported by the SP. If set, requests with unsupported
+	// volume capabilities are rejected before the SP's handlers run. The
+	// X_CSI_SUPPORTED_* environment variables override the eponymous
+	// fields.
+	SupportedVolumeCapabilities *specvalidator.VolumeCapabilitySupport
+
+	// SpecValidatorStats is an optional Stats that counts the violations
+	// found by the spec validator, ex. the number of errors returned by
+	// the SP with codes the CSI specification does not permit.
+	SpecValidatorStats *specvalidator.Stats
+
 	serveOnce sync.Once
 	stopOnce  sync.Once
 	server    *grpc.Server
 
+	// stopLockTableSignal removes the signal handler that logs the serial
+	// volume access middleware's lock table.
+	stopLockTableSignal func()
+
+	// lockTableServer serves the serial volume access middleware's lock
+	// table with a debug HTTP endpoint.
+	lockTableServer *http.Server
+
 	envVars    map[string]string
 	pluginInfo csi.GetPluginInfoResponse
 }
@@ -238,7 +260,9 @@ func (sp *StoragePlugin) Serve(ctx context.Context, lis net.Listener) error {
 		sp.initPluginInfo(ctx)
 
 		// Initialize the interceptors.
-		sp.initInterceptors(ctx)
+		if err = sp.initInterceptors(ctx); err != nil {
+			return
+		}
 
 		// Invoke the SP's BeforeServe function to give the SP a chance
 		// to perform any local initialization routines.
@@ -320,6 +344,12 @@ func (sp *StoragePlugin) Serve(ctx context.Context, lis net.Listener) error {
 // errors.
 func (sp *StoragePlugin) Stop(ctx context.Context) {
 	sp.stopOnce.Do(func() {
+		if sp.stopLockTableSignal != nil {
+			sp.stopLockTableSignal()
+		}
+		if sp.lockTableServer != nil {
+			sp.lockTableServer.Close()
+		}
 		if sp.server != nil {
 			sp.server.Stop()
 		}
@@ -332,6 +362,12 @@ func (sp *StoragePlugin) Stop(ctx context.Context) {
 // pending RPCs are finished.
 func (sp *StoragePlugin) GracefulStop(ctx context.Context) {
 	sp.stopOnce.Do(func() {
+		if sp.stopLockTableSignal != nil {
+			sp.stopLockTableSignal()
+		}
+		if sp.lockTableServer != nil {
+			sp.lockTableServer.Shutdown(ctx)
+		}
 		if sp.server != nil {
 			sp.server.GracefulStop()
 		}
@@ -1,9 +1,15 @@
 package gocsi
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -11,13 +17,16 @@ import (
 	csictx "github.com/rexray/gocsi/context"
 	"github.com/rexray/gocsi/middleware/logging"
 	"github.com/rexray/gocsi/middleware/requestid"
+	"github.com/rexray/gocsi/middleware/secrets"
 	"github.com/rexray/gocsi/middleware/serialvolume"
 	"github.com/rexray/gocsi/middleware/serialvolume/etcd"
+	"github.com/rexray/gocsi/middleware/serialvolume/flock"
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
 	"github.com/rexray/gocsi/middleware/specvalidator"
 	"github.com/rexray/gocsi/utils"
 )
 
-func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
+func (sp *StoragePlugin) initInterceptors(ctx context.Context) error {
 
 	sp.Interceptors = append(sp.Interceptors, sp.injectContext)
 	log.Debug("enabled context injector")
@@ -26,8 +35,15 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 		withReqLogging         = sp.getEnvBool(ctx, EnvVarReqLogging)
 		withRepLogging         = sp.getEnvBool(ctx, EnvVarRepLogging)
 		withDisableLogVolCtx   = sp.getEnvBool(ctx, EnvVarLoggingDisableVolCtx)
+		withLogAsJSON          = sp.getEnvBool(ctx, EnvVarLoggingAsJSON)
+		withLogRepStatus       = sp.getEnvBool(ctx, EnvVarLoggingRepStatus)
+		withReqIDInjection     = sp.getEnvBool(ctx, EnvVarReqIDInjection)
 		withSerialVol          = sp.getEnvBool(ctx, EnvVarSerialVolAccess)
 		withSpec               = sp.getEnvBool(ctx, EnvVarSpecValidation)
+		withSpecCross          = sp.getEnvBool(ctx, EnvVarSpecCrossValidation)
+		withSpecAggregate      = sp.getEnvBool(ctx, EnvVarSpecAggregateViolations)
+		withSpecRemapErrCodes  = sp.getEnvBool(ctx, EnvVarSpecRemapErrCodes)
+		withSpecAudit          = sp.getEnvBool(ctx, EnvVarSpecAudit)
 		withStgTgtPath         = sp.getEnvBool(ctx, EnvVarRequireStagingTargetPath)
 		withVolContext         = sp.getEnvBool(ctx, EnvVarRequireVolContext)
 		withPubContext         = sp.getEnvBool(ctx, EnvVarRequirePubContext)
@@ -38,6 +54,9 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 		withCredsCtrlrUnpubVol = sp.getEnvBool(ctx, EnvVarCredsCtrlrUnpubVol)
 		withCredsNodeStgVol    = sp.getEnvBool(ctx, EnvVarCredsNodeStgVol)
 		withCredsNodePubVol    = sp.getEnvBool(ctx, EnvVarCredsNodePubVol)
+		withCredsNewSnap       = sp.getEnvBool(ctx, EnvVarCredsCreateSnap)
+		withCredsDelSnap       = sp.getEnvBool(ctx, EnvVarCredsDeleteSnap)
+		withCredsCtrlrExpVol   = sp.getEnvBool(ctx, EnvVarCredsCtrlrExpandVol)
 		withDisableFieldLen    = sp.getEnvBool(ctx, EnvVarDisableFieldLen)
 	)
 
@@ -49,19 +68,27 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 		withCredsCtrlrUnpubVol = true
 		withCredsNodeStgVol = true
 		withCredsNodePubVol = true
+		withCredsNewSnap = true
+		withCredsDelSnap = true
+		withCredsCtrlrExpVol = true
 	}
 
 	// Initialize request & response validation to the global validaiton value.
+	// Audit mode implicitly enables both.
 	var (
-		withSpecReq = withSpec
-		withSpecRep = withSpec
+		withSpecReq = withSpec || withSpecAudit
+		withSpecRep = withSpec || withSpecAudit
 	)
 	log.WithField("withSpec", withSpec).Debug("init req & rep validation")
 
+	// Get the volume capabilities supported by the SP, if declared.
+	volCapSupport := sp.getVolumeCapabilitySupport(ctx)
+
 	// If request validation is not enabled explicitly, check to see if it
 	// should be enabled implicitly.
 	if !withSpecReq {
-		withSpecReq = withCreds ||
+		withSpecReq = volCapSupport != nil ||
+			withCreds ||
 			withStgTgtPath ||
 			withVolContext ||
 			withPubContext
@@ -69,6 +96,13 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 			"init implicit req validation")
 	}
 
+	// Cross-validation implicitly enables response validation.
+	if !withSpecRep && withSpecCross {
+		withSpecRep = true
+		log.WithField("withSpecRep", withSpecRep).Debug(
+			"init implicit rep validation")
+	}
+
 	// Check to see if spec request or response validation are overridden.
 	if v, ok := csictx.LookupEnv(ctx, EnvVarSpecReqValidation); ok {
 		withSpecReq, _ = strconv.ParseBool(v)
@@ -79,14 +113,40 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 		log.WithField("withSpecRep", withSpecRep).Debug("init rep validation")
 	}
 
-	// Configure logging.
-	if withReqLogging || withRepLogging {
-		// Automatically enable request ID injection if logging
-		// is enabled.
+	// Get the threshold used to log slow RPCs.
+	var slowRPCThreshold time.Duration
+	if v := csictx.Getenv(ctx, EnvVarLoggingSlowRPCThreshold); v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			log.WithError(err).Fatalf(
+				"invalid %s: %s", EnvVarLoggingSlowRPCThreshold, v)
+		}
+		slowRPCThreshold = t
+	}
+
+	withLogging := withReqLogging || withRepLogging || slowRPCThreshold > 0
+
+	// Configure request ID injection. Request ID injection is
+	// automatically enabled if logging is enabled.
+	if withReqIDInjection || withLogging {
+		var reqIDOpts []requestid.Option
+		if v := csictx.Getenv(ctx, EnvVarReqIDUpstreamKey); v != "" {
+			reqIDOpts = append(reqIDOpts, requestid.WithUpstreamKey(v))
+			log.WithField("key", v).Debug(
+				"enabled request ID injector opt: upstream key")
+		}
 		sp.Interceptors = append(sp.Interceptors,
-			requestid.NewServerRequestIDInjector())
+			requestid.NewServerRequestIDInjector(reqIDOpts...))
 		log.Debug("enabled request ID injector")
+	}
+
+	// Inject the request-scoped logger after the request ID so the
+	// logger includes the ID.
+	sp.Interceptors = append(sp.Interceptors, sp.injectLogger)
+	log.Debug("enabled logger injector")
 
+	// Configure logging.
+	if withLogging {
 		var (
 			loggingOpts []logging.Option
 			w           = newLogger(log.Debugf)
@@ -97,6 +157,53 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 			log.Debug("disabled logging of VolumeContext field")
 		}
 
+		if v := csictx.Getenv(ctx, EnvVarLoggingRedactKeys); v != "" {
+			var patts []*regexp.Regexp
+			for _, p := range utils.ParseSlice(v) {
+				rx, err := regexp.Compile(p)
+				if err != nil {
+					log.WithError(err).Fatalf(
+						"invalid %s pattern: %s", EnvVarLoggingRedactKeys, p)
+				}
+				patts = append(patts, rx)
+			}
+			loggingOpts = append(loggingOpts, logging.WithRedactKeys(patts...))
+			log.WithField("patterns", v).Debug("enabled logging redaction")
+		}
+
+		if v := csictx.Getenv(ctx, EnvVarLoggingMaxListLen); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.WithError(err).Fatalf(
+					"invalid %s: %s", EnvVarLoggingMaxListLen, v)
+			}
+			loggingOpts = append(loggingOpts, logging.WithMaxListLen(n))
+			log.WithField("maxListLen", n).Debug("enabled logging list truncation")
+		}
+
+		if withLogAsJSON {
+			loggingOpts = append(loggingOpts, logging.WithJSONFormat())
+			log.Debug("enabled logging of requests and responses as JSON")
+		}
+
+		if withLogRepStatus {
+			loggingOpts = append(loggingOpts, logging.WithResponseStatus())
+			log.Debug("enabled logging of response codes and durations")
+		}
+
+		if v := csictx.Getenv(ctx, EnvVarLoggingExcludeMethods); v != "" {
+			loggingOpts = append(loggingOpts,
+				logging.WithExcludeMethods(utils.ParseSlice(v)...))
+			log.WithField("methods", v).Debug("excluded methods from logging")
+		}
+
+		if slowRPCThreshold > 0 {
+			loggingOpts = append(loggingOpts,
+				logging.WithSlowThreshold(slowRPCThreshold))
+			log.WithField("threshold", slowRPCThreshold).Debug(
+				"enabled logging of slow rpcs")
+		}
+
 		if withReqLogging {
 			loggingOpts = append(loggingOpts, logging.WithRequestLogging(w))
 			log.Debug("enabled request logging")
@@ -109,6 +216,14 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 			logging.NewServerLogger(loggingOpts...))
 	}
 
+	// Configure the secrets injector. It precedes the spec validator so
+	// injected secrets satisfy the X_CSI_REQUIRE_CREDS* options.
+	if secretsOpts := sp.getSecretsOpts(ctx); len(secretsOpts) > 0 {
+		sp.Interceptors = append(sp.Interceptors,
+			secrets.NewServerSecretsInjector(secretsOpts...))
+		log.Debug("enabled secrets injector")
+	}
+
 	if withSpecReq || withSpecRep {
 		var specOpts []specvalidator.Option
 
@@ -124,6 +239,43 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 				specvalidator.WithResponseValidation())
 			log.Debug("enabled spec validator opt: response validation")
 		}
+		if withSpecCross {
+			specOpts = append(
+				specOpts,
+				specvalidator.WithCrossValidation())
+			log.Debug("enabled spec validator opt: cross validation")
+		}
+		if withSpecAggregate {
+			specOpts = append(
+				specOpts,
+				specvalidator.WithAggregatedViolations())
+			log.Debug("enabled spec validator opt: aggregated violations")
+		}
+		if withSpecRemapErrCodes {
+			specOpts = append(
+				specOpts,
+				specvalidator.WithErrorCodeRemap())
+			log.Debug("enabled spec validator opt: remap error codes")
+		}
+		if volCapSupport != nil {
+			specOpts = append(
+				specOpts,
+				specvalidator.WithSupportedVolumeCapabilities(*volCapSupport))
+			log.WithField("volCapSupport", *volCapSupport).Debug(
+				"enabled spec validator opt: supported volume capabilities")
+		}
+		if withSpecAudit {
+			specOpts = append(
+				specOpts,
+				specvalidator.WithAuditMode())
+			log.Debug("enabled spec validator opt: audit mode")
+		}
+		if sp.SpecValidatorStats != nil {
+			specOpts = append(
+				specOpts,
+				specvalidator.WithStats(sp.SpecValidatorStats))
+			log.Debug("enabled spec validator opt: stats")
+		}
 		if withCredsNewVol {
 			specOpts = append(specOpts,
 				specvalidator.WithRequiresControllerCreateVolumeSecrets())
@@ -160,6 +312,51 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 			log.Debug("enabled spec validator opt: requires creds: " +
 				"NodePublishVolume")
 		}
+		if withCredsNewSnap {
+			specOpts = append(specOpts,
+				specvalidator.WithRequiresControllerCreateSnapshotSecrets())
+			log.Debug("enabled spec validator opt: requires creds: " +
+				"CreateSnapshot")
+		}
+		if withCredsDelSnap {
+			specOpts = append(specOpts,
+				specvalidator.WithRequiresControllerDeleteSnapshotSecrets())
+			log.Debug("enabled spec validator opt: requires creds: " +
+				"DeleteSnapshot")
+		}
+		if withCredsCtrlrExpVol {
+			specOpts = append(specOpts,
+				specvalidator.WithRequiresControllerExpandVolumeSecrets())
+			log.Debug("enabled spec validator opt: requires creds: " +
+				"ControllerExpandVolume")
+		}
+
+		// Unless topology validation is explicitly enabled or disabled it
+		// depends on whether the SP advertises the
+		// VOLUME_ACCESSIBILITY_CONSTRAINTS capability. The SP is not asked
+		// for its capabilities until the first validated RPC since it may
+		// not be ready to report them until BeforeServe is invoked.
+		if v, ok := csictx.LookupEnv(ctx, EnvVarSpecTopology); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				log.WithError(err).Fatalf(
+					"invalid %s: %s", EnvVarSpecTopology, v)
+			}
+			if b {
+				specOpts = append(specOpts,
+					specvalidator.WithTopologyValidation())
+				log.Debug("enabled spec validator opt: topology validation")
+			}
+		} else {
+			specOpts = append(specOpts,
+				specvalidator.WithTopologyValidationFunc(
+					func(ctx context.Context) (bool, error) {
+						return sp.hasPluginServiceCapability(ctx,
+							csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS)
+					}))
+			log.Debug("enabled spec validator opt: topology validation " +
+				"if advertised")
+		}
 
 		if withStgTgtPath {
 			specOpts = append(specOpts,
@@ -182,6 +379,28 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 				specvalidator.WithDisableFieldLenCheck())
 			log.Debug("disabled spec validator opt: field length check")
 		}
+		if v := csictx.Getenv(ctx, EnvVarFieldLenMaxString); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.WithError(err).Fatalf(
+					"invalid %s: %s", EnvVarFieldLenMaxString, v)
+			}
+			specOpts = append(specOpts,
+				specvalidator.WithMaxFieldStringSize(n))
+			log.WithField("max", n).Debug(
+				"enabled spec validator opt: max string field length")
+		}
+		if v := csictx.Getenv(ctx, EnvVarFieldLenMaxMap); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.WithError(err).Fatalf(
+					"invalid %s: %s", EnvVarFieldLenMaxMap, v)
+			}
+			specOpts = append(specOpts,
+				specvalidator.WithMaxFieldMapSize(n))
+			log.WithField("max", n).Debug(
+				"enabled spec validator opt: max map field length")
+		}
 		sp.Interceptors = append(sp.Interceptors,
 			specvalidator.NewServerSpecValidator(specOpts...))
 	}
@@ -206,6 +425,61 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 			}
 		}
 
+		// Get serial provider's retry delay.
+		if v, _ := csictx.LookupEnv(
+			ctx, EnvVarSerialVolAccessRetryDelay); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.WithError(err).Fatalf("invalid %s: %s",
+					EnvVarSerialVolAccessRetryDelay, v)
+			}
+			fields["serialVol.retryDelay"] = d
+			opts = append(opts, serialvolume.WithRetryDelay(d))
+		}
+
+		// Check for RPCs excluded from serial volume access.
+		for _, s := range []struct {
+			key string
+			opt serialvolume.Option
+		}{
+			{EnvVarSerialVolAccessSkipNodeStg, serialvolume.WithSkipNodeStageVolume()},
+			{EnvVarSerialVolAccessSkipNodeUnstg, serialvolume.WithSkipNodeUnstageVolume()},
+			{EnvVarSerialVolAccessSkipCtrlrExpandVol, serialvolume.WithSkipControllerExpandVolume()},
+			{EnvVarSerialVolAccessSkipNodeExpandVol, serialvolume.WithSkipNodeExpandVolume()},
+			{EnvVarSerialVolAccessSkipCreateSnap, serialvolume.WithSkipCreateSnapshot()},
+		} {
+			if sp.getEnvBool(ctx, s.key) {
+				fields[s.key] = true
+				opts = append(opts, s.opt)
+			}
+		}
+
+		// Get the modes in which volume locks are obtained.
+		for method, v := range utils.ParseMap(
+			csictx.Getenv(ctx, EnvVarSerialVolAccessLockModes)) {
+
+			mode, ok := mwtypes.ParseLockMode(strings.ToLower(v))
+			if !ok {
+				log.Fatalf("invalid %s: %s=%s",
+					EnvVarSerialVolAccessLockModes, method, v)
+			}
+			fields["serialVol.lockMode."+method] = mode
+			opts = append(opts, serialvolume.WithLockMode(method, mode))
+		}
+
+		// Get the granularities of the volume locks.
+		for method, v := range utils.ParseMap(
+			csictx.Getenv(ctx, EnvVarSerialVolAccessLockGranularity)) {
+
+			g, ok := serialvolume.ParseLockGranularity(strings.ToLower(v))
+			if !ok {
+				log.Fatalf("invalid %s: %s=%s",
+					EnvVarSerialVolAccessLockGranularity, method, v)
+			}
+			fields["serialVol.lockGranularity."+method] = g
+			opts = append(opts, serialvolume.WithLockGranularity(method, g))
+		}
+
 		// Check for etcd
 		if csictx.Getenv(ctx, EnvVarSerialVolAccessEtcdEndpoints) != "" {
 			p, err := etcd.New(ctx, "", 0, nil)
@@ -213,13 +487,92 @@ func (sp *StoragePlugin) initInterceptors(ctx context.Context) {
 				log.Fatal(err)
 			}
 			opts = append(opts, serialvolume.WithLockProvider(p))
+		} else if csictx.Getenv(ctx, EnvVarSerialVolAccessFlockDir) != "" {
+			// Check for flock
+			p, err := flock.New(ctx, "")
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts = append(opts, serialvolume.WithLockProvider(p))
+		}
+
+		// If an address is specified then report the lock table with a
+		// debug HTTP endpoint and on SIGUSR1.
+		if addr := csictx.Getenv(
+			ctx, EnvVarSerialVolAccessDebugAddr); addr != "" {
+
+			// The lock table reveals lock holders without authentication
+			// so it is only served on the loopback interface.
+			addr, err := loopbackAddr(addr)
+			if err != nil {
+				log.WithError(err).Fatalf(
+					"invalid %s", EnvVarSerialVolAccessDebugAddr)
+			}
+			fields["serialVol.debugAddr"] = addr
+			insp := &serialvolume.Inspector{}
+			opts = append(opts, serialvolume.WithInspector(insp))
+			if err := sp.serveLockTable(addr, insp); err != nil {
+				return err
+			}
+			sp.stopLockTableSignal = trapLockTableSignal(ctx, insp)
 		}
 
 		sp.Interceptors = append(sp.Interceptors, serialvolume.New(opts...))
 		log.WithFields(fields).Debug("enabled serial volume access")
 	}
 
-	return
+	return nil
+}
+
+// secretsDirEnvVars maps the environment variables that specify
+// RPC-specific secrets directories to the names of the RPCs.
+var secretsDirEnvVars = []struct {
+	key string
+	rpc string
+}{
+	{EnvVarSecretsDirCreateVol, "CreateVolume"},
+	{EnvVarSecretsDirDeleteVol, "DeleteVolume"},
+	{EnvVarSecretsDirCtrlrPubVol, "ControllerPublishVolume"},
+	{EnvVarSecretsDirCtrlrUnpubVol, "ControllerUnpublishVolume"},
+	{EnvVarSecretsDirValidateVolCaps, "ValidateVolumeCapabilities"},
+	{EnvVarSecretsDirCreateSnap, "CreateSnapshot"},
+	{EnvVarSecretsDirDeleteSnap, "DeleteSnapshot"},
+	{EnvVarSecretsDirListSnap, "ListSnapshots"},
+	{EnvVarSecretsDirCtrlrExpandVol, "ControllerExpandVolume"},
+	{EnvVarSecretsDirNodeStgVol, "NodeStageVolume"},
+	{EnvVarSecretsDirNodePubVol, "NodePublishVolume"},
+}
+
+func (sp *StoragePlugin) getSecretsOpts(
+	ctx context.Context) []secrets.Option {
+
+	var opts []secrets.Option
+	if v := csictx.Getenv(ctx, EnvVarSecretsDir); v != "" {
+		opts = append(opts, secrets.WithSecretsDir(v))
+		log.WithField("dir", v).Debug("enabled secrets injector opt: " +
+			"secrets dir")
+	}
+	for _, e := range secretsDirEnvVars {
+		if v := csictx.Getenv(ctx, e.key); v != "" {
+			opts = append(opts, secrets.WithSecretsDir(v, e.rpc))
+			log.WithField("dir", v).Debug("enabled secrets injector opt: " +
+				"secrets dir: " + e.rpc)
+		}
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	if v := csictx.Getenv(ctx, EnvVarSecretsStatInterval); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s: %s",
+				EnvVarSecretsStatInterval, v)
+		}
+		opts = append(opts, secrets.WithStatInterval(d))
+		log.WithField("interval", d).Debug("enabled secrets injector opt: " +
+			"stat interval")
+	}
+	return opts
 }
 
 func (sp *StoragePlugin) injectContext(
@@ -231,6 +584,115 @@ func (sp *StoragePlugin) injectContext(
 	return handler(csictx.WithLookupEnv(ctx, sp.lookupEnv), req)
 }
 
+type hasNodeID interface {
+	GetNodeId() string
+}
+
+type hasTargetPath interface {
+	GetTargetPath() string
+}
+
+type hasVolumeID interface {
+	GetVolumeId() string
+}
+
+func (sp *StoragePlugin) injectLogger(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	fields := map[string]interface{}{
+		"method": info.FullMethod,
+	}
+	if id, ok := csictx.GetRequestIDString(ctx); ok {
+		fields["requestID"] = id
+	}
+	if treq, ok := req.(hasVolumeID); ok && treq.GetVolumeId() != "" {
+		fields["volumeID"] = treq.GetVolumeId()
+	}
+	if treq, ok := req.(hasNodeID); ok && treq.GetNodeId() != "" {
+		fields["nodeID"] = treq.GetNodeId()
+	}
+	if treq, ok := req.(hasTargetPath); ok && treq.GetTargetPath() != "" {
+		fields["targetPath"] = treq.GetTargetPath()
+	}
+
+	return handler(csictx.WithLogger(ctx, log.WithFields(fields)), req)
+}
+
+// getVolumeCapabilitySupport returns the volume capabilities supported by
+// the SP as declared by the SupportedVolumeCapabilities field and the
+// X_CSI_SUPPORTED_* environment variables. A nil value is returned if no
+// supported volume capabilities are declared.
+func (sp *StoragePlugin) getVolumeCapabilitySupport(
+	ctx context.Context) *specvalidator.VolumeCapabilitySupport {
+
+	var vcs specvalidator.VolumeCapabilitySupport
+	if sp.SupportedVolumeCapabilities != nil {
+		vcs = *sp.SupportedVolumeCapabilities
+	}
+
+	if v, ok := csictx.LookupEnv(ctx, EnvVarSupportedAccessModes); ok {
+		vcs.AccessModes = nil
+		for _, m := range utils.ParseSlice(v) {
+			i, ok := csi.VolumeCapability_AccessMode_Mode_value[strings.ToUpper(m)]
+			if !ok {
+				log.Fatalf("invalid %s: %s", EnvVarSupportedAccessModes, m)
+			}
+			vcs.AccessModes = append(
+				vcs.AccessModes, csi.VolumeCapability_AccessMode_Mode(i))
+		}
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvVarSupportedAccessTypes); ok {
+		vcs.Block, vcs.Mount = false, false
+		for _, t := range utils.ParseSlice(v) {
+			switch strings.ToLower(t) {
+			case "block":
+				vcs.Block = true
+			case "mount":
+				vcs.Mount = true
+			default:
+				log.Fatalf("invalid %s: %s", EnvVarSupportedAccessTypes, t)
+			}
+		}
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvVarSupportedFsTypes); ok {
+		vcs.FsTypes = utils.ParseSlice(v)
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvVarSupportedMountFlags); ok {
+		vcs.MountFlags = utils.ParseSlice(v)
+	}
+
+	if len(vcs.AccessModes) == 0 && !vcs.Block && !vcs.Mount &&
+		len(vcs.FsTypes) == 0 && len(vcs.MountFlags) == 0 {
+		return nil
+	}
+	return &vcs
+}
+
+// hasPluginServiceCapability returns a flag indicating whether or not
+// the SP's Identity service advertises the provided service capability.
+func (sp *StoragePlugin) hasPluginServiceCapability(
+	ctx context.Context,
+	capType csi.PluginCapability_Service_Type) (bool, error) {
+
+	if sp.Identity == nil {
+		return false, nil
+	}
+	rep, err := sp.Identity.GetPluginCapabilities(
+		ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		return false, err
+	}
+	for _, c := range rep.GetCapabilities() {
+		if svc := c.GetService(); svc != nil && svc.Type == capType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (sp *StoragePlugin) getPluginInfo(
 	ctx context.Context,
 	req interface{},
@@ -251,3 +713,45 @@ func (sp *StoragePlugin) getPluginInfo(
 
 	return &sp.pluginInfo, nil
 }
+
+// loopbackAddr returns the provided address if its host is a loopback
+// address. An address without a host is returned with the host 127.0.0.1.
+func loopbackAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if host == "localhost" {
+		return addr, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return addr, nil
+	}
+	return "", fmt.Errorf("not a loopback address: %s", addr)
+}
+
+// serveLockTable serves the serial volume access middleware's lock table
+// with a debug HTTP endpoint at addr. The address is bound before
+// serveLockTable returns so that an address in use fails startup.
+func (sp *StoragePlugin) serveLockTable(
+	addr string, insp *serialvolume.Inspector) error {
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to serve volume lock table: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/serialvolume/locks", insp)
+	sp.lockTableServer = &http.Server{Handler: mux}
+	go func(srv *http.Server) {
+		log.WithField("addr", addr).Info("serving volume lock table")
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Errorf(
+				"failed to serve volume lock table: %s", addr)
+		}
+	}(sp.lockTableServer)
+	return nil
+}
@@ -1,16 +1,36 @@
+// Package logging provides a gRPC interceptor that logs CSI requests and
+// responses.
+//
+// Requests and responses are logged in the following format:
+//
+//	METHOD: REQ ID: FIELD=VALUE, ...
+//	METHOD: REP ID: ERROR: FIELD=VALUE, ...
+//
+// Numeric request IDs are zero-padded to four digits, ex. "REQ 0001",
+// as they always have been. Request IDs that are not numeric, ex. UUIDs,
+// are logged as they are. The WithResponseStatus option inserts the gRPC
+// result code and the duration of the RPC after the response's request
+// ID, ex. "REP 0001: code=OK, duration=1.2ms".
 package logging
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 
 	csictx "github.com/rexray/gocsi/context"
 	"github.com/rexray/gocsi/utils"
@@ -23,6 +43,12 @@ type opts struct {
 	reqw             io.Writer
 	repw             io.Writer
 	disableLogVolCtx bool
+	redactKeys       []*regexp.Regexp
+	slowThreshold    time.Duration
+	excludeMethods   map[string]struct{}
+	maxListLen       int
+	jsonFormat       bool
+	repStatus        bool
 }
 
 // WithRequestLogging is a Option that enables request logging
@@ -55,6 +81,70 @@ func WithDisableLogVolumeContext() Option {
 	}
 }
 
+// WithRedactKeys is an Option that replaces the values of map entries
+// with keys that match any of the provided patterns with "***" when
+// logging requests and responses. The patterns are applied to the
+// entries of all maps, ex. Parameters, VolumeContext, and PublishContext,
+// including the maps of nested messages such as CreateVolumeResponse.Volume.
+// The values of the redacted entries, and of all secrets, are also replaced
+// wherever they appear in logged errors and slow RPC warnings.
+func WithRedactKeys(patterns ...*regexp.Regexp) Option {
+	return func(o *opts) {
+		o.redactKeys = append(o.redactKeys, patterns...)
+	}
+}
+
+// WithSlowThreshold is an Option that logs a warning for every RPC that
+// takes longer than the provided duration to complete. The warning is
+// logged even if response logging is disabled.
+func WithSlowThreshold(t time.Duration) Option {
+	return func(o *opts) {
+		o.slowThreshold = t
+	}
+}
+
+// WithExcludeMethods is an Option that excludes the provided methods from
+// request and response logging, ex. methods that are frequently polled by
+// the CO such as Probe and NodeGetCapabilities. A method may be specified
+// by its name, ex. "Probe", or its full name, ex.
+// "/csi.v1.Identity/Probe". Excluded methods are still subject to the
+// slow RPC warning enabled with WithSlowThreshold.
+func WithExcludeMethods(methods ...string) Option {
+	return func(o *opts) {
+		if o.excludeMethods == nil {
+			o.excludeMethods = map[string]struct{}{}
+		}
+		for _, m := range methods {
+			o.excludeMethods[m] = struct{}{}
+		}
+	}
+}
+
+// WithMaxListLen is an Option that truncates the lists in logged
+// requests and responses, ex. ListVolumesResponse.Entries, to the
+// provided number of elements. A value of zero disables truncation.
+func WithMaxListLen(n int) Option {
+	return func(o *opts) {
+		o.maxListLen = n
+	}
+}
+
+// WithJSONFormat is an Option that logs complete requests and responses
+// as JSON objects instead of lists of their top-level fields.
+func WithJSONFormat() Option {
+	return func(o *opts) {
+		o.jsonFormat = true
+	}
+}
+
+// WithResponseStatus is an Option that logs the gRPC result code and the
+// time it took to complete the RPC with every response.
+func WithResponseStatus() Option {
+	return func(o *opts) {
+		o.repStatus = true
+	}
+}
+
 type interceptor struct {
 	opts opts
 }
@@ -120,69 +210,180 @@ func (s *interceptor) handle(
 		return next()
 	}
 
+	var (
+		reqw = s.opts.reqw
+		repw = s.opts.repw
+	)
+	if s.isExcludedMethod(method) {
+		reqw, repw = nil, nil
+	}
+
+	// If there is nothing to log then pass control to the next handler
+	// in the chain.
+	if reqw == nil && repw == nil && s.opts.slowThreshold <= 0 {
+		return next()
+	}
+
 	w := &bytes.Buffer{}
-	reqID, reqIDOK := csictx.GetRequestID(ctx)
+	reqID, reqIDOK := csictx.GetRequestIDString(ctx)
 
 	// Print the request
-	if s.opts.reqw != nil {
+	if reqw != nil {
 		fmt.Fprintf(w, "%s: ", method)
 		if reqIDOK {
-			fmt.Fprintf(w, "REQ %04d", reqID)
+			fmt.Fprintf(w, "REQ %s", formatRequestID(reqID))
 		}
 		s.rprintReqOrRep(w, req)
-		fmt.Fprintln(s.opts.reqw, w.String())
+		fmt.Fprintln(reqw, w.String())
 	}
 
 	w.Reset()
 
 	// Get the response.
+	start := time.Now()
 	rep, failed = next()
+	elapsed := time.Since(start)
+	code := status.Code(failed)
 
-	if s.opts.repw == nil {
+	// Warn about the RPC if it exceeded the slow threshold.
+	if t := s.opts.slowThreshold; t > 0 && elapsed > t {
+		fields := map[string]interface{}{
+			"method":    method,
+			"code":      code.String(),
+			"duration":  elapsed,
+			"threshold": t,
+		}
+		if reqIDOK {
+			fields["requestID"] = reqID
+		}
+		if failed != nil {
+			fields["error"] = s.redactError(failed, req, rep)
+		}
+		log.WithFields(fields).Warn("slow rpc")
+	}
+
+	if repw == nil {
 		return
 	}
 
 	// Print the response method name.
 	fmt.Fprintf(w, "%s: ", method)
 	if reqIDOK {
-		fmt.Fprintf(w, "REP %04d", reqID)
+		fmt.Fprintf(w, "REP %s", formatRequestID(reqID))
+	}
+
+	// Print the response code and the time it took to get the response.
+	if s.opts.repStatus {
+		fmt.Fprintf(w, ": code=%s, duration=%s", code, elapsed)
 	}
 
 	// Print the response error if it is set.
 	if failed != nil {
 		fmt.Fprint(w, ": ")
-		fmt.Fprint(w, failed)
+		fmt.Fprint(w, s.redactError(failed, req, rep))
 	}
 
 	// Print the response data if it is set.
 	if !utils.IsNilResponse(rep) {
 		s.rprintReqOrRep(w, rep)
 	}
-	fmt.Fprintln(s.opts.repw, w.String())
+	fmt.Fprintln(repw, w.String())
 
 	return
 }
 
+// formatRequestID zero-pads numeric request IDs to four digits so they
+// are logged as they were before string request IDs were supported.
+func formatRequestID(id string) string {
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return fmt.Sprintf("%04d", n)
+	}
+	return id
+}
+
+func (s *interceptor) isExcludedMethod(method string) bool {
+	if len(s.opts.excludeMethods) == 0 {
+		return false
+	}
+	if _, ok := s.opts.excludeMethods[method]; ok {
+		return true
+	}
+	if _, _, name, err := utils.ParseMethod(method); err == nil {
+		if _, ok := s.opts.excludeMethods[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 var emptyValRX = regexp.MustCompile(
 	`^((?:)|(?:\[\])|(?:<nil>)|(?:map\[\]))$`)
 
+// redacted is the value that replaces the values of redacted map entries.
+const redacted = "***"
+
+// jsonMarshaler renders messages using their protobuf JSON field names.
+var jsonMarshaler = &jsonpb.Marshaler{}
+
 // rprintReqOrRep is used by the server-side interceptors that log
 // requests and responses.
 func (s *interceptor) rprintReqOrRep(w io.Writer, obj interface{}) {
+	// Redact a copy of the message so the original is not modified.
+	msg, isMsg := obj.(proto.Message)
+	if isMsg {
+		msg = proto.Clone(msg)
+		obj = msg
+		s.redact(reflect.ValueOf(obj), false, nil)
+	}
+
 	rv := reflect.ValueOf(obj).Elem()
 	tv := rv.Type()
 	nf := tv.NumField()
+
+	// Render the message as generic JSON data keyed by the protobuf JSON
+	// field names. If the message cannot be rendered then its fields are
+	// formatted with their Go representations instead.
+	var data map[string]interface{}
+	if isMsg {
+		// Remove the fields that are never logged from the message.
+		for i := 0; i < nf; i++ {
+			if s.isOmittedField(tv.Field(i).Name) {
+				f := rv.Field(i)
+				f.Set(reflect.Zero(f.Type()))
+			}
+		}
+		data, _ = s.toJSONData(msg)
+	}
+
+	if s.opts.jsonFormat && data != nil {
+		fmt.Fprintf(w, ": %s", marshalJSON(data))
+		return
+	}
+
 	printedColon := false
 	printComma := false
 	for i := 0; i < nf; i++ {
-		name := tv.Field(i).Name
-		if strings.Contains(name, "Secrets") {
+		tf := tv.Field(i)
+		name := tf.Name
+		if strings.HasPrefix(name, "XXX_") || s.isOmittedField(name) {
 			continue
 		}
-		if s.opts.disableLogVolCtx && strings.Contains(name, "VolumeContext") {
-			continue
+		var sv string
+		switch tf.Type.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			if data != nil {
+				// Fields with empty values are omitted from the JSON data.
+				jv, ok := data[jsonFieldName(tf)]
+				if !ok {
+					continue
+				}
+				sv = marshalJSON(jv)
+				break
+			}
+			sv = fmt.Sprintf("%v", rv.Field(i).Interface())
+		default:
+			sv = fmt.Sprintf("%v", rv.Field(i).Interface())
 		}
-		sv := fmt.Sprintf("%v", rv.Field(i).Interface())
 		if emptyValRX.MatchString(sv) {
 			continue
 		}
@@ -197,3 +398,150 @@ func (s *interceptor) rprintReqOrRep(w io.Writer, obj interface{}) {
 		fmt.Fprintf(w, "%s=%s", name, sv)
 	}
 }
+
+// isOmittedField returns a flag indicating whether the top-level field
+// with the provided name is omitted from the logs.
+func (s *interceptor) isOmittedField(name string) bool {
+	if strings.Contains(name, "Secrets") {
+		return true
+	}
+	if s.opts.disableLogVolCtx && strings.Contains(name, "VolumeContext") {
+		return true
+	}
+	return false
+}
+
+// toJSONData renders the message as JSON and decodes the result into
+// generic data, truncating lists that exceed the configured length.
+func (s *interceptor) toJSONData(
+	msg proto.Message) (map[string]interface{}, error) {
+
+	buf := &bytes.Buffer{}
+	if err := jsonMarshaler.Marshal(buf, msg); err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	dec := json.NewDecoder(buf)
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	s.truncate(data)
+	return data, nil
+}
+
+// truncate walks the generic JSON data and shortens the lists that
+// exceed the configured length. The last element of a shortened list
+// indicates the number of elements that were removed.
+func (s *interceptor) truncate(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for k, e := range tv {
+			tv[k] = s.truncate(e)
+		}
+	case []interface{}:
+		if n := s.opts.maxListLen; n > 0 && len(tv) > n {
+			more := len(tv) - n
+			tv = append(tv[:n:n], fmt.Sprintf("...%d more", more))
+		}
+		for i, e := range tv {
+			tv[i] = s.truncate(e)
+		}
+		return tv
+	}
+	return v
+}
+
+// jsonFieldName returns the protobuf JSON name of a message's field.
+func jsonFieldName(f reflect.StructField) string {
+	var name string
+	for _, p := range strings.Split(f.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(p, "json=") {
+			return strings.TrimPrefix(p, "json=")
+		}
+		if strings.HasPrefix(p, "name=") {
+			name = strings.TrimPrefix(p, "name=")
+		}
+	}
+	return name
+}
+
+func marshalJSON(v interface{}) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// redact walks the provided value and replaces the values of the entries
+// of string maps whose keys match one of the redaction patterns. All of
+// the values of secrets maps, including those of nested messages, are
+// replaced. If vals is not nil then the replaced values are appended to it.
+func (s *interceptor) redact(rv reflect.Value, secrets bool, vals *[]string) {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !rv.IsNil() {
+			s.redact(rv.Elem(), false, vals)
+		}
+	case reflect.Struct:
+		tv := rv.Type()
+		for i := 0; i < rv.NumField(); i++ {
+			s.redact(
+				rv.Field(i),
+				strings.Contains(tv.Field(i).Name, "Secrets"),
+				vals)
+		}
+	case reflect.Slice:
+		switch rv.Type().Elem().Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Struct:
+			for i := 0; i < rv.Len(); i++ {
+				s.redact(rv.Index(i), false, vals)
+			}
+		}
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String ||
+			rv.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, k := range rv.MapKeys() {
+			if secrets || s.isRedactedKey(k.String()) {
+				if vals != nil {
+					*vals = append(*vals, rv.MapIndex(k).String())
+				}
+				rv.SetMapIndex(k, reflect.ValueOf(redacted))
+			}
+		}
+	}
+}
+
+// redactError returns the error's text with the values that are redacted
+// from the request and response replaced with "***".
+func (s *interceptor) redactError(err error, req, rep interface{}) string {
+	text := err.Error()
+	for _, obj := range []interface{}{req, rep} {
+		msg, ok := obj.(proto.Message)
+		if !ok || utils.IsNilResponse(obj) {
+			continue
+		}
+		var vals []string
+		s.redact(reflect.ValueOf(proto.Clone(msg)), false, &vals)
+		for _, v := range vals {
+			if v != "" {
+				text = strings.Replace(text, v, redacted, -1)
+			}
+		}
+	}
+	return text
+}
+
+func (s *interceptor) isRedactedKey(key string) bool {
+	for _, rx := range s.opts.redactKeys {
+		if rx.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,356 @@
+package logging
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+const createVolume = "/csi.v1.Controller/CreateVolume"
+
+// invoke sends the request through a logging interceptor configured
+// with the provided options and returns the logged request and response.
+func invoke(
+	t *testing.T,
+	method string,
+	req, rep interface{},
+	opts ...Option) (string, string) {
+
+	var reqw, repw bytes.Buffer
+	opts = append(opts, WithRequestLogging(&reqw), WithResponseLogging(&repw))
+	i := NewServerLogger(opts...)
+
+	ctx := metadata.NewIncomingContext(
+		context.Background(),
+		metadata.Pairs(csictx.RequestIDKey, "1"))
+	_, err := i(
+		ctx,
+		req,
+		&grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return rep, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reqw.String(), repw.String()
+}
+
+func TestLogging_Redact(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		req  proto.Message
+		exp  string
+		nexp []string
+	}{
+		{
+			name: "secrets",
+			req: &csi.CreateVolumeRequest{
+				Name:    "v",
+				Secrets: map[string]string{"password": "hunter2"},
+			},
+			exp:  `: REQ 0001: Name=v`,
+			nexp: []string{"hunter2", "Secrets"},
+		},
+		{
+			name: "parameters",
+			opts: []Option{WithRedactKeys(regexp.MustCompile(`(?i)token`))},
+			req: &csi.CreateVolumeRequest{
+				Name: "v",
+				Parameters: map[string]string{
+					"apiToken": "abc123",
+					"size":     "large",
+				},
+			},
+			exp:  `Parameters={"apiToken":"***","size":"large"}`,
+			nexp: []string{"abc123"},
+		},
+		{
+			name: "volume context",
+			opts: []Option{WithRedactKeys(regexp.MustCompile(`^key$`))},
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:      "v",
+				VolumeContext: map[string]string{"key": "val1"},
+				Parameters:    map[string]string{"other": "val2"},
+			},
+			exp:  `VolumeContext={"key":"***"}`,
+			nexp: []string{"val1"},
+		},
+		{
+			name: "disable volume context",
+			opts: []Option{WithDisableLogVolumeContext()},
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:      "v",
+				VolumeContext: map[string]string{"key": "val1"},
+			},
+			exp:  `: REQ 0001: VolumeId=v`,
+			nexp: []string{"VolumeContext", "val1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := proto.Clone(tt.req)
+			got, _ := invoke(t, createVolume, tt.req, nil, tt.opts...)
+			if !strings.Contains(got, tt.exp) {
+				t.Errorf("logged %q, expected %q", got, tt.exp)
+			}
+			for _, s := range tt.nexp {
+				if strings.Contains(got, s) {
+					t.Errorf("logged %q, unexpected %q", got, s)
+				}
+			}
+			if !proto.Equal(orig, tt.req) {
+				t.Errorf("request modified: %v", tt.req)
+			}
+		})
+	}
+}
+
+func TestLogging_ExcludeMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		logged  bool
+	}{
+		{name: "none", logged: true},
+		{name: "name", exclude: []string{"CreateVolume"}},
+		{name: "full name", exclude: []string{createVolume}},
+		{name: "other", exclude: []string{"Probe"}, logged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, rep := invoke(t, createVolume,
+				&csi.CreateVolumeRequest{Name: "v"},
+				&csi.CreateVolumeResponse{},
+				WithExcludeMethods(tt.exclude...))
+			if logged := req != "" && rep != ""; logged != tt.logged {
+				t.Errorf("req=%q, rep=%q, expected logged=%v",
+					req, rep, tt.logged)
+			}
+		})
+	}
+}
+
+func TestLogging_SlowThreshold(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		warned    bool
+	}{
+		{name: "disabled", delay: 20 * time.Millisecond},
+		{name: "fast", threshold: time.Second},
+		{
+			name:      "slow",
+			threshold: 10 * time.Millisecond,
+			delay:     20 * time.Millisecond,
+			warned:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			i := NewServerLogger(WithSlowThreshold(tt.threshold))
+			_, err := i(
+				context.Background(),
+				&csi.CreateVolumeRequest{Name: "v"},
+				&grpc.UnaryServerInfo{FullMethod: createVolume},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					time.Sleep(tt.delay)
+					return &csi.CreateVolumeResponse{}, nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := hook.LastEntry()
+			if warned := e != nil; warned != tt.warned {
+				t.Fatalf("warned=%v, expected %v", warned, tt.warned)
+			}
+			if e == nil {
+				return
+			}
+			if e.Level != log.WarnLevel || e.Message != "slow rpc" {
+				t.Errorf("entry=%v, expected slow rpc warning", e)
+			}
+			if e.Data["method"] != createVolume || e.Data["code"] != "OK" {
+				t.Errorf("fields=%v", e.Data)
+			}
+		})
+	}
+}
+
+func TestLogging_RedactError(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	var repw bytes.Buffer
+	i := NewServerLogger(
+		WithResponseLogging(&repw),
+		WithRedactKeys(regexp.MustCompile(`(?i)token`)),
+		WithSlowThreshold(time.Nanosecond))
+	_, err := i(
+		context.Background(),
+		&csi.CreateVolumeRequest{
+			Name:       "v",
+			Parameters: map[string]string{"apiToken": "abc123"},
+			Secrets:    map[string]string{"password": "hunter2"},
+		},
+		&grpc.UnaryServerInfo{FullMethod: createVolume},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			time.Sleep(time.Millisecond)
+			return nil, status.Error(codes.PermissionDenied,
+				"login failed: token=abc123, password=hunter2")
+		})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("err=%v, expected code PermissionDenied", err)
+	}
+
+	exp := "login failed: token=***, password=***"
+	if got := repw.String(); !strings.Contains(got, exp) {
+		t.Errorf("logged %q, expected %q", got, exp)
+	}
+	e := hook.LastEntry()
+	if e == nil || e.Message != "slow rpc" {
+		t.Fatalf("entry=%v, expected slow rpc warning", e)
+	}
+	if v, _ := e.Data["error"].(string); !strings.Contains(v, exp) {
+		t.Errorf("warning error=%q, expected %q", v, exp)
+	}
+
+	// The error returned to the client is not modified.
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, "abc123") {
+		t.Errorf("returned error modified: %q", msg)
+	}
+}
+
+func TestLogging_Format(t *testing.T) {
+	rep := &csi.ListVolumesResponse{
+		Entries: []*csi.ListVolumesResponse_Entry{
+			{Volume: &csi.Volume{VolumeId: "1"}},
+			{Volume: &csi.Volume{VolumeId: "2"}},
+			{Volume: &csi.Volume{VolumeId: "3"}},
+		},
+		NextToken: "3",
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		exp  string
+	}{
+		{
+			name: "fields",
+			exp: `Entries=[{"volume":{"volumeId":"1"}},` +
+				`{"volume":{"volumeId":"2"}},{"volume":{"volumeId":"3"}}], ` +
+				`NextToken=3`,
+		},
+		{
+			name: "truncated",
+			opts: []Option{WithMaxListLen(2)},
+			exp: `Entries=[{"volume":{"volumeId":"1"}},` +
+				`{"volume":{"volumeId":"2"}},"...1 more"], NextToken=3`,
+		},
+		{
+			name: "json",
+			opts: []Option{WithJSONFormat()},
+			exp: `: {"entries":[{"volume":{"volumeId":"1"}},` +
+				`{"volume":{"volumeId":"2"}},{"volume":{"volumeId":"3"}}],` +
+				`"nextToken":"3"}`,
+		},
+		{
+			name: "json truncated",
+			opts: []Option{WithJSONFormat(), WithMaxListLen(1)},
+			exp: `: {"entries":[{"volume":{"volumeId":"1"}},"...2 more"],` +
+				`"nextToken":"3"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := invoke(t,
+				"/csi.v1.Controller/ListVolumes",
+				&csi.ListVolumesRequest{}, rep, tt.opts...)
+			if !strings.HasSuffix(strings.TrimSpace(got), tt.exp) {
+				t.Errorf("logged %q, expected suffix %q", got, tt.exp)
+			}
+			if !strings.HasPrefix(got,
+				"/csi.v1.Controller/ListVolumes: REP 0001: ") {
+				t.Errorf("logged %q, expected response prefix", got)
+			}
+		})
+	}
+}
+
+func TestLogging_RequestIDAndStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		opts   []Option
+		expReq string
+		expRep string
+	}{
+		{
+			name:   "numeric",
+			id:     "7",
+			expReq: createVolume + ": REQ 0007: Name=v\n",
+			expRep: createVolume + ": REP 0007: Volume=",
+		},
+		{
+			name:   "string",
+			id:     "a1b2-c3",
+			expReq: createVolume + ": REQ a1b2-c3: Name=v\n",
+			expRep: createVolume + ": REP a1b2-c3: Volume=",
+		},
+		{
+			name:   "status",
+			id:     "7",
+			opts:   []Option{WithResponseStatus()},
+			expReq: createVolume + ": REQ 0007: Name=v\n",
+			expRep: createVolume + ": REP 0007: code=OK, duration=",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reqw, repw bytes.Buffer
+			opts := append(tt.opts,
+				WithRequestLogging(&reqw), WithResponseLogging(&repw))
+			ctx := metadata.NewIncomingContext(
+				context.Background(),
+				metadata.Pairs(csictx.RequestIDKey, tt.id))
+			_, err := NewServerLogger(opts...)(
+				ctx,
+				&csi.CreateVolumeRequest{Name: "v"},
+				&grpc.UnaryServerInfo{FullMethod: createVolume},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{VolumeId: "1"},
+					}, nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reqw.String(); got != tt.expReq {
+				t.Errorf("logged %q, expected %q", got, tt.expReq)
+			}
+			if got := repw.String(); !strings.HasPrefix(got, tt.expRep) {
+				t.Errorf("logged %q, expected prefix %q", got, tt.expRep)
+			}
+		})
+	}
+}
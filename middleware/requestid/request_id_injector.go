@@ -2,8 +2,9 @@ package requestid
 
 import (
 	"fmt"
-	"strconv"
+	"strings"
 	"sync/atomic"
+	"unicode"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -12,16 +13,41 @@ import (
 	csictx "github.com/rexray/gocsi/context"
 )
 
+// maxRequestIDLen is the maximum length of a request ID read from the
+// incoming request's metadata.
+const maxRequestIDLen = 128
+
+// Option configures the request ID injector.
+type Option func(*opts)
+
+type opts struct {
+	upstreamKey string
+}
+
+// WithUpstreamKey is an Option that adopts the value of the provided
+// metadata key as the request ID, ex. a correlation ID set by the CO.
+// The upstream key takes precedence over the "csi.requestid" key.
+func WithUpstreamKey(key string) Option {
+	return func(o *opts) {
+		// gRPC metadata keys are always lower-case.
+		o.upstreamKey = strings.ToLower(key)
+	}
+}
+
 type interceptor struct {
-	id uint64
+	opts opts
+	id   uint64
 }
 
 // NewServerRequestIDInjector returns a new UnaryServerInterceptor
 // that reads a unique request ID from the incoming context's gRPC
 // metadata. If the incoming context does not contain gRPC metadata or
-// a request ID, then a new request ID is generated.
-func NewServerRequestIDInjector() grpc.UnaryServerInterceptor {
-	return newRequestIDInjector().handleServer
+// a request ID, then a new request ID is generated. Request IDs may
+// be numbers or strings, ex. UUIDs. The request ID is echoed to the
+// client in the response header, or the response trailer if the header
+// was already sent.
+func NewServerRequestIDInjector(opts ...Option) grpc.UnaryServerInterceptor {
+	return newRequestIDInjector(opts...).handleServer
 }
 
 // NewClientRequestIDInjector provides a UnaryClientInterceptor
@@ -31,8 +57,12 @@ func NewClientRequestIDInjector() grpc.UnaryClientInterceptor {
 	return newRequestIDInjector().handleClient
 }
 
-func newRequestIDInjector() *interceptor {
-	return &interceptor{}
+func newRequestIDInjector(opts ...Option) *interceptor {
+	i := &interceptor{}
+	for _, withOpts := range opts {
+		withOpts(&i.opts)
+	}
+	return i
 }
 
 func (s *interceptor) handleServer(
@@ -41,48 +71,61 @@ func (s *interceptor) handleServer(
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (interface{}, error) {
 
-	// storeID is a flag that indicates whether or not the request ID
-	// should be atomically stored in the interceptor's id field at
-	// the end of this function. If the ID was found in the incoming
-	// request and could be parsed successfully then the ID is stored.
-	// If the ID was generated server-side then the ID is not stored.
-	storeID := true
-
-	// Retrieve the gRPC metadata from the incoming context.
-	md, mdOK := metadata.FromIncomingContext(ctx)
-
-	// If no gRPC metadata was found then create some and ensure the
-	// context is a gRPC incoming context.
-	if !mdOK {
-		md = metadata.Pairs()
-		ctx = metadata.NewIncomingContext(ctx, md)
+	// Retrieve a copy of the gRPC metadata from the incoming context so
+	// the request ID may be injected without altering the original.
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+
+	// Prefer the ID from the upstream key, then the ID from the request
+	// ID key. If neither is valid then generate a new request ID. IDs
+	// from different clients are used as-is and never affect the IDs
+	// generated by the interceptor.
+	var id string
+	if k := s.opts.upstreamKey; k != "" {
+		id = getValidID(md, k)
 	}
-
-	// Check the metadata from the request ID.
-	szID, szIDOK := md[csictx.RequestIDKey]
-
-	// If the metadata does not contain a request ID then create a new
-	// request ID and inject it into the metadata.
-	if !szIDOK || len(szID) != 1 {
-		szID = []string{fmt.Sprintf("%d", atomic.AddUint64(&s.id, 1))}
-		md[csictx.RequestIDKey] = szID
-		storeID = false
+	if id == "" {
+		id = getValidID(md, csictx.RequestIDKey)
 	}
-
-	// Parse the request ID from the
-	id, err := strconv.ParseUint(szID[0], 10, 64)
-	if err != nil {
-		id = atomic.AddUint64(&s.id, 1)
-		storeID = false
+	if id == "" {
+		id = fmt.Sprintf("%d", atomic.AddUint64(&s.id, 1))
 	}
 
-	if storeID {
-		atomic.StoreUint64(&s.id, id)
+	// Inject the request ID into the metadata and ensure the context is
+	// a gRPC incoming context.
+	md[csictx.RequestIDKey] = []string{id}
+	ctx = metadata.NewIncomingContext(ctx, md)
+
+	// Echo the request ID to the client. Errors are ignored as they only
+	// occur if there is no server transport stream, ex. when the handler
+	// is invoked directly.
+	echo := metadata.Pairs(csictx.RequestIDKey, id)
+	if err := grpc.SetHeader(ctx, echo); err != nil {
+		grpc.SetTrailer(ctx, echo)
 	}
 
 	return handler(ctx, req)
 }
 
+// getValidID returns the value of the provided metadata key if the key
+// has a single value that is a valid request ID.
+func getValidID(md metadata.MD, key string) string {
+	v, ok := md[key]
+	if !ok || len(v) != 1 {
+		return ""
+	}
+	id := v[0]
+	if id == "" || len(id) > maxRequestIDLen {
+		return ""
+	}
+	for _, c := range id {
+		if !unicode.IsPrint(c) || unicode.IsSpace(c) {
+			return ""
+		}
+	}
+	return id
+}
+
 func (s *interceptor) handleClient(
 	ctx context.Context,
 	method string,
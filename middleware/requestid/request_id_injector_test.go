@@ -0,0 +1,172 @@
+package requestid
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+// stream is a grpc.ServerTransportStream that records the metadata set
+// by the interceptor.
+type stream struct {
+	header     metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+}
+
+func (s *stream) Method() string {
+	return "/csi.v1.Identity/Probe"
+}
+
+func (s *stream) SetHeader(md metadata.MD) error {
+	if s.headerSent {
+		return errors.New("header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *stream) SendHeader(md metadata.MD) error {
+	if err := s.SetHeader(md); err != nil {
+		return err
+	}
+	s.headerSent = true
+	return nil
+}
+
+func (s *stream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+// invoke sends a request with the provided incoming metadata through the
+// interceptor and returns the request ID seen by the handler.
+func invoke(
+	t *testing.T,
+	i grpc.UnaryServerInterceptor,
+	st *stream,
+	md metadata.MD) string {
+
+	ctx := context.Background()
+	if md != nil {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	if st != nil {
+		ctx = grpc.NewContextWithServerTransportStream(ctx, st)
+	}
+
+	var (
+		id   string
+		idOK bool
+	)
+	_, err := i(
+		ctx,
+		nil,
+		&grpc.UnaryServerInfo{FullMethod: "/csi.v1.Identity/Probe"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			id, idOK = csictx.GetRequestIDString(ctx)
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idOK {
+		t.Fatal("missing request ID")
+	}
+	return id
+}
+
+func TestRequestID_Generated(t *testing.T) {
+	i := NewServerRequestIDInjector()
+	for _, exp := range []string{"1", "2", "3"} {
+		if id := invoke(t, i, nil, nil); id != exp {
+			t.Fatalf("id=%s, expected %s", id, exp)
+		}
+	}
+
+	// Invalid IDs are replaced with generated IDs.
+	for _, v := range []string{
+		"", "has space", "new\nline", strings.Repeat("a", 129)} {
+
+		md := metadata.Pairs(csictx.RequestIDKey, v)
+		if id := invoke(t, i, nil, md); id == v {
+			t.Fatalf("id=%q, expected generated ID", id)
+		}
+	}
+}
+
+func TestRequestID_Incoming(t *testing.T) {
+	i := NewServerRequestIDInjector()
+
+	// IDs from the client are used as-is and do not affect the
+	// generated IDs.
+	for _, v := range []string{"42", "4a7c9b1e-5d3f-4e21-9f0a-2c6b8d1e3f57"} {
+		md := metadata.Pairs(csictx.RequestIDKey, v)
+		if id := invoke(t, i, nil, md); id != v {
+			t.Fatalf("id=%s, expected %s", id, v)
+		}
+	}
+	if id := invoke(t, i, nil, nil); id != "1" {
+		t.Fatalf("id=%s, expected 1", id)
+	}
+}
+
+func TestRequestID_Upstream(t *testing.T) {
+	i := NewServerRequestIDInjector(WithUpstreamKey("X-Correlation-ID"))
+
+	tests := []struct {
+		name string
+		md   metadata.MD
+		exp  string
+	}{
+		{
+			name: "upstream",
+			md:   metadata.Pairs("x-correlation-id", "corr-1"),
+			exp:  "corr-1",
+		},
+		{
+			name: "precedence",
+			md: metadata.Pairs(
+				"x-correlation-id", "corr-2",
+				csictx.RequestIDKey, "7"),
+			exp: "corr-2",
+		},
+		{
+			name: "invalid upstream",
+			md: metadata.Pairs(
+				"x-correlation-id", "has space",
+				csictx.RequestIDKey, "7"),
+			exp: "7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := invoke(t, i, nil, tt.md); id != tt.exp {
+				t.Errorf("id=%s, expected %s", id, tt.exp)
+			}
+		})
+	}
+}
+
+func TestRequestID_Echo(t *testing.T) {
+	i := NewServerRequestIDInjector()
+
+	st := &stream{}
+	id := invoke(t, i, st, metadata.Pairs(csictx.RequestIDKey, "abc"))
+	if v := st.header[csictx.RequestIDKey]; len(v) != 1 || v[0] != id {
+		t.Fatalf("header=%v, expected %s", st.header, id)
+	}
+
+	// The ID is sent in the trailer if the header was already sent.
+	st = &stream{headerSent: true}
+	id = invoke(t, i, st, nil)
+	if v := st.trailer[csictx.RequestIDKey]; len(v) != 1 || v[0] != id {
+		t.Fatalf("trailer=%v, expected %s", st.trailer, id)
+	}
+}
@@ -0,0 +1,330 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rexray/gocsi/utils"
+)
+
+// Option configures the secrets injector interceptor.
+type Option func(*opts)
+
+type opts struct {
+	// dirs is a map of RPC names to the directories from which the
+	// RPCs' secrets are read. The empty key is the default directory.
+	dirs map[string]string
+
+	// statInterval is the minimum interval between checks of the
+	// directories for changes.
+	statInterval time.Duration
+}
+
+// defaultStatInterval is the default minimum interval between checks of
+// the secrets directories for changes.
+const defaultStatInterval = time.Second
+
+// WithSecretsDir is an Option that sets the directory from which secrets
+// are read for the specified RPCs, ex. "CreateVolume". Each regular file
+// in the directory is a secret whose key is the file's name and whose
+// value is the file's contents. Files with names that begin with a "."
+// are ignored, making it possible to use a directory into which a
+// Kubernetes secret is mounted.
+//
+// If no RPC names are specified then the directory is used for all RPCs
+// that accept secrets and that do not have a directory of their own.
+func WithSecretsDir(dir string, rpcs ...string) Option {
+	return func(o *opts) {
+		if o.dirs == nil {
+			o.dirs = map[string]string{}
+		}
+		if len(rpcs) == 0 {
+			o.dirs[""] = dir
+			return
+		}
+		for _, rpc := range rpcs {
+			o.dirs[rpc] = dir
+		}
+	}
+}
+
+// WithStatInterval is an Option that sets the minimum interval between
+// checks of the secrets directories for changes. Requests received within
+// the interval of the previous check are injected with the cached secrets.
+// An interval of zero or less checks the directories on every request.
+// The default interval is one second.
+func WithStatInterval(d time.Duration) Option {
+	return func(o *opts) {
+		o.statInterval = d
+	}
+}
+
+type interceptor struct {
+	opts    opts
+	sources map[string]*fileSource
+}
+
+// NewServerSecretsInjector returns a new UnaryServerInterceptor that
+// injects secrets read from files into incoming requests that accept
+// secrets but arrive with an empty Secrets field. Requests that already
+// have secrets are not modified.
+//
+// The files are re-read when they change. The values of the injected
+// secrets are never logged or included in errors returned by the
+// interceptor.
+func NewServerSecretsInjector(opts ...Option) grpc.UnaryServerInterceptor {
+	return newSecretsInjector(opts...).handleServer
+}
+
+func newSecretsInjector(opts ...Option) *interceptor {
+	i := &interceptor{sources: map[string]*fileSource{}}
+	i.opts.statInterval = defaultStatInterval
+	for _, withOpts := range opts {
+		withOpts(&i.opts)
+	}
+
+	// RPCs that share a directory also share a file source so the
+	// directory's contents are cached only once.
+	byDir := map[string]*fileSource{}
+	for rpc, dir := range i.opts.dirs {
+		if dir == "" {
+			continue
+		}
+		src, ok := byDir[dir]
+		if !ok {
+			src = &fileSource{dir: dir, interval: i.opts.statInterval}
+			byDir[dir] = src
+		}
+		i.sources[rpc] = src
+	}
+
+	return i
+}
+
+func (s *interceptor) handleServer(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	_, _, method, err := utils.ParseMethod(info.FullMethod)
+	if err != nil {
+		return handler(ctx, req)
+	}
+
+	if err := s.inject(method, req); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *interceptor) inject(method string, req interface{}) error {
+
+	// Get a pointer to the request's secrets map. If the request does
+	// not accept secrets or already has secrets then there is nothing
+	// to inject.
+	var secrets *map[string]string
+	switch treq := req.(type) {
+	//
+	// Controller Service
+	//
+	case *csi.CreateVolumeRequest:
+		secrets = &treq.Secrets
+	case *csi.DeleteVolumeRequest:
+		secrets = &treq.Secrets
+	case *csi.ControllerPublishVolumeRequest:
+		secrets = &treq.Secrets
+	case *csi.ControllerUnpublishVolumeRequest:
+		secrets = &treq.Secrets
+	case *csi.ValidateVolumeCapabilitiesRequest:
+		secrets = &treq.Secrets
+	case *csi.CreateSnapshotRequest:
+		secrets = &treq.Secrets
+	case *csi.DeleteSnapshotRequest:
+		secrets = &treq.Secrets
+	case *csi.ListSnapshotsRequest:
+		secrets = &treq.Secrets
+	case *csi.ControllerExpandVolumeRequest:
+		secrets = &treq.Secrets
+	//
+	// Node Service
+	//
+	case *csi.NodeStageVolumeRequest:
+		secrets = &treq.Secrets
+	case *csi.NodePublishVolumeRequest:
+		secrets = &treq.Secrets
+	default:
+		return nil
+	}
+	if len(*secrets) > 0 {
+		return nil
+	}
+
+	src, ok := s.sources[method]
+	if !ok {
+		if src, ok = s.sources[""]; !ok {
+			return nil
+		}
+	}
+
+	data, err := src.get()
+	if err != nil {
+		log.WithFields(map[string]interface{}{
+			"method": method,
+			"dir":    src.dir,
+		}).WithError(err).Error("failed to read secrets")
+		return status.Error(codes.Internal, "failed to read secrets")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	// Give each request its own copy of the secrets so a handler that
+	// modifies the map cannot alter the cached values.
+	*secrets = make(map[string]string, len(data))
+	for k, v := range data {
+		(*secrets)[k] = v
+	}
+
+	log.WithFields(map[string]interface{}{
+		"method": method,
+		"keys":   len(data),
+	}).Debug("injected secrets")
+
+	return nil
+}
+
+// fileSource reads secrets from the files in a directory. The files'
+// contents are cached and re-read only when the directory's listing or
+// the files' sizes or modification times change. The directory is checked
+// for changes at most once per interval.
+type fileSource struct {
+	sync.RWMutex
+	dir      string
+	interval time.Duration
+	checked  time.Time
+	sig      string
+	data     map[string]string
+}
+
+func (f *fileSource) get() (map[string]string, error) {
+	f.RLock()
+	data, fresh := f.data, f.fresh()
+	f.RUnlock()
+	if fresh {
+		return data, nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	// Another request may have checked the directory while this one
+	// waited for the lock.
+	if f.fresh() {
+		return f.data, nil
+	}
+
+	if err := f.load(); err != nil {
+		// Keep serving the secrets that were loaded before, if any, since
+		// the error may be transient, ex. a file that is being replaced.
+		if f.data == nil {
+			return nil, err
+		}
+		f.checked = time.Now()
+		log.WithError(err).WithField("dir", f.dir).Warn(
+			"failed to reload secrets; using cached secrets")
+	}
+	return f.data, nil
+}
+
+// load reads the secrets from the directory if the directory changed
+// since they were last read. The caller must hold the lock.
+func (f *fileSource) load() error {
+	names, sig, err := f.stat()
+	if err != nil {
+		return err
+	}
+	if f.data != nil && sig == f.sig {
+		f.checked = time.Now()
+		return nil
+	}
+
+	data := map[string]string{}
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(filepath.Join(f.dir, name))
+		if err != nil {
+			return err
+		}
+		data[name] = string(buf)
+	}
+
+	f.data = data
+	f.sig = sig
+	f.checked = time.Now()
+	log.WithFields(map[string]interface{}{
+		"dir":  f.dir,
+		"keys": len(data),
+	}).Info("loaded secrets")
+
+	return nil
+}
+
+// fresh returns whether the cached secrets were checked for changes within
+// the interval. The caller must hold the lock.
+func (f *fileSource) fresh() bool {
+	return f.data != nil && f.interval > 0 &&
+		time.Since(f.checked) < f.interval
+}
+
+// stat returns the sorted names of the regular files in the directory
+// and a signature that changes when any of the files change. Symlinks
+// are followed, so secrets updated by swapping a symlink, as Kubernetes
+// does, are detected as well.
+func (f *fileSource) stat() ([]string, string, error) {
+	d, err := os.Open(f.dir)
+	if err != nil {
+		return nil, "", err
+	}
+	all, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(all)
+
+	var (
+		names []string
+		sig   strings.Builder
+	)
+	for _, name := range all {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(f.dir, name))
+		if err != nil {
+			return nil, "", err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		names = append(names, name)
+		fmt.Fprintf(&sig, "%s:%d:%d;",
+			name, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return names, sig.String(), nil
+}
@@ -0,0 +1,228 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newSecretsDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gocsi-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, val := range files {
+		writeSecret(t, dir, name, val)
+	}
+	return dir
+}
+
+func writeSecret(t *testing.T, dir, name, val string) {
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, name), []byte(val), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// invoke sends the request through the interceptor and returns the
+// secrets seen by the handler.
+func invoke(
+	t *testing.T,
+	i grpc.UnaryServerInterceptor,
+	method string,
+	req interface{}) map[string]string {
+
+	var seen map[string]string
+	_, err := i(
+		context.Background(),
+		req,
+		&grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			if r, ok := req.(interface {
+				GetSecrets() map[string]string
+			}); ok {
+				seen = r.GetSecrets()
+			}
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seen
+}
+
+func TestSecretsInjector_Inject(t *testing.T) {
+	dir := newSecretsDir(t, map[string]string{
+		"username": "admin",
+		"password": "secret",
+	})
+	defer os.RemoveAll(dir)
+
+	i := NewServerSecretsInjector(WithSecretsDir(dir))
+
+	exp := map[string]string{"username": "admin", "password": "secret"}
+	got := invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{Name: "v"})
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("secrets=%v, expected %v", got, exp)
+	}
+
+	// Requests that already have secrets are not modified.
+	own := map[string]string{"token": "mine"}
+	got = invoke(t, i, "DeleteVolume",
+		&csi.DeleteVolumeRequest{VolumeId: "v", Secrets: own})
+	if !reflect.DeepEqual(got, own) {
+		t.Fatalf("secrets=%v, expected %v", got, own)
+	}
+}
+
+func TestSecretsInjector_PerRPCDir(t *testing.T) {
+	def := newSecretsDir(t, map[string]string{"key": "default"})
+	defer os.RemoveAll(def)
+	del := newSecretsDir(t, map[string]string{"key": "delete"})
+	defer os.RemoveAll(del)
+
+	i := NewServerSecretsInjector(
+		WithSecretsDir(def), WithSecretsDir(del, "DeleteVolume"))
+
+	if got := invoke(t, i, "CreateVolume",
+		&csi.CreateVolumeRequest{}); got["key"] != "default" {
+		t.Fatalf("CreateVolume secrets=%v", got)
+	}
+	if got := invoke(t, i, "DeleteVolume",
+		&csi.DeleteVolumeRequest{}); got["key"] != "delete" {
+		t.Fatalf("DeleteVolume secrets=%v", got)
+	}
+}
+
+func TestSecretsInjector_Reread(t *testing.T) {
+	dir := newSecretsDir(t, map[string]string{"key": "v1"})
+	defer os.RemoveAll(dir)
+
+	i := NewServerSecretsInjector(WithSecretsDir(dir), WithStatInterval(0))
+	if got := invoke(t, i, "CreateVolume",
+		&csi.CreateVolumeRequest{}); got["key"] != "v1" {
+		t.Fatalf("secrets=%v, expected key=v1", got)
+	}
+
+	writeSecret(t, dir, "key", "v2-changed")
+	writeSecret(t, dir, "added", "new")
+	got := invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{})
+	if got["key"] != "v2-changed" || got["added"] != "new" {
+		t.Fatalf("secrets=%v, expected changed and added keys", got)
+	}
+
+	os.Remove(filepath.Join(dir, "added"))
+	got = invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{})
+	if _, ok := got["added"]; ok {
+		t.Fatalf("secrets=%v, expected removed key to be absent", got)
+	}
+}
+
+func TestSecretsInjector_StatInterval(t *testing.T) {
+	dir := newSecretsDir(t, map[string]string{"key": "v1"})
+	defer os.RemoveAll(dir)
+
+	i := NewServerSecretsInjector(
+		WithSecretsDir(dir), WithStatInterval(time.Hour))
+	invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{})
+
+	// Changes made within the interval are not seen.
+	writeSecret(t, dir, "key", "v2-changed")
+	if got := invoke(t, i, "CreateVolume",
+		&csi.CreateVolumeRequest{}); got["key"] != "v1" {
+		t.Fatalf("secrets=%v, expected cached key=v1", got)
+	}
+}
+
+func TestSecretsInjector_Files(t *testing.T) {
+	dir := newSecretsDir(t, map[string]string{
+		"key":     "val",
+		".hidden": "ignored",
+	})
+	defer os.RemoveAll(dir)
+
+	// Kubernetes mounts secrets as symlinks into a hidden directory. The
+	// symlinks to files are followed and the directories are ignored.
+	data := filepath.Join(dir, "..data")
+	if err := os.Mkdir(data, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeSecret(t, data, "linked", "target")
+	if err := os.Symlink(
+		filepath.Join(data, "linked"), filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(data, filepath.Join(dir, "subdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	i := NewServerSecretsInjector(WithSecretsDir(dir))
+	exp := map[string]string{"key": "val", "linked": "target"}
+	got := invoke(t, i, "NodeStageVolume", &csi.NodeStageVolumeRequest{})
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("secrets=%v, expected %v", got, exp)
+	}
+}
+
+func TestSecretsInjector_CopyPerRequest(t *testing.T) {
+	dir := newSecretsDir(t, map[string]string{"key": "val"})
+	defer os.RemoveAll(dir)
+
+	i := NewServerSecretsInjector(WithSecretsDir(dir))
+
+	// A handler that modifies the injected map must not alter the
+	// secrets injected into later requests.
+	first := invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{})
+	first["key"] = "modified"
+	first["extra"] = "added"
+
+	got := invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{})
+	if exp := map[string]string{"key": "val"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("secrets=%v, expected %v", got, exp)
+	}
+}
+
+func TestSecretsInjector_ReadError(t *testing.T) {
+	dir := newSecretsDir(t, nil)
+	os.RemoveAll(dir)
+
+	i := NewServerSecretsInjector(WithSecretsDir(dir))
+	_, err := i(
+		context.Background(),
+		&csi.CreateVolumeRequest{},
+		&grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatal("handler invoked")
+			return nil, nil
+		})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("err=%v, expected code Internal", err)
+	}
+}
+
+func TestSecretsInjector_ReloadError(t *testing.T) {
+	dir := newSecretsDir(t, map[string]string{"key": "v1"})
+	defer os.RemoveAll(dir)
+
+	i := NewServerSecretsInjector(WithSecretsDir(dir), WithStatInterval(0))
+	invoke(t, i, "CreateVolume", &csi.CreateVolumeRequest{})
+
+	// The secrets that were loaded before are used while the directory
+	// cannot be read.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := invoke(t, i, "CreateVolume",
+		&csi.CreateVolumeRequest{}); got["key"] != "v1" {
+		t.Fatalf("secrets=%v, expected cached key=v1", got)
+	}
+}
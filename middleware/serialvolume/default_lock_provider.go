@@ -2,40 +2,276 @@ package serialvolume
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/akutz/gosync"
+
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
 )
 
+// defaultLockProvider is an in-memory lock provider. Locks are created
+// on demand and reference-counted by the callers that hold or are waiting
+// for them. A lock is removed once its last reference is closed, so the
+// provider's memory use is bounded by the number of volumes with
+// in-flight operations instead of the number of volumes ever seen.
+//
+// The names of the volumes are recorded until the volumes are deleted.
 type defaultLockProvider struct {
 	volIDLocksL   sync.Mutex
 	volNameLocksL sync.Mutex
-	volIDLocks    map[string]gosync.TryLocker
-	volNameLocks  map[string]gosync.TryLocker
+	volNamesL     sync.RWMutex
+	volResLocksL  sync.Mutex
+	volIDLocks    map[string]*refCountedLock
+	volNameLocks  map[string]*refCountedLock
+	volResLocks   map[string]*refCountedLock
+	volNames      map[string]string
+}
+
+func newDefaultLockProvider() *defaultLockProvider {
+	return &defaultLockProvider{
+		volIDLocks:   map[string]*refCountedLock{},
+		volNameLocks: map[string]*refCountedLock{},
+		volResLocks:  map[string]*refCountedLock{},
+		volNames:     map[string]string{},
+	}
 }
 
 func (i *defaultLockProvider) GetLockWithID(
 	ctx context.Context, id string) (gosync.TryLocker, error) {
 
-	i.volIDLocksL.Lock()
-	defer i.volIDLocksL.Unlock()
-	lock := i.volIDLocks[id]
-	if lock == nil {
-		lock = &gosync.TryMutex{}
-		i.volIDLocks[id] = lock
-	}
-	return lock, nil
+	return getRefCountedLock(&i.volIDLocksL, i.volIDLocks, id), nil
 }
 
 func (i *defaultLockProvider) GetLockWithName(
 	ctx context.Context, name string) (gosync.TryLocker, error) {
 
-	i.volNameLocksL.Lock()
-	defer i.volNameLocksL.Unlock()
-	lock := i.volNameLocks[name]
+	return getRefCountedLock(&i.volNameLocksL, i.volNameLocks, name), nil
+}
+
+func (i *defaultLockProvider) GetResourceLockWithID(
+	ctx context.Context, id, key string) (gosync.TryLocker, error) {
+
+	// Volume IDs cannot contain the NUL character, so the combined key
+	// is unique.
+	return getRefCountedLock(&i.volResLocksL, i.volResLocks, id+"\x00"+key), nil
+}
+
+func (i *defaultLockProvider) SetVolumeName(
+	ctx context.Context, id, name string) error {
+
+	i.volNamesL.Lock()
+	defer i.volNamesL.Unlock()
+	i.volNames[id] = name
+	return nil
+}
+
+func (i *defaultLockProvider) GetVolumeName(
+	ctx context.Context, id string) (string, error) {
+
+	i.volNamesL.RLock()
+	defer i.volNamesL.RUnlock()
+	return i.volNames[id], nil
+}
+
+func (i *defaultLockProvider) DeleteVolumeName(
+	ctx context.Context, id string) error {
+
+	i.volNamesL.Lock()
+	defer i.volNamesL.Unlock()
+	delete(i.volNames, id)
+	return nil
+}
+
+// GetLockTable gets the locks that are held or waited for. The keys of
+// the locks are:
+//
+//	volumesByID/VOLUME_ID
+//	volumesByName/VOLUME_NAME
+//	volumeResources/VOLUME_ID/RESOURCE
+func (i *defaultLockProvider) GetLockTable(
+	ctx context.Context) ([]mwtypes.LockInfo, error) {
+
+	var table []mwtypes.LockInfo
+	for _, m := range []struct {
+		mu    *sync.Mutex
+		locks map[string]*refCountedLock
+		pfx   string
+	}{
+		{&i.volIDLocksL, i.volIDLocks, "volumesByID/"},
+		{&i.volNameLocksL, i.volNameLocks, "volumesByName/"},
+		{&i.volResLocksL, i.volResLocks, "volumeResources/"},
+	} {
+		m.mu.Lock()
+		for key, lock := range m.locks {
+			held, waiters := lock.state()
+			if !held && waiters == 0 {
+				continue
+			}
+			table = append(table, mwtypes.LockInfo{
+				Key:     m.pfx + strings.Replace(key, "\x00", "/", 1),
+				Holders: lock.lockHolders(),
+				Waiters: waiters,
+			})
+		}
+		m.mu.Unlock()
+	}
+
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Key < table[j].Key
+	})
+	return table, nil
+}
+
+// refCountedLock is a lock shared by all of the references to the same
+// key. The refs field is guarded by the mutex of the map that contains
+// the lock.
+type refCountedLock struct {
+	tryRWMutex
+	refs int
+
+	holdersL sync.Mutex
+	holders  map[*lockRef]mwtypes.LockHolder
+}
+
+// getRefCountedLock returns a new reference to the lock for the key,
+// creating the lock if it does not exist.
+func getRefCountedLock(
+	mu *sync.Mutex,
+	locks map[string]*refCountedLock,
+	key string) *lockRef {
+
+	mu.Lock()
+	defer mu.Unlock()
+	lock := locks[key]
 	if lock == nil {
-		lock = &gosync.TryMutex{}
-		i.volNameLocks[name] = lock
+		lock = &refCountedLock{}
+		locks[key] = lock
+	}
+	lock.refs++
+	return &lockRef{mu: mu, locks: locks, key: key, lock: lock}
+}
+
+var _ mwtypes.LockTableReporter = &defaultLockProvider{}
+
+var (
+	_ mwtypes.TryRWLocker        = &lockRef{}
+	_ mwtypes.ContextLocker      = &lockRef{}
+	_ mwtypes.LockHolderRecorder = &lockRef{}
+)
+
+// lockRef is a reference to a refCountedLock. Closing the reference
+// releases it and removes the lock from its map if no other references
+// remain. A reference should be unlocked before it is closed.
+type lockRef struct {
+	mu    *sync.Mutex
+	locks map[string]*refCountedLock
+	key   string
+	lock  *refCountedLock
+	once  sync.Once
+
+	// shared indicates the lock was obtained with TryLockContext in
+	// shared mode.
+	shared bool
+}
+
+func (r *lockRef) Lock() {
+	r.lock.Lock()
+}
+
+func (r *lockRef) Unlock() {
+	r.deleteLockHolder()
+	r.lock.Unlock()
+}
+
+func (r *lockRef) TryLock(timeout time.Duration) bool {
+	return r.lock.TryLock(timeout)
+}
+
+func (r *lockRef) RLock() {
+	r.lock.RLock()
+}
+
+func (r *lockRef) RUnlock() {
+	r.deleteLockHolder()
+	r.lock.RUnlock()
+}
+
+func (r *lockRef) TryRLock(timeout time.Duration) bool {
+	return r.lock.TryRLock(timeout)
+}
+
+// TryLockContext attempts to lock the lock in the provided mode until the
+// timeout expires or the context is done. The in-memory lock cannot fail,
+// so the returned error is always nil.
+func (r *lockRef) TryLockContext(
+	ctx context.Context,
+	mode mwtypes.LockMode,
+	timeout time.Duration) (bool, error) {
+
+	shared := mode == mwtypes.LockModeShared
+	if !r.lock.acquire(ctx.Done(), shared, timeout) {
+		return false, nil
 	}
-	return lock, nil
+	r.shared = shared
+	return true, nil
+}
+
+// UnlockContext unlocks the lock obtained with TryLockContext.
+func (r *lockRef) UnlockContext(ctx context.Context) error {
+	if r.shared {
+		r.RUnlock()
+	} else {
+		r.Unlock()
+	}
+	return nil
+}
+
+func (r *lockRef) SetLockHolder(
+	ctx context.Context, h mwtypes.LockHolder) error {
+
+	r.lock.holdersL.Lock()
+	defer r.lock.holdersL.Unlock()
+	if r.lock.holders == nil {
+		r.lock.holders = map[*lockRef]mwtypes.LockHolder{}
+	}
+	r.lock.holders[r] = h
+	return nil
+}
+
+func (r *lockRef) GetLockHolders(
+	ctx context.Context) ([]mwtypes.LockHolder, error) {
+
+	return r.lock.lockHolders(), nil
+}
+
+func (l *refCountedLock) lockHolders() []mwtypes.LockHolder {
+	l.holdersL.Lock()
+	defer l.holdersL.Unlock()
+	holders := make([]mwtypes.LockHolder, 0, len(l.holders))
+	for _, h := range l.holders {
+		holders = append(holders, h)
+	}
+	return holders
+}
+
+func (r *lockRef) deleteLockHolder() {
+	r.lock.holdersL.Lock()
+	defer r.lock.holdersL.Unlock()
+	delete(r.lock.holders, r)
+}
+
+// Close releases the reference. It is safe to call Close more than once.
+func (r *lockRef) Close() error {
+	r.once.Do(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.lock.refs--
+		if r.lock.refs == 0 {
+			delete(r.locks, r.key)
+		}
+	})
+	return nil
 }
@@ -0,0 +1,201 @@
+package serialvolume
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+func TestDefaultLockProvider_Cleanup(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newDefaultLockProvider()
+	)
+
+	a, _ := p.GetLockWithID(ctx, "vol-1")
+	b, _ := p.GetLockWithID(ctx, "vol-1")
+	if n := len(p.volIDLocks); n != 1 {
+		t.Fatalf("len(volIDLocks)=%d, expected 1", n)
+	}
+
+	// Both references must share the same underlying lock.
+	a.Lock()
+	if b.TryLock(0) {
+		t.Fatal("obtained lock held by another reference")
+	}
+	a.Unlock()
+
+	a.(io.Closer).Close()
+	a.(io.Closer).Close()
+	if n := len(p.volIDLocks); n != 1 {
+		t.Fatalf("len(volIDLocks)=%d, expected 1 after first close", n)
+	}
+	b.(io.Closer).Close()
+	if n := len(p.volIDLocks); n != 0 {
+		t.Fatalf("len(volIDLocks)=%d, expected 0 after last close", n)
+	}
+}
+
+func TestDefaultLockProvider_Shared(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newDefaultLockProvider()
+	)
+
+	lock := func() mwtypes.TryRWLocker {
+		l, _ := p.GetLockWithID(ctx, "vol-1")
+		return l.(mwtypes.TryRWLocker)
+	}
+
+	a, b, c := lock(), lock(), lock()
+	if !a.TryRLock(0) || !b.TryRLock(0) {
+		t.Fatal("failed to obtain shared locks")
+	}
+	if c.TryLock(10 * time.Millisecond) {
+		t.Fatal("obtained exclusive lock while shared locks are held")
+	}
+
+	// A pending writer blocks new readers.
+	locked := make(chan struct{})
+	go func() {
+		c.Lock()
+		close(locked)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if d := lock(); d.TryRLock(10 * time.Millisecond) {
+		t.Fatal("obtained shared lock while exclusive lock is pending")
+	}
+
+	a.RUnlock()
+	b.RUnlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("exclusive lock not obtained after shared locks released")
+	}
+	c.Unlock()
+}
+
+func TestDefaultLockProvider_Context(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newDefaultLockProvider()
+	)
+
+	lock := func() mwtypes.ContextLocker {
+		l, _ := p.GetLockWithID(ctx, "vol-1")
+		return l.(mwtypes.ContextLocker)
+	}
+
+	a, b := lock(), lock()
+	if ok, err := a.TryLockContext(
+		ctx, mwtypes.LockModeShared, 0); !ok || err != nil {
+		t.Fatalf("failed to obtain shared lock: %v", err)
+	}
+
+	// A canceled context ends the wait before the timeout expires.
+	cctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if ok, err := b.TryLockContext(
+		cctx, mwtypes.LockModeExclusive, time.Minute); ok || err != nil {
+		t.Fatalf("obtained exclusive lock while shared lock is held: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("wait not ended by canceled context: %s", d)
+	}
+
+	if err := a.UnlockContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryLockContext(
+		ctx, mwtypes.LockModeExclusive, 0); !ok || err != nil {
+		t.Fatalf("failed to obtain exclusive lock: %v", err)
+	}
+	if err := b.UnlockContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkDefaultLockProvider_Churn obtains, locks, and releases the lock
+// for a new volume ID on every iteration. The heap in use and the number of
+// locks held by the provider must not grow with the number of volumes.
+func BenchmarkDefaultLockProvider_Churn(b *testing.B) {
+	var (
+		ctx = context.Background()
+		p   = newDefaultLockProvider()
+	)
+
+	churn := func(n int) {
+		for i := 0; i < n; i++ {
+			lock, _ := p.GetLockWithID(ctx, strconv.Itoa(i))
+			lock.Lock()
+			lock.Unlock()
+			lock.(io.Closer).Close()
+		}
+	}
+
+	// Warm up the provider's map before measuring the heap.
+	churn(1000)
+	before := heapInUse()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	churn(b.N)
+	b.StopTimer()
+
+	if n := len(p.volIDLocks); n != 0 {
+		b.Fatalf("len(volIDLocks)=%d, expected 0", n)
+	}
+	const slack = 1 << 20
+	if after := heapInUse(); after > before+slack {
+		b.Fatalf("heap grew from %d to %d bytes after %d volumes",
+			before, after, b.N)
+	}
+}
+
+// BenchmarkDefaultLockProvider_Contention obtains and locks the locks for
+// a small set of volume IDs from many goroutines so that locks are shared
+// by several references at once.
+func BenchmarkDefaultLockProvider_Contention(b *testing.B) {
+	var (
+		ctx = context.Background()
+		p   = newDefaultLockProvider()
+		ids = make([]string, 8)
+	)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			lock, _ := p.GetLockWithID(ctx, ids[i%len(ids)])
+			lock.Lock()
+			lock.Unlock()
+			lock.(io.Closer).Close()
+			i++
+		}
+	})
+	b.StopTimer()
+
+	p.volIDLocksL.Lock()
+	defer p.volIDLocksL.Unlock()
+	if n := len(p.volIDLocks); n != 0 {
+		b.Fatalf("len(volIDLocks)=%d, expected 0", n)
+	}
+}
+
+func heapInUse() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
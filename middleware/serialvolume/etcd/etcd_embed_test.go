@@ -0,0 +1,74 @@
+package etcd_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/pkg/capnslog"
+)
+
+// startEmbeddedEtcd starts a single member etcd cluster in the process
+// and returns its client endpoint and a function that stops the cluster
+// and removes its data.
+func startEmbeddedEtcd() (string, func(), error) {
+	dir, err := ioutil.TempDir("", "gocsi-etcd")
+	if err != nil {
+		return "", nil, err
+	}
+
+	clientURL, err := freeURL()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	peerURL, err := freeURL()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	capnslog.SetGlobalLogLevel(capnslog.CRITICAL)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	stop := func() {
+		e.Close()
+		os.RemoveAll(dir)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case err := <-e.Err():
+		stop()
+		return "", nil, err
+	case <-time.After(10 * time.Second):
+		stop()
+		return "", nil, errors.New("embedded etcd not ready")
+	}
+	return clientURL.String(), stop, nil
+}
+
+// freeURL returns an http URL with a loopback address and a port that
+// is not in use.
+func freeURL() (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, nil
+}
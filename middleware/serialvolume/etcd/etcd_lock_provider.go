@@ -1,17 +1,35 @@
+// Package etcd provides a volume lock provider for the serial volume
+// access middleware that is backed by etcd, which serializes access to
+// volumes across all of the processes that share the provider's domain.
+//
+// The locks are stored under DOMAIN/v2, ex. DOMAIN/v2/volumesByID/ID,
+// where each holder and waiter of a lock has a key of its own, and the
+// IDs and names of volumes are escaped. Earlier versions stored a lock
+// as the keys of an etcd concurrency mutex under DOMAIN, ex.
+// DOMAIN/volumesByID/ID. The two layouts do not exclude each other, so
+// this is a breaking change: all of the processes that share a domain
+// must be upgraded together, and not replica by replica, otherwise a
+// volume may be accessed by an upgraded and an earlier process at the
+// same time.
 package etcd
 
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/akutz/gosync"
 	etcd "github.com/coreos/etcd/clientv3"
 	etcdsync "github.com/coreos/etcd/clientv3/concurrency"
 	log "github.com/sirupsen/logrus"
-	"github.com/akutz/gosync"
 
 	csictx "github.com/rexray/gocsi/context"
 	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
@@ -56,7 +74,7 @@ func New(
 
 	return &provider{
 		client: client,
-		domain: domain,
+		domain: path.Join(domain, keyLayoutVersion),
 		ttl:    int(ttl.Seconds()),
 	}, nil
 }
@@ -166,55 +184,320 @@ func initConfig(
 	return config, nil
 }
 
+// defaultSessionTTL is the TTL, in seconds, of the provider's session when
+// no TTL is specified. It matches the etcd concurrency package's default.
+const defaultSessionTTL = 60
+
+// cleanupTimeout bounds the requests that remove the keys and leases left
+// behind by failed or canceled operations, which are sent with contexts of
+// their own since the callers' contexts may be done.
+const cleanupTimeout = 5 * time.Second
+
+// keyLayoutVersion is the path under the domain at which the locks are
+// stored. It is changed whenever a lock's keys change in a way that does
+// not exclude the processes that use the earlier keys.
+const keyLayoutVersion = "v2"
+
 type provider struct {
 	client *etcd.Client
 	domain string
 	ttl    int
+
+	// sess is the session with which all of the provider's mutexes are
+	// locked. It is replaced when its lease expires.
+	sess  *etcdsync.Session
+	sessL sync.Mutex
+
+	// lockID is incremented to distinguish the mutexes that share sess.
+	lockID uint64
 }
 
 func (p *provider) Close() error {
+	p.sessL.Lock()
+	defer p.sessL.Unlock()
+	if p.sess != nil {
+		if err := p.sess.Close(); err != nil {
+			log.Errorf("EtcdVolumeLockProvider: close session err: %v", err)
+		}
+		p.sess = nil
+	}
 	return p.client.Close()
 }
 
+// session returns the provider's session. A new session is created if
+// there is no session, if the lease of the current session expired, or
+// if the current session is the expired session.
+//
+// The new session is created without holding sessL so that a slow etcd
+// does not block the callers that can use the current session. If another
+// caller replaced the session in the meantime then the replacement is
+// used and the new session is closed.
+func (p *provider) session(
+	ctx context.Context,
+	expired *etcdsync.Session) (*etcdsync.Session, error) {
+
+	if sess := p.currentSession(expired); sess != nil {
+		return sess, nil
+	}
+
+	sess, err := p.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sessL.Lock()
+	defer p.sessL.Unlock()
+	if cur := p.sess; cur != nil && cur != expired {
+		select {
+		case <-cur.Done():
+		default:
+			if err := sess.Close(); err != nil {
+				log.Debugf("EtcdVolumeLockProvider: close session err: %v", err)
+			}
+			return cur, nil
+		}
+	}
+	log.Debugf("EtcdVolumeLockProvider: new session: lease=%x", sess.Lease())
+	p.sess = sess
+	return sess, nil
+}
+
+// currentSession returns the provider's session if it is neither expired
+// nor the provided expired session, otherwise nil is returned.
+func (p *provider) currentSession(
+	expired *etcdsync.Session) *etcdsync.Session {
+
+	p.sessL.Lock()
+	defer p.sessL.Unlock()
+
+	if p.sess != nil && p.sess == expired {
+		log.Warnf("EtcdVolumeLockProvider: session lease not found: lease=%x",
+			p.sess.Lease())
+		p.sess.Orphan()
+		p.sess = nil
+	}
+	if p.sess == nil {
+		return nil
+	}
+	select {
+	case <-p.sess.Done():
+		// The keys of the locks held or waited for with the session
+		// were deleted with its lease. The mutexes detect this when
+		// they are unlocked.
+		log.Warnf("EtcdVolumeLockProvider: session expired: lease=%x",
+			p.sess.Lease())
+		p.sess = nil
+		return nil
+	default:
+		return p.sess
+	}
+}
+
+// newSession creates a new session.
+func (p *provider) newSession(ctx context.Context) (*etcdsync.Session, error) {
+	ttl := p.ttl
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+
+	// Grant the lease with the caller's context so that an unreachable
+	// etcd cannot block the caller past its deadline. The session is kept
+	// alive with the client's context so that it outlives the caller.
+	rep, err := p.client.Grant(ctx, int64(ttl))
+	if err != nil {
+		return nil, err
+	}
+	sess, err := etcdsync.NewSession(
+		p.client,
+		etcdsync.WithLease(rep.ID),
+		etcdsync.WithTTL(ttl),
+		etcdsync.WithContext(p.client.Ctx()))
+	if err != nil {
+		// The caller's context may be done, so the lease is revoked with
+		// a context of its own.
+		rctx, cancel := context.WithTimeout(p.client.Ctx(), cleanupTimeout)
+		defer cancel()
+		p.client.Revoke(rctx, rep.ID)
+		return nil, err
+	}
+	return sess, nil
+}
+
 func (p *provider) GetLockWithID(
 	ctx context.Context, id string) (gosync.TryLocker, error) {
 
-	return p.getLock(ctx, path.Join(p.domain, "volumesByID", id))
+	return p.getLock(ctx, p.key("volumesByID", id))
 }
 
 func (p *provider) GetLockWithName(
 	ctx context.Context, name string) (gosync.TryLocker, error) {
 
-	return p.getLock(ctx, path.Join(p.domain, "volumesByName", name))
+	return p.getLock(ctx, p.key("volumesByName", name))
 }
 
-func (p *provider) getLock(
-	ctx context.Context, pfx string) (gosync.TryLocker, error) {
+func (p *provider) GetResourceLockWithID(
+	ctx context.Context, id, key string) (gosync.TryLocker, error) {
 
-	log.Debugf("EtcdVolumeLockProvider: getLock: pfx=%v", pfx)
+	return p.getLock(ctx, p.key("volumeResources", id, key))
+}
+
+func (p *provider) SetVolumeName(
+	ctx context.Context, id, name string) error {
 
-	opts := []etcdsync.SessionOption{etcdsync.WithContext(ctx)}
-	if p.ttl > 0 {
-		opts = append(opts, etcdsync.WithTTL(p.ttl))
+	_, err := p.client.Put(ctx, p.volumeNameKey(id), name)
+	return err
+}
+
+func (p *provider) GetVolumeName(
+	ctx context.Context, id string) (string, error) {
+
+	rep, err := p.client.Get(ctx, p.volumeNameKey(id))
+	if err != nil {
+		return "", err
 	}
+	if len(rep.Kvs) == 0 {
+		return "", nil
+	}
+	return string(rep.Kvs[0].Value), nil
+}
+
+func (p *provider) DeleteVolumeName(
+	ctx context.Context, id string) error {
+
+	_, err := p.client.Delete(ctx, p.volumeNameKey(id))
+	return err
+}
+
+func (p *provider) volumeNameKey(id string) string {
+	return p.key("volumeNames", id)
+}
+
+// key returns the key with the provided kind, ex. volumesByID, and
+// segments, ex. a volume ID. The segments are escaped so that IDs and
+// names that contain "/" cannot create keys that overlap the keys of other
+// locks or the PREFIX/(read|write)/ keys of a lock's holders and waiters.
+// The segments "." and ".." are escaped as well since etcd keys are not
+// paths but the lock table is reported as if they were.
+func (p *provider) key(kind string, segments ...string) string {
+	key := path.Join(p.domain, kind)
+	for _, s := range segments {
+		key = key + "/" + escapeKeySegment(s)
+	}
+	return key
+}
+
+func escapeKeySegment(s string) string {
+	switch s {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return url.PathEscape(s)
+}
+
+// GetLockTable gets the locks that are held or waited for by all of the
+// processes that share the provider's domain. The keys of the locks are
+// the paths of the locks relative to the domain and the key layout's
+// version, ex. volumesByID/vol-1.
+func (p *provider) GetLockTable(
+	ctx context.Context) ([]mwtypes.LockInfo, error) {
 
-	sess, err := etcdsync.NewSession(p.client, opts...)
+	rep, err := p.client.Get(
+		ctx, p.domain+"/", etcd.WithPrefix(),
+		etcd.WithSort(etcd.SortByCreateRevision, etcd.SortAscend))
 	if err != nil {
 		return nil, err
 	}
+
+	var (
+		table   []mwtypes.LockInfo
+		indices = map[string]int{}
+		writers = map[string]bool{} // locks with an earlier writer
+	)
+	for _, kv := range rep.Kvs {
+		// The keys of a lock's holders and waiters have the form
+		// DOMAIN/LOCK/(read|write)/LEASE-ID.
+		key := strings.TrimPrefix(string(kv.Key), p.domain+"/")
+		parts := strings.Split(key, "/")
+		if len(parts) < 3 || strings.HasPrefix(key, "volumeNames/") {
+			continue
+		}
+		kind := parts[len(parts)-2]
+		if kind != "read" && kind != "write" {
+			continue
+		}
+		lockKey := strings.Join(parts[:len(parts)-2], "/")
+
+		i, ok := indices[lockKey]
+		if !ok {
+			i = len(table)
+			indices[lockKey] = i
+			table = append(table, mwtypes.LockInfo{Key: lockKey})
+		}
+		info := &table[i]
+
+		// The keys are sorted by creation revision. A writer holds the
+		// lock if its key is the first key, and a reader holds the lock
+		// if no writer's key precedes its key.
+		var holds bool
+		if kind == "write" {
+			holds = len(info.Holders) == 0 && info.Waiters == 0
+			writers[lockKey] = true
+		} else {
+			holds = !writers[lockKey]
+		}
+		if !holds {
+			info.Waiters++
+			continue
+		}
+		var h mwtypes.LockHolder
+		if len(kv.Value) > 0 {
+			if err := json.Unmarshal(kv.Value, &h); err != nil {
+				log.Debugf("EtcdVolumeLockProvider: invalid lock holder: %s: %v",
+					kv.Value, err)
+			}
+		}
+		info.Holders = append(info.Holders, h)
+	}
+
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Key < table[j].Key
+	})
+	return table, nil
+}
+
+func (p *provider) getLock(
+	ctx context.Context, pfx string) (gosync.TryLocker, error) {
+
+	log.Debugf("EtcdVolumeLockProvider: getLock: pfx=%v", pfx)
+
+	// Ensure there is a session so that an unreachable etcd is reported
+	// when the mutex is created.
+	if _, err := p.session(ctx, nil); err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint64(&p.lockID, 1)
 	return &TryMutex{
-		ctx: ctx, sess: sess, mtx: etcdsync.NewMutex(sess, pfx)}, nil
+		ctx: ctx, mtx: newRWMutex(p.client, p.session, pfx, id)}, nil
 }
 
-// TryMutex is a mutual exclusion lock backed by etcd that implements the
-// TryLocker interface.
-// The zero value for a TryMutex is an unlocked mutex.
+var _ mwtypes.LockTableReporter = &provider{}
+
+var (
+	_ mwtypes.TryRWLocker        = &TryMutex{}
+	_ mwtypes.ContextLocker      = &TryMutex{}
+	_ mwtypes.LockHolderRecorder = &TryMutex{}
+	_ mwtypes.LostLocker         = &TryMutex{}
+)
+
+// TryMutex is a reader/writer mutual exclusion lock backed by etcd that
+// implements the TryRWLocker and ContextLocker interfaces.
 //
 // A TryMutex may be copied after first use.
 type TryMutex struct {
-	ctx  context.Context
-	sess *etcdsync.Session
-	mtx  *etcdsync.Mutex
+	ctx context.Context
+	mtx *rwMutex
 
 	// LockCtx, when non-nil, is the context used with Lock.
 	LockCtx context.Context
@@ -227,59 +510,62 @@ type TryMutex struct {
 }
 
 // Lock locks m. If the lock is already in use, the calling goroutine blocks
-// until the mutex is available.
+// until the mutex is available. Failures of etcd are logged; use
+// TryLockContext to handle them.
 func (m *TryMutex) Lock() {
-	//log.Debug("TryMutex: lock")
-	ctx := m.LockCtx
-	if ctx == nil {
-		ctx = m.ctx
-	}
-	if err := m.mtx.Lock(ctx); err != nil {
-		log.Debugf("TryMutex: lock err: %v", err)
-		if err != context.Canceled && err != context.DeadlineExceeded {
-			log.Panicf("TryMutex: lock panic: %v", err)
-		}
-	}
+	m.tryLock(m.LockCtx, mwtypes.LockModeExclusive, 0)
 }
 
 // Unlock unlocks m. It is a run-time error if m is not locked on entry to
-// Unlock.
+// Unlock. Failures of etcd are logged; use UnlockContext to handle them.
 //
 // A locked TryMutex is not associated with a particular goroutine. It is
 // allowed for one goroutine to lock a Mutex and then arrange for another
 // goroutine to unlock it.
 func (m *TryMutex) Unlock() {
-	//log.Debug("TryMutex: unlock")
-	ctx := m.UnlockCtx
-	if ctx == nil {
-		ctx = m.ctx
-	}
-	if err := m.mtx.Unlock(ctx); err != nil {
-		log.Debugf("TryMutex: unlock err: %v", err)
-		if err != context.Canceled && err != context.DeadlineExceeded {
-			log.Panicf("TryMutex: unlock panic: %v", err)
-		}
+	if err := m.UnlockContext(m.context(m.UnlockCtx)); err != nil {
+		log.Errorf("TryMutex: unlock err: %s: %v", m.mtx.pfx, err)
 	}
 }
 
-// Close closes and cleans up the underlying concurrency session.
+// Close releases m. The concurrency session is shared by all of the
+// provider's mutexes and is closed when the provider is closed.
 func (m *TryMutex) Close() error {
-	//log.Debug("TryMutex: close")
-	if err := m.sess.Close(); err != nil {
-		log.Errorf("TryMutex: close err: %v", err)
-		return err
-	}
 	return nil
 }
 
 // TryLock attempts to lock m. If no lock can be obtained in the specified
 // duration then a false value is returned.
 func (m *TryMutex) TryLock(timeout time.Duration) bool {
+	return m.tryLock(m.TryLockCtx, mwtypes.LockModeExclusive, timeout)
+}
 
-	ctx := m.TryLockCtx
-	if ctx == nil {
-		ctx = m.ctx
-	}
+// RLock locks m in shared mode. If the lock is held in exclusive mode, the
+// calling goroutine blocks until the mutex is available.
+func (m *TryMutex) RLock() {
+	m.tryLock(m.LockCtx, mwtypes.LockModeShared, 0)
+}
+
+// RUnlock undoes a single RLock call.
+func (m *TryMutex) RUnlock() {
+	m.Unlock()
+}
+
+// TryRLock attempts to lock m in shared mode. If no lock can be obtained
+// in the specified duration then a false value is returned.
+func (m *TryMutex) TryRLock(timeout time.Duration) bool {
+	return m.tryLock(m.TryLockCtx, mwtypes.LockModeShared, timeout)
+}
+
+// TryLockContext attempts to lock m in the provided mode. If no lock can
+// be obtained before the timeout expires or the context is done then a
+// false value and a nil error are returned. A timeout of zero waits until
+// the context is done. An error is returned if etcd failed or if the
+// session's lease expired while waiting for the lock.
+func (m *TryMutex) TryLockContext(
+	ctx context.Context,
+	mode mwtypes.LockMode,
+	timeout time.Duration) (bool, error) {
 
 	// Create a timeout context only if the timeout is greater than zero.
 	if timeout > 0 {
@@ -288,12 +574,79 @@ func (m *TryMutex) TryLock(timeout time.Duration) bool {
 		defer cancel()
 	}
 
-	if err := m.mtx.Lock(ctx); err != nil {
-		log.Debugf("TryMutex: TryLock err: %v", err)
-		if err != context.Canceled && err != context.DeadlineExceeded {
-			log.Panicf("TryMutex: TryLock panic: %v", err)
+	err := m.mtx.lock(ctx, mode == mwtypes.LockModeShared)
+	switch err {
+	case nil:
+		return true, nil
+	case context.Canceled, context.DeadlineExceeded:
+		return false, nil
+	}
+	return false, err
+}
+
+// UnlockContext unlocks m. An error is returned if etcd failed, or
+// mwtypes.ErrLockLost if the session's lease expired while m was locked,
+// in which case another process may have obtained the lock.
+func (m *TryMutex) UnlockContext(ctx context.Context) error {
+	return m.mtx.unlock(ctx)
+}
+
+// Lost returns a channel that is closed when m's key, and with it the
+// lock, is deleted because the lease of the session with which m is
+// locked expired. A nil channel is returned if m is not locked.
+func (m *TryMutex) Lost() <-chan struct{} {
+	return m.mtx.lost()
+}
+
+func (m *TryMutex) tryLock(
+	ctx context.Context,
+	mode mwtypes.LockMode,
+	timeout time.Duration) bool {
+
+	ok, err := m.TryLockContext(m.context(ctx), mode, timeout)
+	if err != nil {
+		log.Errorf("TryMutex: lock err: %s: %v", m.mtx.pfx, err)
+	}
+	return ok
+}
+
+// context returns ctx if it is not nil, otherwise the context with which
+// m was created.
+func (m *TryMutex) context(ctx context.Context) context.Context {
+	if ctx == nil {
+		return m.ctx
+	}
+	return ctx
+}
+
+// SetLockHolder records the holder of m as the value of m's key. The
+// holder is removed when m is unlocked.
+func (m *TryMutex) SetLockHolder(
+	ctx context.Context, h mwtypes.LockHolder) error {
+
+	buf, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return m.mtx.setValue(ctx, string(buf))
+}
+
+// GetLockHolders gets the holders of m.
+func (m *TryMutex) GetLockHolders(
+	ctx context.Context) ([]mwtypes.LockHolder, error) {
+
+	vals, err := m.mtx.values(ctx)
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]mwtypes.LockHolder, 0, len(vals))
+	for _, v := range vals {
+		var h mwtypes.LockHolder
+		if err := json.Unmarshal(v, &h); err != nil {
+			log.Debugf("TryMutex: invalid lock holder: %s: %v", v, err)
+			continue
 		}
-		return false
+		holders = append(holders, h)
 	}
-	return true
+	return holders, nil
 }
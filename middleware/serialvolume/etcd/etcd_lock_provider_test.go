@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/akutz/gosync"
+	etcd "github.com/coreos/etcd/clientv3"
 	log "github.com/sirupsen/logrus"
 
 	csietcd "github.com/rexray/gocsi/middleware/serialvolume/etcd"
@@ -17,19 +21,30 @@ import (
 
 var p mwtypes.VolumeLockerProvider
 
+// TestMain runs the tests against the etcd cluster specified with
+// X_CSI_SERIAL_VOL_ACCESS_ETCD_ENDPOINTS or, if no cluster is specified,
+// an etcd cluster embedded in the test process.
 func TestMain(m *testing.M) {
 	log.SetLevel(log.InfoLevel)
+	stopEtcd := func() {}
 	if os.Getenv(csietcd.EnvVarEndpoints) == "" {
-		os.Exit(0)
+		endpoint, stop, err := startEmbeddedEtcd()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		stopEtcd = stop
+		os.Setenv(csietcd.EnvVarEndpoints, endpoint)
 	}
 	os.Setenv(csietcd.EnvVarDialTimeout, "1s")
 	var err error
 	p, err = csietcd.New(context.TODO(), "/gocsi/etcd", 0, nil)
 	if err != nil {
+		stopEtcd()
 		log.Fatalln(err)
 	}
 	exitCode := m.Run()
 	p.(io.Closer).Close()
+	stopEtcd()
 	os.Exit(exitCode)
 }
 
@@ -97,6 +112,345 @@ func TestTryMutex_Lock(t *testing.T) {
 	}
 }
 
+func TestTryMutex_SessionExpired(t *testing.T) {
+
+	var (
+		id  = t.Name()
+		ctx = context.Background()
+	)
+
+	m1, err := p.GetLockWithID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m1.(io.Closer).Close()
+	if !m1.TryLock(time.Duration(3) * time.Second) {
+		t.Fatal("m1 not locked")
+	}
+
+	// Revoke the lease of the session with which m1 is locked, as etcd
+	// does when the session is not kept alive for its TTL.
+	client, err := etcd.New(etcd.Config{
+		Endpoints:   strings.Split(os.Getenv(csietcd.EnvVarEndpoints), ","),
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	lost := m1.(mwtypes.LostLocker).Lost()
+	if _, err := client.Revoke(ctx, m1.(*csietcd.TryMutex).Lease()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(time.Duration(3) * time.Second):
+		t.Fatal("m1 not lost")
+	}
+
+	// m1's key was deleted with the lease, so m2 obtains the lock with a
+	// new session.
+	m2, err := p.GetLockWithID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m2.(io.Closer).Close()
+	if !m2.TryLock(time.Duration(3) * time.Second) {
+		t.Fatal("m2 not locked")
+	}
+	defer m2.Unlock()
+
+	// Unlocking m1 reports the lost lock and must not release the lock
+	// held by m2.
+	err = m1.(mwtypes.ContextLocker).UnlockContext(ctx)
+	if err != mwtypes.ErrLockLost {
+		t.Fatalf("m1 unlock err=%v, expected %v", err, mwtypes.ErrLockLost)
+	}
+	m3, err := p.GetLockWithID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m3.(io.Closer).Close()
+	if m3.TryLock(time.Duration(1) * time.Second) {
+		m3.Unlock()
+		t.Fatal("m3 locked")
+	}
+}
+
+func TestTryMutex_RWExclusion(t *testing.T) {
+
+	var (
+		id  = t.Name()
+		ctx = context.Background()
+	)
+
+	lock := func(mode mwtypes.LockMode, timeout time.Duration) (
+		gosync.TryLocker, bool) {
+
+		m, err := p.GetLockWithID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := m.(mwtypes.ContextLocker).TryLockContext(ctx, mode, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m, ok
+	}
+
+	// Readers share the lock.
+	r1, ok := lock(mwtypes.LockModeShared, time.Second)
+	if !ok {
+		t.Fatal("r1 not locked")
+	}
+	r2, ok := lock(mwtypes.LockModeShared, time.Second)
+	if !ok {
+		t.Fatal("r2 not locked")
+	}
+
+	// A writer waits for the readers.
+	if w, ok := lock(mwtypes.LockModeExclusive, time.Second); ok {
+		w.Unlock()
+		t.Fatal("w locked while read locked")
+	}
+
+	// A reader queued behind a waiting writer waits for the writer.
+	wc := make(chan gosync.TryLocker, 1)
+	go func() {
+		w, ok := lock(mwtypes.LockModeExclusive, 5*time.Second)
+		if !ok {
+			w = nil
+		}
+		wc <- w
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if r3, ok := lock(mwtypes.LockModeShared, time.Second); ok {
+		r3.Unlock()
+		t.Fatal("r3 locked while a writer waits")
+	}
+
+	// The writer obtains the lock once the readers unlock, and excludes
+	// the readers until it unlocks.
+	r1.Unlock()
+	r2.Unlock()
+	w := <-wc
+	if w == nil {
+		t.Fatal("w not locked")
+	}
+	if r4, ok := lock(mwtypes.LockModeShared, time.Second); ok {
+		r4.Unlock()
+		t.Fatal("r4 locked while write locked")
+	}
+	w.Unlock()
+	r5, ok := lock(mwtypes.LockModeShared, time.Second)
+	if !ok {
+		t.Fatal("r5 not locked")
+	}
+	r5.Unlock()
+}
+
+func TestTryMutex_LockLocked(t *testing.T) {
+
+	ctx := context.Background()
+	m, err := p.GetLockWithID(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.TryLock(time.Second) {
+		t.Fatal("m not locked")
+	}
+	defer m.Unlock()
+
+	_, err = m.(mwtypes.ContextLocker).TryLockContext(
+		ctx, mwtypes.LockModeExclusive, time.Second)
+	if err == nil {
+		t.Fatal("second lock of m did not fail")
+	}
+}
+
+func TestTryMutex_CanceledWait(t *testing.T) {
+
+	var (
+		id  = t.Name()
+		ctx = context.Background()
+	)
+
+	m1, err := p.GetLockWithID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m1.TryLock(time.Second) {
+		t.Fatal("m1 not locked")
+	}
+
+	// m2 gives up waiting with a canceled context. Its key is removed
+	// even though the context is done, so m3 is not queued behind it.
+	m2, err := p.GetLockWithID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	ok, err := m2.(mwtypes.ContextLocker).TryLockContext(
+		cctx, mwtypes.LockModeExclusive, 0)
+	if ok || err != nil {
+		t.Fatalf("m2 ok=%v, err=%v, expected not locked", ok, err)
+	}
+
+	m1.Unlock()
+	m3, err := p.GetLockWithID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m3.TryLock(time.Second) {
+		t.Fatal("m3 not locked")
+	}
+	m3.Unlock()
+}
+
+func TestWaitDelete_Compacted(t *testing.T) {
+
+	var (
+		key = "/gocsi/etcd/" + t.Name()
+		ctx = context.Background()
+	)
+
+	client, err := etcd.New(etcd.Config{
+		Endpoints:   strings.Split(os.Getenv(csietcd.EnvVarEndpoints), ","),
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	rep, err := client.Put(ctx, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := rep.Header.Revision
+
+	// Compact the revision from which the key is watched so that the
+	// watch fails before the key is deleted.
+	rep, err = client.Put(ctx, key+"/other", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Delete(ctx, key+"/other")
+	if _, err := client.Compact(ctx, rep.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- csietcd.WaitDelete(ctx, client, key, rev, rev)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("wait ended before delete: err=%v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if _, err := client.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Duration(3) * time.Second):
+		t.Fatal("wait not ended by delete")
+	}
+}
+
+func TestProvider_EscapedIDs(t *testing.T) {
+
+	ctx := context.Background()
+
+	// Without escaping, the lock of the volume "a/write" would be the
+	// writer queue of the lock of the volume "a".
+	m1, err := p.GetLockWithID(ctx, t.Name()+"/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m1.TryLock(time.Second) {
+		t.Fatal("m1 not locked")
+	}
+	defer m1.Unlock()
+
+	m2, err := p.GetLockWithID(ctx, t.Name()+"/a/write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m2.TryLock(time.Second) {
+		t.Fatal("m2 not locked")
+	}
+	defer m2.Unlock()
+
+	m3, err := p.GetLockWithID(ctx, t.Name()+"/a/write/..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m3.TryLock(time.Second) {
+		t.Fatal("m3 not locked")
+	}
+	defer m3.Unlock()
+
+	table, err := p.(mwtypes.LockTableReporter).GetLockTable(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, l := range table {
+		if strings.Contains(l.Key, "TestProvider_EscapedIDs") {
+			keys = append(keys, l.Key)
+		}
+	}
+	exp := []string{
+		"volumesByID/TestProvider_EscapedIDs%2Fa",
+		"volumesByID/TestProvider_EscapedIDs%2Fa%2Fwrite",
+		"volumesByID/TestProvider_EscapedIDs%2Fa%2Fwrite%2F..",
+	}
+	if !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("keys=%v, expected %v", keys, exp)
+	}
+}
+
+func TestProvider_KeyLayout(t *testing.T) {
+
+	ctx := context.Background()
+	m, err := p.GetLockWithID(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.TryLock(time.Second) {
+		t.Fatal("m not locked")
+	}
+	defer m.Unlock()
+
+	client, err := etcd.New(etcd.Config{
+		Endpoints:   strings.Split(os.Getenv(csietcd.EnvVarEndpoints), ","),
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The locks are stored under the version of the key layout so that
+	// they are not mistaken for the locks of earlier versions.
+	rep, err := client.Get(
+		ctx, "/gocsi/etcd/v2/volumesByID/"+t.Name()+"/write/",
+		etcd.WithPrefix(), etcd.WithCountOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Count != 1 {
+		t.Fatalf("keys=%d, expected 1", rep.Count)
+	}
+}
+
 func ExampleTryMutex_TryLock() {
 
 	const lockName = "ExampleTryMutex_TryLock"
@@ -0,0 +1,341 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	etcdsync "github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+// errLockLost is returned when the key of a lock is deleted while the
+// lock is held or waited for, which happens when the lease of the session
+// with which the key was created expires.
+var errLockLost = mwtypes.ErrLockLost
+
+// rwMutex is a reader/writer lock backed by etcd. Each holder, or waiter,
+// creates a key under the lock's prefix, PREFIX/read/LEASE-ID for readers
+// and PREFIX/write/LEASE-ID for writers, and the lock is granted in the
+// order the keys are created. A reader waits for the writer keys created
+// before its key to be deleted, and a writer waits for all of the keys
+// created before its key to be deleted.
+//
+// The keys are bound to the lease of a session shared by all of the
+// mutexes of a provider, and the ID distinguishes the keys of the mutexes
+// that share a session.
+type rwMutex struct {
+	client  *etcd.Client
+	session sessionFunc
+	pfx     string
+	id      uint64
+
+	sess *etcdsync.Session // the session with which key was created
+	key  string
+	rev  int64 // the creation revision of key
+
+	lostCh    chan struct{}      // closed when the held lock is lost
+	stopWatch context.CancelFunc // stops watching for the lock's loss
+}
+
+// sessionFunc returns the session with which to lock a mutex. If expired is
+// not nil then it is a session whose lease was found to be expired, and a
+// new session is returned.
+type sessionFunc func(
+	ctx context.Context,
+	expired *etcdsync.Session) (*etcdsync.Session, error)
+
+func newRWMutex(
+	client *etcd.Client,
+	session sessionFunc,
+	pfx string,
+	id uint64) *rwMutex {
+
+	return &rwMutex{client: client, session: session, pfx: pfx + "/", id: id}
+}
+
+// lock obtains the lock in shared mode if the shared flag is true or
+// exclusive mode if it is false. If the context is canceled before the
+// lock is obtained then the lock's key is removed and the context's error
+// is returned. If the session's lease expires before the lock is obtained
+// then errLockLost is returned.
+func (m *rwMutex) lock(ctx context.Context, shared bool) error {
+	if m.key != "" {
+		return errors.New("lock of locked mutex")
+	}
+
+	kind, waitPfx := "write", m.pfx
+	if shared {
+		kind, waitPfx = "read", m.pfx+"write/"
+	}
+
+	var (
+		sess *etcdsync.Session
+		key  string
+		rep  *etcd.PutResponse
+		err  error
+	)
+	for i := 0; i < 2; i++ {
+		// The lease of the session may have expired before the session's
+		// keep alive noticed, in which case the session is replaced once.
+		if sess, err = m.session(ctx, sess); err != nil {
+			return err
+		}
+		key = fmt.Sprintf("%s%s/%x-%x", m.pfx, kind, sess.Lease(), m.id)
+		rep, err = m.client.Put(ctx, key, "", etcd.WithLease(sess.Lease()))
+		if err != rpctypes.ErrLeaseNotFound {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.sess, m.key, m.rev = sess, key, rep.Header.Revision
+
+	// Stop waiting if the session's lease expires, since the key, and
+	// with it the key's place in the queue, is deleted with the lease.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-sess.Done():
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+
+	err = waitDeletes(wctx, m.client, waitPfx, m.rev-1)
+	if err == nil {
+		// The lease may have expired after the keys ahead of this one
+		// were deleted, in which case another process may hold the lock.
+		err = m.check(ctx)
+	}
+	if err != nil {
+		select {
+		case <-sess.Done():
+			err = errLockLost
+		default:
+		}
+		// Remove the key so that the waiters queued behind it do not
+		// wait for a lock that will never be obtained. The caller's
+		// context may be done, so the key is removed with a context of
+		// its own.
+		uctx, cancel := context.WithTimeout(m.client.Ctx(), cleanupTimeout)
+		defer cancel()
+		m.unlock(uctx)
+		m.sess, m.key, m.rev = nil, "", 0
+		return err
+	}
+
+	var lctx context.Context
+	lctx, m.stopWatch = context.WithCancel(m.client.Ctx())
+	m.lostCh = make(chan struct{})
+	go watchLost(lctx, m.client, sess, m.key, m.rev, m.lostCh)
+	return nil
+}
+
+// lost returns a channel that is closed when the held lock is lost, or
+// nil if the lock is not held.
+func (m *rwMutex) lost() <-chan struct{} {
+	return m.lostCh
+}
+
+// check returns errLockLost if the lock's key was deleted.
+func (m *rwMutex) check(ctx context.Context) error {
+	rep, err := m.client.Get(ctx, m.key)
+	if err != nil {
+		return err
+	}
+	if len(rep.Kvs) == 0 || rep.Kvs[0].CreateRevision != m.rev {
+		return errLockLost
+	}
+	return nil
+}
+
+// unlock releases the lock. If the lock's key was deleted while the lock
+// was held then errLockLost is returned, since another process may have
+// obtained the lock in the meantime.
+func (m *rwMutex) unlock(ctx context.Context) error {
+	if m.key == "" {
+		return errors.New("unlock of unlocked mutex")
+	}
+	if m.stopWatch != nil {
+		m.stopWatch()
+		m.lostCh, m.stopWatch = nil, nil
+	}
+	cmp := etcd.Compare(etcd.CreateRevision(m.key), "=", m.rev)
+	rep, err := m.client.Txn(ctx).If(cmp).Then(etcd.OpDelete(m.key)).Commit()
+	if err != nil {
+		return err
+	}
+	m.sess, m.key, m.rev = nil, "", 0
+	if !rep.Succeeded {
+		return errLockLost
+	}
+	return nil
+}
+
+// setValue sets the value of the lock's key. The lock must be held.
+func (m *rwMutex) setValue(ctx context.Context, val string) error {
+	if m.key == "" {
+		return errors.New("set value of unlocked mutex")
+	}
+	// Put the value only if the key exists, otherwise the put would
+	// recreate the key at the end of the queue.
+	cmp := etcd.Compare(etcd.CreateRevision(m.key), "=", m.rev)
+	put := etcd.OpPut(m.key, val, etcd.WithLease(m.sess.Lease()))
+	rep, err := m.client.Txn(ctx).If(cmp).Then(put).Commit()
+	if err != nil {
+		return err
+	}
+	if !rep.Succeeded {
+		return errLockLost
+	}
+	return nil
+}
+
+// values gets the non-empty values of the keys of the lock's holders
+// and waiters.
+func (m *rwMutex) values(ctx context.Context) ([][]byte, error) {
+	rep, err := m.client.Get(ctx, m.pfx, etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var vals [][]byte
+	for _, kv := range rep.Kvs {
+		if len(kv.Value) > 0 {
+			vals = append(vals, kv.Value)
+		}
+	}
+	return vals, nil
+}
+
+// watchLost closes lost if the key is deleted, or the session's lease
+// expires, before the context is done. The key is deleted by another
+// process only when the lease with which it was created expires, but the
+// session notices the expiry only when it next renews the lease. The key
+// is watched again after errors, ex. when etcd is unreachable, since
+// only the key's deletion or the session's end means the lock is lost.
+func watchLost(
+	ctx context.Context,
+	client *etcd.Client,
+	sess *etcdsync.Session,
+	key string,
+	rev int64,
+	lost chan struct{}) {
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-sess.Done():
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+
+	for {
+		err := waitDelete(wctx, client, key, rev, rev)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil || wctx.Err() != nil {
+			close(lost)
+			return
+		}
+		select {
+		case <-time.After(watchRetryInterval):
+		case <-wctx.Done():
+		}
+	}
+}
+
+// watchRetryInterval is the time to wait before watching a held lock's key
+// again after the watch failed with an error other than the key's delete.
+const watchRetryInterval = time.Second
+
+// waitDeletes waits until all of the keys with the provided prefix and
+// a creation revision no greater than maxCreateRev are deleted.
+func waitDeletes(
+	ctx context.Context,
+	client *etcd.Client,
+	pfx string,
+	maxCreateRev int64) error {
+
+	opts := append(etcd.WithLastCreate(), etcd.WithMaxCreateRev(maxCreateRev))
+	for {
+		rep, err := client.Get(ctx, pfx, opts...)
+		if err != nil {
+			return err
+		}
+		if len(rep.Kvs) == 0 {
+			return nil
+		}
+		kv := rep.Kvs[0]
+		if err := waitDelete(
+			ctx, client, string(kv.Key), kv.CreateRevision,
+			rep.Header.Revision); err != nil {
+			return err
+		}
+	}
+}
+
+// waitDelete waits until the key created at createRev is deleted at or
+// after the revision rev. If the watch fails, ex. because rev has been
+// compacted or the watch was canceled by the server, then the key is
+// watched again from the current revision if it still exists with the
+// same creation revision.
+func waitDelete(
+	ctx context.Context,
+	client *etcd.Client,
+	key string,
+	createRev int64,
+	rev int64) error {
+
+	for {
+		if watchDelete(ctx, client, key, rev) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rep, err := client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(rep.Kvs) == 0 || rep.Kvs[0].CreateRevision != createRev {
+			return nil
+		}
+		rev = rep.Header.Revision + 1
+	}
+}
+
+// watchDelete watches the key from the revision rev and returns true when
+// the key is deleted, or false if the watch ends before then.
+func watchDelete(
+	ctx context.Context,
+	client *etcd.Client,
+	key string,
+	rev int64) bool {
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for rep := range client.Watch(wctx, key, etcd.WithRev(rev)) {
+		if rep.Err() != nil {
+			return false
+		}
+		for _, ev := range rep.Events {
+			if ev.Type == mvccpb.DELETE {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package etcd
+
+import (
+	"context"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+// Lease returns the ID of the lease of the session with which m is locked.
+func (m *TryMutex) Lease() etcd.LeaseID {
+	return m.mtx.sess.Lease()
+}
+
+// WaitDelete waits until the key created at createRev is deleted at or
+// after the revision rev.
+func WaitDelete(
+	ctx context.Context,
+	client *etcd.Client,
+	key string,
+	createRev int64,
+	rev int64) error {
+
+	return waitDelete(ctx, client, key, createRev, rev)
+}
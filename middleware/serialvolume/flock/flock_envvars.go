@@ -0,0 +1,7 @@
+package flock
+
+const (
+	// EnvVarDir is the name of the environment variable that defines
+	// the directory in which the lock provider creates its lock files.
+	EnvVarDir = "X_CSI_SERIAL_VOL_ACCESS_FLOCK_DIR"
+)
@@ -0,0 +1,524 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package flock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/akutz/gosync"
+	log "github.com/sirupsen/logrus"
+
+	csictx "github.com/rexray/gocsi/context"
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+const (
+	volumesByIDDir     = "volumesByID"
+	volumesByNameDir   = "volumesByName"
+	volumeResourcesDir = "volumeResources"
+	volumeNamesDir     = "volumeNames"
+)
+
+// New returns a new volume lock provider that uses flock(2) on files in
+// the provided directory. The locks are shared by all of the processes
+// that use the same directory, ex. several instances of a node plugin
+// that share a host directory. If the directory is empty then the value
+// of the environment variable X_CSI_SERIAL_VOL_ACCESS_FLOCK_DIR is used.
+//
+// A lock file exists only while its lock is held or waited for. Locks
+// held by a process are released by the operating system when the
+// process exits, so the locks of a process that dies are never orphaned.
+func New(
+	ctx context.Context,
+	dir string) (mwtypes.VolumeLockerProvider, error) {
+
+	if dir == "" {
+		dir = csictx.Getenv(ctx, EnvVarDir)
+	}
+	if dir == "" {
+		return nil, errors.New("flock: lock directory required")
+	}
+
+	for _, d := range []string{
+		volumesByIDDir,
+		volumesByNameDir,
+		volumeResourcesDir,
+		volumeNamesDir,
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithField("serialvol.flock.dir", dir).Info(
+		"creating serial vol flock lock provider")
+
+	return &provider{dir: dir, locks: map[string]*lockState{}}, nil
+}
+
+type provider struct {
+	dir string
+
+	// locks are the locks held or waited for by this process.
+	locksL sync.Mutex
+	locks  map[string]*lockState
+}
+
+type lockState struct {
+	key     string
+	holders map[*TryMutex]mwtypes.LockHolder
+	waiters int
+}
+
+func (p *provider) GetLockWithID(
+	ctx context.Context, id string) (gosync.TryLocker, error) {
+
+	return p.getLock(volumesByIDDir, id, id), nil
+}
+
+func (p *provider) GetLockWithName(
+	ctx context.Context, name string) (gosync.TryLocker, error) {
+
+	return p.getLock(volumesByNameDir, name, name), nil
+}
+
+func (p *provider) GetResourceLockWithID(
+	ctx context.Context, id, key string) (gosync.TryLocker, error) {
+
+	// Volume IDs cannot contain the NUL character, so the combined key
+	// is unique.
+	return p.getLock(volumeResourcesDir, id+"\x00"+key, id+"/"+key), nil
+}
+
+func (p *provider) SetVolumeName(
+	ctx context.Context, id, name string) error {
+
+	// Write the name to a temporary file and rename it so that readers
+	// never observe a partially written name.
+	dir := filepath.Join(p.dir, volumeNamesDir)
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(name); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, fileName(id))); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (p *provider) GetVolumeName(
+	ctx context.Context, id string) (string, error) {
+
+	buf, err := ioutil.ReadFile(
+		filepath.Join(p.dir, volumeNamesDir, fileName(id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (p *provider) DeleteVolumeName(
+	ctx context.Context, id string) error {
+
+	err := os.Remove(filepath.Join(p.dir, volumeNamesDir, fileName(id)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// GetLockTable gets the locks that are held or waited for by this
+// process. Locks held by other processes that share the provider's
+// directory are not reported. The keys of the locks are:
+//
+//	volumesByID/VOLUME_ID
+//	volumesByName/VOLUME_NAME
+//	volumeResources/VOLUME_ID/RESOURCE
+func (p *provider) GetLockTable(
+	ctx context.Context) ([]mwtypes.LockInfo, error) {
+
+	p.locksL.Lock()
+	defer p.locksL.Unlock()
+	table := make([]mwtypes.LockInfo, 0, len(p.locks))
+	for _, st := range p.locks {
+		info := mwtypes.LockInfo{Key: st.key, Waiters: st.waiters}
+		for _, h := range st.holders {
+			info.Holders = append(info.Holders, h)
+		}
+		table = append(table, info)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Key < table[j].Key
+	})
+	return table, nil
+}
+
+// getLock returns a lock for the key. The name is the key's description
+// in the lock table.
+func (p *provider) getLock(kind, key, name string) *TryMutex {
+	log.Debugf("FlockVolumeLockProvider: getLock: kind=%s, key=%q", kind, key)
+	return &TryMutex{
+		p:    p,
+		key:  kind + "/" + name,
+		path: filepath.Join(p.dir, kind, fileName(key)+".lock"),
+	}
+}
+
+// update updates the state of the lock in this process's lock table.
+func (p *provider) update(m *TryMutex, f func(st *lockState)) {
+	p.locksL.Lock()
+	defer p.locksL.Unlock()
+	st := p.locks[m.path]
+	if st == nil {
+		st = &lockState{
+			key:     m.key,
+			holders: map[*TryMutex]mwtypes.LockHolder{},
+		}
+		p.locks[m.path] = st
+	}
+	f(st)
+	if st.waiters == 0 && len(st.holders) == 0 {
+		delete(p.locks, m.path)
+	}
+}
+
+// fileName returns the name of the file for a key. Keys are hashed as
+// they may contain path separators or exceed the maximum file name length.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+var _ mwtypes.LockTableReporter = &provider{}
+
+var (
+	_ mwtypes.TryRWLocker        = &TryMutex{}
+	_ mwtypes.ContextLocker      = &TryMutex{}
+	_ mwtypes.LockHolderRecorder = &TryMutex{}
+)
+
+// TryMutex is a reader/writer mutual exclusion lock backed by flock(2)
+// that implements the TryRWLocker and ContextLocker interfaces. A TryMutex
+// may be held only once at a time.
+type TryMutex struct {
+	p    *provider
+	key  string
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Lock locks m. If the lock is already in use, the calling goroutine blocks
+// until the mutex is available. Failures to lock the file are logged; use
+// TryLockContext to handle them.
+func (m *TryMutex) Lock() {
+	m.tryLock(
+		context.Background(), mwtypes.LockModeExclusive, waitIndefinitely)
+}
+
+// Unlock unlocks m. It is a run-time error if m is not locked on entry to
+// Unlock. Failures to unlock the file are logged; use UnlockContext to
+// handle them.
+func (m *TryMutex) Unlock() {
+	if err := m.UnlockContext(context.Background()); err != nil {
+		log.Errorf("TryMutex: unlock err: %s: %v", m.key, err)
+	}
+}
+
+// TryLock attempts to lock m. If no lock can be obtained in the specified
+// duration then a false value is returned.
+func (m *TryMutex) TryLock(timeout time.Duration) bool {
+	return m.tryLock(context.Background(), mwtypes.LockModeExclusive, timeout)
+}
+
+// RLock locks m in shared mode. If the lock is held in exclusive mode, the
+// calling goroutine blocks until the mutex is available. Failures to lock
+// the file are logged; use TryLockContext to handle them.
+func (m *TryMutex) RLock() {
+	m.tryLock(context.Background(), mwtypes.LockModeShared, waitIndefinitely)
+}
+
+// RUnlock undoes a single RLock call.
+func (m *TryMutex) RUnlock() {
+	m.Unlock()
+}
+
+// TryRLock attempts to lock m in shared mode. If no lock can be obtained
+// in the specified duration then a false value is returned.
+func (m *TryMutex) TryRLock(timeout time.Duration) bool {
+	return m.tryLock(context.Background(), mwtypes.LockModeShared, timeout)
+}
+
+// TryLockContext attempts to lock m in the provided mode. If no lock can
+// be obtained before the timeout expires or the context is done then a
+// false value and a nil error are returned. A timeout of zero does not
+// wait at all, and a negative timeout waits until the context is done.
+// An error is returned if the lock file could not be opened or locked.
+func (m *TryMutex) TryLockContext(
+	ctx context.Context,
+	mode mwtypes.LockMode,
+	timeout time.Duration) (bool, error) {
+
+	how := syscall.LOCK_EX
+	if mode == mwtypes.LockModeShared {
+		how = syscall.LOCK_SH
+	}
+	return m.lock(ctx, how, timeout)
+}
+
+// UnlockContext unlocks m. An error is returned if m is not locked or if
+// the lock file could not be closed.
+func (m *TryMutex) UnlockContext(ctx context.Context) error {
+	return m.unlock()
+}
+
+// Close releases m if it is still held.
+func (m *TryMutex) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.f == nil {
+		return nil
+	}
+	m.p.update(m, func(st *lockState) { delete(st.holders, m) })
+	err := m.f.Close()
+	m.f = nil
+	return err
+}
+
+// SetLockHolder records the holder of m in this process's lock table.
+// The holder is removed when m is unlocked.
+func (m *TryMutex) SetLockHolder(
+	ctx context.Context, h mwtypes.LockHolder) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.f == nil {
+		return errors.New("set holder of unlocked mutex")
+	}
+	m.p.update(m, func(st *lockState) { st.holders[m] = h })
+	return nil
+}
+
+// GetLockHolders gets the holders of m in this process. The holders in
+// other processes are not reported.
+func (m *TryMutex) GetLockHolders(
+	ctx context.Context) ([]mwtypes.LockHolder, error) {
+
+	m.p.locksL.Lock()
+	defer m.p.locksL.Unlock()
+	st := m.p.locks[m.path]
+	if st == nil {
+		return nil, nil
+	}
+	holders := make([]mwtypes.LockHolder, 0, len(st.holders))
+	for _, h := range st.holders {
+		holders = append(holders, h)
+	}
+	return holders, nil
+}
+
+func (m *TryMutex) tryLock(
+	ctx context.Context,
+	mode mwtypes.LockMode,
+	timeout time.Duration) bool {
+
+	ok, err := m.TryLockContext(ctx, mode, timeout)
+	if err != nil {
+		log.Errorf("TryMutex: lock err: %s: %v", m.key, err)
+	}
+	return ok
+}
+
+const (
+	minPollInterval = 5 * time.Millisecond
+	maxPollInterval = 100 * time.Millisecond
+
+	// waitIndefinitely is the timeout with which a lock is obtained by
+	// Lock and RLock.
+	waitIndefinitely = -1
+)
+
+// lock obtains the lock. A negative timeout waits until the context is
+// done, and a timeout of zero does not wait at all.
+func (m *TryMutex) lock(
+	ctx context.Context,
+	how int,
+	timeout time.Duration) (bool, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.f != nil {
+		return false, errors.New("lock of locked mutex")
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	m.p.update(m, func(st *lockState) { st.waiters++ })
+	acquired := false
+	defer m.p.update(m, func(st *lockState) {
+		st.waiters--
+		if acquired {
+			st.holders[m] = mwtypes.LockHolder{}
+		}
+	})
+
+	for {
+		f, err := os.OpenFile(m.path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := flock(ctx, f, how, timeout, deadline)
+		if err != nil || !ok {
+			f.Close()
+			return false, err
+		}
+
+		// The file may have been removed by the previous holder after
+		// this file was opened. If so then the lock is for a file that
+		// no longer exists and the lock must be obtained again.
+		if ok, err := isCurrent(f, m.path); err != nil {
+			f.Close()
+			return false, err
+		} else if !ok {
+			f.Close()
+			continue
+		}
+
+		m.f = f
+		acquired = true
+		return true, nil
+	}
+}
+
+// unlock releases the lock. The lock file is removed if no other holder
+// or waiter has it locked.
+func (m *TryMutex) unlock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.f == nil {
+		return errors.New("unlock of unlocked mutex")
+	}
+	f := m.f
+	m.f = nil
+	m.p.update(m, func(st *lockState) { delete(st.holders, m) })
+
+	// Removing the file requires an exclusive lock. An exclusive lock
+	// is already held, and a shared lock is converted if there are no
+	// other holders. Waiters that opened the file before it is removed
+	// obtain the lock again once they detect the file was removed.
+	if err := flockNB(f, syscall.LOCK_EX); err == nil {
+		if err := os.Remove(m.path); err != nil && !os.IsNotExist(err) {
+			log.Debugf("TryMutex: remove lock file err: %v", err)
+		}
+	}
+	return f.Close()
+}
+
+// flock locks the file. A negative timeout waits until the context is
+// done, and a timeout of zero does not wait at all.
+func flock(
+	ctx context.Context,
+	f *os.File,
+	how int,
+	timeout time.Duration,
+	deadline time.Time) (bool, error) {
+
+	if timeout < 0 && ctx.Done() == nil {
+		for {
+			err := syscall.Flock(int(f.Fd()), how)
+			if err != syscall.EINTR {
+				return err == nil, err
+			}
+		}
+	}
+
+	// flock(2) cannot time out or be canceled, so a non-blocking lock is
+	// attempted until it succeeds, the deadline passes, or the context is
+	// done.
+	interval := minPollInterval
+	for {
+		err := flockNB(f, how)
+		if err == nil {
+			return true, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			return false, err
+		}
+		if timeout == 0 {
+			return false, nil
+		}
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return false, nil
+			}
+			if interval > remaining {
+				interval = remaining
+			}
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return false, nil
+		case <-t.C:
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+	}
+}
+
+func flockNB(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// isCurrent returns a flag indicating whether or not the open file is
+// the file at the provided path.
+func isCurrent(f *os.File, path string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	pfi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(fi, pfi), nil
+}
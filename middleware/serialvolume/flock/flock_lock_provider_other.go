@@ -0,0 +1,18 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package flock
+
+import (
+	"context"
+	"errors"
+
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+// New returns an error as flock(2) is not supported on this platform.
+func New(
+	ctx context.Context,
+	dir string) (mwtypes.VolumeLockerProvider, error) {
+
+	return nil, errors.New("flock: unsupported platform")
+}
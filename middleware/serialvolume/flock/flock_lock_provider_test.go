@@ -0,0 +1,228 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package flock_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akutz/gosync"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rexray/gocsi/middleware/serialvolume"
+	csiflock "github.com/rexray/gocsi/middleware/serialvolume/flock"
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+// envVarHelper is set when the test binary is executed by a test as a
+// helper process that holds a lock until it is killed.
+const envVarHelper = "GOCSI_TEST_FLOCK_HELPER"
+
+var helperLock gosync.TryLocker
+
+func TestMain(m *testing.M) {
+	if id := os.Getenv(envVarHelper); id != "" {
+		p, err := csiflock.New(context.Background(), "")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// The lock is assigned to a package-level variable so its file
+		// is not closed by a finalizer while the helper blocks.
+		helperLock, _ = p.GetLockWithID(context.Background(), id)
+		helperLock.Lock()
+		fmt.Println("locked")
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func newProvider(t *testing.T) (mwtypes.VolumeLockerProvider, string) {
+	dir, err := ioutil.TempDir("", "gocsi-flock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := csiflock.New(context.Background(), dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return p, dir
+}
+
+func TestTryMutex_SharedExclusive(t *testing.T) {
+	p, dir := newProvider(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	lock := func() mwtypes.TryRWLocker {
+		l, err := p.GetLockWithID(ctx, t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.(mwtypes.TryRWLocker)
+	}
+
+	a, b, c := lock(), lock(), lock()
+	if !a.TryRLock(0) || !b.TryRLock(0) {
+		t.Fatal("failed to obtain shared locks")
+	}
+	if c.TryLock(20 * time.Millisecond) {
+		t.Fatal("obtained exclusive lock while shared locks are held")
+	}
+	a.RUnlock()
+	b.RUnlock()
+	if !c.TryLock(time.Second) {
+		t.Fatal("failed to obtain exclusive lock")
+	}
+	if a.TryRLock(20 * time.Millisecond) {
+		t.Fatal("obtained shared lock while exclusive lock is held")
+	}
+	c.Unlock()
+
+	// The lock file is removed once the lock is no longer held.
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*.lock"))
+	if len(files) != 0 {
+		t.Fatalf("lock files not removed: %v", files)
+	}
+}
+
+func TestTryMutex_HolderDies(t *testing.T) {
+	p, dir := newProvider(t)
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(),
+		envVarHelper+"="+t.Name(),
+		csiflock.EnvVarDir+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "locked\n" {
+		t.Fatalf("helper process failed to lock: %q", line)
+	}
+
+	lock, err := p.GetLockWithID(context.Background(), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.TryLock(20 * time.Millisecond) {
+		t.Fatal("obtained lock held by another process")
+	}
+
+	// The operating system releases the lock when the holder dies.
+	cmd.Process.Kill()
+	cmd.Wait()
+	if !lock.TryLock(time.Second) {
+		t.Fatal("failed to obtain lock after holder died")
+	}
+	lock.Unlock()
+}
+
+func TestTryMutex_Context(t *testing.T) {
+	p, dir := newProvider(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	lock := func() mwtypes.ContextLocker {
+		l, err := p.GetLockWithID(ctx, t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.(mwtypes.ContextLocker)
+	}
+
+	a, b := lock(), lock()
+	if ok, err := a.TryLockContext(
+		ctx, mwtypes.LockModeExclusive, 0); !ok || err != nil {
+		t.Fatalf("ok=%v, err=%v, expected lock", ok, err)
+	}
+
+	// A negative timeout waits until the context is done.
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if ok, err := b.TryLockContext(
+		tctx, mwtypes.LockModeShared, -1); ok || err != nil {
+		t.Fatalf("ok=%v, err=%v, expected no lock", ok, err)
+	}
+
+	if err := a.UnlockContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UnlockContext(ctx); err == nil {
+		t.Fatal("unlocked unlocked mutex")
+	}
+
+	// Failures are logged by the methods that cannot return them.
+	a.(gosync.TryLocker).Unlock()
+}
+
+func TestTryMutex_Unavailable(t *testing.T) {
+	p, dir := newProvider(t)
+	ctx := context.Background()
+	lock, err := p.GetLockWithID(ctx, "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock file cannot be created once the directory is removed.
+	os.RemoveAll(dir)
+	if ok, err := lock.(mwtypes.ContextLocker).TryLockContext(
+		ctx, mwtypes.LockModeExclusive, 0); ok || err == nil {
+		t.Fatalf("ok=%v, err=%v, expected error", ok, err)
+	}
+	lock.Lock()
+	if lock.TryLock(0) {
+		t.Fatal("obtained lock without lock file")
+	}
+
+	// The interceptor reports the failure as unavailable.
+	i := serialvolume.New(serialvolume.WithLockProvider(p))
+	_, err = i(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: "vol-1",
+	}, &grpc.UnaryServerInfo{
+		FullMethod: "/csi.v1.Controller/DeleteVolume",
+	}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("handler invoked without lock")
+		return nil, nil
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("err=%v, expected code Unavailable", err)
+	}
+}
+
+func TestProvider_VolumeName(t *testing.T) {
+	p, dir := newProvider(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	if err := p.SetVolumeName(ctx, "vol/1", "name"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := p.GetVolumeName(ctx, "vol/1"); err != nil || name != "name" {
+		t.Fatalf("name=%q, err=%v", name, err)
+	}
+	if err := p.DeleteVolumeName(ctx, "vol/1"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := p.GetVolumeName(ctx, "vol/1"); err != nil || name != "" {
+		t.Fatalf("name=%q, err=%v", name, err)
+	}
+}
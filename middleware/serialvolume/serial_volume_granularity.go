@@ -0,0 +1,113 @@
+package serialvolume
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// LockGranularity is the resource on which an RPC is serialized.
+type LockGranularity int
+
+const (
+	// LockGranularityVolume serializes an RPC on its volume.
+	LockGranularityVolume LockGranularity = iota
+
+	// LockGranularityNode serializes an RPC on its volume and the ID of
+	// the node to which the RPC applies.
+	LockGranularityNode
+
+	// LockGranularityTargetPath serializes an RPC on its volume and the
+	// target path to which the RPC applies.
+	LockGranularityTargetPath
+)
+
+// String returns the name of the lock granularity.
+func (g LockGranularity) String() string {
+	switch g {
+	case LockGranularityVolume:
+		return "volume"
+	case LockGranularityNode:
+		return "node"
+	case LockGranularityTargetPath:
+		return "target"
+	}
+	return "unknown"
+}
+
+// ParseLockGranularity returns the lock granularity with the provided name.
+func ParseLockGranularity(s string) (LockGranularity, bool) {
+	switch s {
+	case "volume":
+		return LockGranularityVolume, true
+	case "node":
+		return LockGranularityNode, true
+	case "target":
+		return LockGranularityTargetPath, true
+	}
+	return 0, false
+}
+
+// defaultLockGranularities are the granularities of the RPCs that are not
+// serialized on only their volume by default.
+var defaultLockGranularities = map[string]LockGranularity{
+	"ControllerPublishVolume":   LockGranularityNode,
+	"ControllerUnpublishVolume": LockGranularityNode,
+	"NodePublishVolume":         LockGranularityTargetPath,
+	"NodeUnpublishVolume":       LockGranularityTargetPath,
+}
+
+// WithLockGranularity is an Option that sets the granularity of the locks
+// obtained for the RPC with the provided name, ex. ControllerPublishVolume.
+func WithLockGranularity(method string, g LockGranularity) Option {
+	return func(o *opts) {
+		if o.lockGranularities == nil {
+			o.lockGranularities = map[string]LockGranularity{}
+		}
+		o.lockGranularities[method] = g
+	}
+}
+
+func (i *interceptor) lockGranularity(method string) LockGranularity {
+	if g, ok := i.opts.lockGranularities[method]; ok {
+		return g
+	}
+	return defaultLockGranularities[method]
+}
+
+// resourceKey returns the key of the resource, finer-grained than the
+// volume, on which the request is serialized. An empty string is returned
+// if the request is serialized only on its volume, either because of the
+// granularity or because the request does not specify the resource, ex.
+// a ControllerUnpublishVolume request without a node ID.
+func resourceKey(req interface{}, g LockGranularity) string {
+	switch g {
+	case LockGranularityNode:
+		var nodeID string
+		switch treq := req.(type) {
+		case *csi.ControllerPublishVolumeRequest:
+			nodeID = treq.NodeId
+		case *csi.ControllerUnpublishVolumeRequest:
+			nodeID = treq.NodeId
+		}
+		if nodeID != "" {
+			return "node/" + nodeID
+		}
+	case LockGranularityTargetPath:
+		var targetPath string
+		switch treq := req.(type) {
+		case *csi.NodeStageVolumeRequest:
+			targetPath = treq.StagingTargetPath
+		case *csi.NodeUnstageVolumeRequest:
+			targetPath = treq.StagingTargetPath
+		case *csi.NodePublishVolumeRequest:
+			targetPath = treq.TargetPath
+		case *csi.NodeUnpublishVolumeRequest:
+			targetPath = treq.TargetPath
+		case *csi.NodeExpandVolumeRequest:
+			targetPath = treq.VolumePath
+		}
+		if targetPath != "" {
+			return "target/" + targetPath
+		}
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package serialvolume
+
+import (
+	"sync"
+	"time"
+)
+
+// histogramBuckets are the upper bounds of the buckets of a Histogram.
+// The last bucket of a Histogram, +Inf, is implicit.
+var histogramBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// Histogram records the distribution of durations. The zero value for a
+// Histogram is an empty histogram.
+type Histogram struct {
+	mu     sync.Mutex
+	counts [len(histogramBuckets) + 1]uint64
+	count  uint64
+	sum    time.Duration
+}
+
+// Observe records a duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBuckets) && d > histogramBuckets[i] {
+		i++
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// HistogramBucket is the number of recorded durations less than or equal
+// to the bucket's upper bound.
+type HistogramBucket struct {
+	// LE is the upper bound of the bucket, ex. "100ms", or "+Inf".
+	LE string `json:"le"`
+
+	// Count is the cumulative number of durations in the bucket.
+	Count uint64 `json:"count"`
+}
+
+// HistogramSnapshot is the state of a Histogram at a point in time.
+type HistogramSnapshot struct {
+	// Count is the number of recorded durations.
+	Count uint64 `json:"count"`
+
+	// Sum is the sum of the recorded durations.
+	Sum string `json:"sum"`
+
+	// Buckets are the histogram's buckets in increasing order.
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// Snapshot returns the state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{
+		Count:   h.count,
+		Sum:     h.sum.String(),
+		Buckets: make([]HistogramBucket, len(h.counts)),
+	}
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		s.Buckets[i].Count = n
+		if i < len(histogramBuckets) {
+			s.Buckets[i].LE = histogramBuckets[i].String()
+		} else {
+			s.Buckets[i].LE = "+Inf"
+		}
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+package serialvolume
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akutz/gosync"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csictx "github.com/rexray/gocsi/context"
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+// newLockHolder returns the holder recorded with the locks obtained for
+// the request.
+func newLockHolder(
+	ctx context.Context,
+	req interface{},
+	method string) mwtypes.LockHolder {
+
+	h := mwtypes.LockHolder{Method: method}
+	h.RequestID, _ = csictx.GetRequestIDString(ctx)
+	if treq, ok := req.(interface{ GetNodeId() string }); ok {
+		h.NodeID = treq.GetNodeId()
+	}
+	return h
+}
+
+// defaultRetryDelay is the minimum default retry delay.
+const defaultRetryDelay = time.Second
+
+func (i *interceptor) retryDelay() time.Duration {
+	if i.opts.retryDelay > 0 {
+		return i.opts.retryDelay
+	}
+	if i.opts.timeout > defaultRetryDelay {
+		return i.opts.timeout
+	}
+	return defaultRetryDelay
+}
+
+// pendingError returns the error for an operation that could not obtain
+// the lock for the resource. If the lock records its holders then the
+// error's message describes them, ex.
+//
+//	pending: VolumeID=vol-1: held by method=NodePublishVolume,
+//	requestID=42, acquired=2019-06-01T12:00:00Z
+//
+// The error's details include a google.rpc.RetryInfo with the suggested
+// retry delay and a google.rpc.ResourceInfo for each holder.
+func (i *interceptor) pendingError(
+	ctx context.Context,
+	lock gosync.TryLocker,
+	resource string) error {
+
+	var holders []mwtypes.LockHolder
+	if r, ok := lock.(mwtypes.LockHolderRecorder); ok {
+		var err error
+		if holders, err = r.GetLockHolders(ctx); err != nil {
+			log.WithError(err).WithField("resource", resource).
+				Debug("serialvolume: failed to get lock holders")
+		}
+	}
+
+	sort.Slice(holders, func(i, j int) bool {
+		return holders[i].Acquired.Before(holders[j].Acquired)
+	})
+
+	msg := pending
+	if len(holders) > 0 {
+		descs := make([]string, len(holders))
+		for j, h := range holders {
+			descs[j] = h.String()
+		}
+		msg = fmt.Sprintf("%s: %s: held by %s",
+			pending, resource, strings.Join(descs, "; "))
+	}
+
+	details := []proto.Message{
+		&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(i.retryDelay())},
+	}
+	for _, h := range holders {
+		details = append(details, &errdetails.ResourceInfo{
+			ResourceType: "serialvolume.lock",
+			ResourceName: resource,
+			Owner:        h.RequestID,
+			Description:  h.String(),
+		})
+	}
+
+	st := status.New(codes.Aborted, msg)
+	if std, err := st.WithDetails(details...); err == nil {
+		st = std
+	}
+	return st.Err()
+}
+
+// unavailableError returns the error for an operation that could not
+// obtain the lock for the resource because the lock provider failed, ex.
+// lost its connection to etcd. The error's details include a
+// google.rpc.RetryInfo with the suggested retry delay.
+func (i *interceptor) unavailableError(resource string, err error) error {
+	st := status.Newf(codes.Unavailable,
+		"lock provider failed: %s: %v", resource, err)
+	if std, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: ptypes.DurationProto(i.retryDelay()),
+	}); err == nil {
+		st = std
+	}
+	return st.Err()
+}
+
+// lostError returns the error for an operation whose lock for the resource
+// was lost while the operation was in progress, ex. because the lease of
+// the etcd session with which it was obtained expired. Another operation
+// may have obtained the lock in the meantime, so the operation is aborted.
+// The error's details include a google.rpc.RetryInfo with the suggested
+// retry delay.
+func (i *interceptor) lostError(resource string) error {
+	st := status.Newf(codes.Aborted, "%v: %s", mwtypes.ErrLockLost, resource)
+	if std, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: ptypes.DurationProto(i.retryDelay()),
+	}); err == nil {
+		st = std
+	}
+	return st.Err()
+}
@@ -0,0 +1,146 @@
+package serialvolume
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+// Inspector reports the volume locks that are held or waited for and
+// the durations for which the interceptor waited for and held locks. An
+// Inspector is associated with an interceptor by the WithInspector option.
+type Inspector struct {
+	// WaitDurations records how long the interceptor waited to obtain
+	// locks, including the waits that timed out.
+	WaitDurations Histogram
+
+	// HoldDurations records how long the interceptor held locks.
+	HoldDurations Histogram
+
+	locker mwtypes.VolumeLockerProvider
+}
+
+// WithInspector is an Option that associates an Inspector with the
+// interceptor.
+func WithInspector(i *Inspector) Option {
+	return func(o *opts) {
+		o.inspector = i
+	}
+}
+
+// GetLockTable gets the locks that are held or waited for. An error is
+// returned if the interceptor's lock provider does not implement the
+// types.LockTableReporter interface.
+func (i *Inspector) GetLockTable(
+	ctx context.Context) ([]mwtypes.LockInfo, error) {
+
+	r, ok := i.locker.(mwtypes.LockTableReporter)
+	if !ok {
+		return nil, errors.New("lock provider does not report lock table")
+	}
+	return r.GetLockTable(ctx)
+}
+
+type lockHolderReport struct {
+	mwtypes.LockHolder
+	Held string `json:"held,omitempty"`
+}
+
+type lockReport struct {
+	Key     string             `json:"key"`
+	Holders []lockHolderReport `json:"holders"`
+	Waiters int                `json:"waiters"`
+}
+
+type inspectorReport struct {
+	Locks         []lockReport      `json:"locks"`
+	LockTableErr  string            `json:"lockTableError,omitempty"`
+	WaitDurations HistogramSnapshot `json:"waitDurations"`
+	HoldDurations HistogramSnapshot `json:"holdDurations"`
+}
+
+func (i *Inspector) report(ctx context.Context) inspectorReport {
+	rep := inspectorReport{
+		Locks:         []lockReport{},
+		WaitDurations: i.WaitDurations.Snapshot(),
+		HoldDurations: i.HoldDurations.Snapshot(),
+	}
+	table, err := i.GetLockTable(ctx)
+	if err != nil {
+		rep.LockTableErr = err.Error()
+	}
+	now := time.Now()
+	for _, l := range table {
+		lr := lockReport{
+			Key:     l.Key,
+			Holders: make([]lockHolderReport, len(l.Holders)),
+			Waiters: l.Waiters,
+		}
+		for j, h := range l.Holders {
+			lr.Holders[j].LockHolder = h
+			if !h.Acquired.IsZero() {
+				lr.Holders[j].Held = now.Sub(h.Acquired).String()
+			}
+		}
+		rep.Locks = append(rep.Locks, lr)
+	}
+	return rep
+}
+
+// ServeHTTP writes the lock table and the wait and hold duration
+// histograms as JSON.
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(i.report(r.Context())); err != nil {
+		log.WithError(err).Debug("serialvolume: failed to write lock table")
+	}
+}
+
+// LogLockTable logs the lock table and the wait and hold duration
+// histograms.
+func (i *Inspector) LogLockTable(ctx context.Context) {
+	rep := i.report(ctx)
+	if rep.LockTableErr != "" {
+		log.WithField("error", rep.LockTableErr).Warn(
+			"serialvolume: failed to get lock table")
+	}
+	for _, l := range rep.Locks {
+		fields := log.Fields{
+			"key":     l.Key,
+			"holders": len(l.Holders),
+			"waiters": l.Waiters,
+		}
+		for _, h := range l.Holders {
+			hf := log.Fields{
+				"method":    h.Method,
+				"requestID": h.RequestID,
+				"nodeID":    h.NodeID,
+				"held":      h.Held,
+			}
+			log.WithFields(fields).WithFields(hf).Info("serialvolume: lock holder")
+		}
+		if len(l.Holders) == 0 {
+			log.WithFields(fields).Info("serialvolume: lock")
+		}
+	}
+	fields := log.Fields{"locks": len(rep.Locks)}
+	for name, h := range map[string]HistogramSnapshot{
+		"wait": rep.WaitDurations,
+		"hold": rep.HoldDurations,
+	} {
+		fields[name+".count"] = h.Count
+		fields[name+".sum"] = h.Sum
+		for _, b := range h.Buckets {
+			fields[name+".le."+b.LE] = b.Count
+		}
+	}
+	log.WithFields(fields).Info("serialvolume: lock table")
+}
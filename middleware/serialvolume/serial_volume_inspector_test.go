@@ -0,0 +1,193 @@
+package serialvolume
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+func TestHistogram_Buckets(t *testing.T) {
+	var h Histogram
+	for _, d := range []time.Duration{
+		0,
+		time.Millisecond,
+		2 * time.Millisecond,
+		time.Minute,
+		time.Hour,
+	} {
+		h.Observe(d)
+	}
+
+	s := h.Snapshot()
+	if s.Count != 5 {
+		t.Fatalf("count=%d, expected 5", s.Count)
+	}
+	sum := time.Hour + time.Minute + 3*time.Millisecond
+	if s.Sum != sum.String() {
+		t.Fatalf("sum=%s, expected %s", s.Sum, sum)
+	}
+
+	// Bucket counts are cumulative and a duration equal to a bucket's
+	// upper bound is in the bucket.
+	exp := []HistogramBucket{
+		{"1ms", 2},
+		{"5ms", 3},
+		{"10ms", 3},
+		{"50ms", 3},
+		{"100ms", 3},
+		{"500ms", 3},
+		{"1s", 3},
+		{"5s", 3},
+		{"10s", 3},
+		{"30s", 3},
+		{"1m0s", 4},
+		{"+Inf", 5},
+	}
+	if !reflect.DeepEqual(s.Buckets, exp) {
+		t.Fatalf("buckets=%v, expected %v", s.Buckets, exp)
+	}
+}
+
+// whileStaged invokes f while the interceptor's handler of a
+// NodeStageVolume request for vol-1 with the request ID 42 is running.
+func whileStaged(t *testing.T, i grpc.UnaryServerInterceptor, f func()) {
+	ctx := metadata.NewIncomingContext(
+		context.Background(), metadata.Pairs(csictx.RequestIDKey, "42"))
+	_, err := i(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/stage",
+	}, &grpc.UnaryServerInfo{
+		FullMethod: "/csi.v1.Node/NodeStageVolume",
+	}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		f()
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspector_ServeHTTP(t *testing.T) {
+	insp := &Inspector{}
+	i := New(WithInspector(insp))
+
+	serve := func() inspectorReport {
+		w := httptest.NewRecorder()
+		insp.ServeHTTP(w, httptest.NewRequest(
+			"GET", "/debug/serialvolume/locks", nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("content type=%q, expected application/json", ct)
+		}
+		var rep inspectorReport
+		if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+			t.Fatal(err)
+		}
+		if rep.LockTableErr != "" {
+			t.Fatalf("lock table err=%s", rep.LockTableErr)
+		}
+		return rep
+	}
+
+	whileStaged(t, i, func() {
+		rep := serve()
+		if len(rep.Locks) != 1 {
+			t.Fatalf("locks=%v, expected volumesByID/vol-1", rep.Locks)
+		}
+		l := rep.Locks[0]
+		if l.Key != "volumesByID/vol-1" || l.Waiters != 0 {
+			t.Fatalf("lock=%v, expected volumesByID/vol-1", l)
+		}
+		if len(l.Holders) != 1 {
+			t.Fatalf("holders=%v, expected NodeStageVolume", l.Holders)
+		}
+		h := l.Holders[0]
+		if h.Method != "NodeStageVolume" || h.RequestID != "42" ||
+			h.Acquired.IsZero() || h.Held == "" {
+			t.Fatalf("holder=%v, expected NodeStageVolume by 42", h)
+		}
+		if rep.WaitDurations.Count != 1 || rep.HoldDurations.Count != 0 {
+			t.Fatalf("wait count=%d, hold count=%d, expected 1, 0",
+				rep.WaitDurations.Count, rep.HoldDurations.Count)
+		}
+	})
+
+	rep := serve()
+	if rep.Locks == nil || len(rep.Locks) != 0 {
+		t.Fatalf("locks=%v, expected none", rep.Locks)
+	}
+	if rep.HoldDurations.Count != 1 {
+		t.Fatalf("hold count=%d, expected 1", rep.HoldDurations.Count)
+	}
+}
+
+func TestInspector_LockTableError(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Inspector{}).ServeHTTP(w, httptest.NewRequest(
+		"GET", "/debug/serialvolume/locks", nil))
+	var rep map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	exp := "lock provider does not report lock table"
+	if rep["lockTableError"] != exp {
+		t.Fatalf("report=%v, expected lockTableError %q", rep, exp)
+	}
+}
+
+func TestInspector_LogLockTable(t *testing.T) {
+	insp := &Inspector{}
+	i := New(WithInspector(insp))
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	whileStaged(t, i, func() {
+		insp.LogLockTable(context.Background())
+	})
+
+	var holder, table *log.Entry
+	for _, e := range hook.AllEntries() {
+		switch e.Message {
+		case "serialvolume: lock holder":
+			holder = e
+		case "serialvolume: lock table":
+			table = e
+		}
+	}
+	if holder == nil || table == nil {
+		t.Fatalf("entries=%v, expected lock holder and lock table",
+			hook.AllEntries())
+	}
+	for k, v := range map[string]interface{}{
+		"key":       "volumesByID/vol-1",
+		"method":    "NodeStageVolume",
+		"requestID": "42",
+		"waiters":   0,
+	} {
+		if holder.Data[k] != v {
+			t.Fatalf("holder %s=%v, expected %v", k, holder.Data[k], v)
+		}
+	}
+	for k, v := range map[string]interface{}{
+		"locks":        1,
+		"wait.count":   uint64(1),
+		"wait.le.+Inf": uint64(1),
+		"hold.count":   uint64(0),
+		"hold.le.+Inf": uint64(0),
+	} {
+		if table.Data[k] != v {
+			t.Fatalf("table %s=%v, expected %v", k, table.Data[k], v)
+		}
+	}
+}
@@ -7,12 +7,12 @@ import (
 
 	"github.com/akutz/gosync"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
 	xctx "golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 
 	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+	"github.com/rexray/gocsi/utils"
 )
 
 const pending = "pending"
@@ -21,8 +21,28 @@ const pending = "pending"
 type Option func(*opts)
 
 type opts struct {
-	timeout time.Duration
-	locker  mwtypes.VolumeLockerProvider
+	timeout           time.Duration
+	locker            mwtypes.VolumeLockerProvider
+	skipNodeStage     bool
+	skipNodeUnstage   bool
+	skipCtlrExpandVol bool
+	skipNodeExpandVol bool
+	skipCreateSnap    bool
+	lockModes         map[string]mwtypes.LockMode
+	lockGranularities map[string]LockGranularity
+	retryDelay        time.Duration
+	inspector         *Inspector
+}
+
+// defaultLockModes are the modes in which the volume locks are obtained
+// for the RPCs that do not use exclusive locks by default. Publishing a
+// volume to, or unpublishing a volume from, a node or target path does not
+// conflict with doing the same for a different node or target path.
+var defaultLockModes = map[string]mwtypes.LockMode{
+	"ControllerPublishVolume":   mwtypes.LockModeShared,
+	"ControllerUnpublishVolume": mwtypes.LockModeShared,
+	"NodePublishVolume":         mwtypes.LockModeShared,
+	"NodeUnpublishVolume":       mwtypes.LockModeShared,
 }
 
 // WithTimeout is an Option that sets the timeout used by the interceptor.
@@ -40,6 +60,69 @@ func WithLockProvider(p mwtypes.VolumeLockerProvider) Option {
 	}
 }
 
+// WithRetryDelay is an Option that sets the retry delay suggested to
+// clients by the errors returned for operations that could not obtain a
+// lock because another operation is pending. The default is the timeout
+// or one second, whichever is greater.
+func WithRetryDelay(d time.Duration) Option {
+	return func(o *opts) {
+		o.retryDelay = d
+	}
+}
+
+// WithSkipNodeStageVolume is an Option that disables serial access
+// for the NodeStageVolume RPC.
+func WithSkipNodeStageVolume() Option {
+	return func(o *opts) {
+		o.skipNodeStage = true
+	}
+}
+
+// WithSkipNodeUnstageVolume is an Option that disables serial access
+// for the NodeUnstageVolume RPC.
+func WithSkipNodeUnstageVolume() Option {
+	return func(o *opts) {
+		o.skipNodeUnstage = true
+	}
+}
+
+// WithSkipControllerExpandVolume is an Option that disables serial access
+// for the ControllerExpandVolume RPC.
+func WithSkipControllerExpandVolume() Option {
+	return func(o *opts) {
+		o.skipCtlrExpandVol = true
+	}
+}
+
+// WithSkipNodeExpandVolume is an Option that disables serial access
+// for the NodeExpandVolume RPC.
+func WithSkipNodeExpandVolume() Option {
+	return func(o *opts) {
+		o.skipNodeExpandVol = true
+	}
+}
+
+// WithSkipCreateSnapshot is an Option that disables serial access
+// for the CreateSnapshot RPC.
+func WithSkipCreateSnapshot() Option {
+	return func(o *opts) {
+		o.skipCreateSnap = true
+	}
+}
+
+// WithLockMode is an Option that sets the mode in which the volume locks
+// are obtained for the RPC with the provided name, ex. NodePublishVolume.
+// Shared locks are obtained in exclusive mode if the lock provider's locks
+// do not implement types.TryRWLocker.
+func WithLockMode(method string, mode mwtypes.LockMode) Option {
+	return func(o *opts) {
+		if o.lockModes == nil {
+			o.lockModes = map[string]mwtypes.LockMode{}
+		}
+		o.lockModes[method] = mode
+	}
+}
+
 // New returns a new server-side, gRPC interceptor
 // that provides serial access to volume resources across the following
 // RPCs:
@@ -48,8 +131,38 @@ func WithLockProvider(p mwtypes.VolumeLockerProvider) Option {
 //  * DeleteVolume
 //  * ControllerPublishVolume
 //  * ControllerUnpublishVolume
+//  * NodeStageVolume
+//  * NodeUnstageVolume
 //  * NodePublishVolume
 //  * NodeUnpublishVolume
+//  * ControllerExpandVolume
+//  * NodeExpandVolume
+//  * CreateSnapshot
+//
+// CreateVolume is serialized on the name of the volume. The name of a
+// created volume is recorded with the lock provider, and all of the other
+// RPCs are serialized on both the name and the ID of the volume to which
+// they apply. CreateSnapshot is serialized on the snapshot's source
+// volume. An operation on a volume whose name is not recorded, ex. a
+// volume created before the SP was restarted with an in-memory lock
+// provider, is serialized only on the volume's ID.
+//
+// Locks are obtained in exclusive mode except for the publish and
+// unpublish RPCs, which obtain them in shared mode. The mode for each RPC
+// may be set with the WithLockMode option.
+//
+// The controller publish and unpublish RPCs are also serialized on the
+// node ID, and the node publish and unpublish RPCs on the target path. The
+// granularity for each RPC may be set with the WithLockGranularity option.
+// An RPC serialized on a node ID or target path obtains an exclusive lock
+// for the node ID or target path after obtaining the volume locks, so
+// RPCs that obtain exclusive volume locks, ex. DeleteVolume, exclude all
+// of the RPCs serialized on the volume's nodes and target paths. A
+// publish or unpublish RPC serialized on only its volume obtains its
+// volume locks in exclusive mode unless its mode is set with WithLockMode.
+//
+// The stage, expansion, and snapshot RPCs may be excluded with the
+// eponymous WithSkip options.
 func New(opts ...Option) grpc.UnaryServerInterceptor {
 
 	i := &interceptor{}
@@ -62,10 +175,11 @@ func New(opts ...Option) grpc.UnaryServerInterceptor {
 	// If no lock provider is configured then set the default,
 	// in-memory provider.
 	if i.opts.locker == nil {
-		i.opts.locker = &defaultLockProvider{
-			volIDLocks:   map[string]gosync.TryLocker{},
-			volNameLocks: map[string]gosync.TryLocker{},
-		}
+		i.opts.locker = newDefaultLockProvider()
+	}
+
+	if i.opts.inspector != nil {
+		i.opts.inspector.locker = i.opts.locker
 	}
 
 	return i.handle
@@ -90,76 +204,349 @@ func (i *interceptor) handle(
 		return i.createVolume(ctx, treq, info, handler)
 	case *csi.DeleteVolumeRequest:
 		return i.deleteVolume(ctx, treq, info, handler)
+	case *csi.NodeStageVolumeRequest:
+		if !i.opts.skipNodeStage {
+			return i.nodeStageVolume(ctx, treq, info, handler)
+		}
+	case *csi.NodeUnstageVolumeRequest:
+		if !i.opts.skipNodeUnstage {
+			return i.nodeUnstageVolume(ctx, treq, info, handler)
+		}
 	case *csi.NodePublishVolumeRequest:
 		return i.nodePublishVolume(ctx, treq, info, handler)
 	case *csi.NodeUnpublishVolumeRequest:
 		return i.nodeUnpublishVolume(ctx, treq, info, handler)
+	case *csi.ControllerExpandVolumeRequest:
+		if !i.opts.skipCtlrExpandVol {
+			return i.controllerExpandVolume(ctx, treq, info, handler)
+		}
+	case *csi.NodeExpandVolumeRequest:
+		if !i.opts.skipNodeExpandVol {
+			return i.nodeExpandVolume(ctx, treq, info, handler)
+		}
+	case *csi.CreateSnapshotRequest:
+		if !i.opts.skipCreateSnap {
+			return i.createSnapshot(ctx, treq, info, handler)
+		}
 	}
 
 	return handler(ctx, req)
 }
 
-func (i *interceptor) controllerPublishVolume(
+// unlockTimeout bounds the time taken to unlock a lock once the RPC is
+// complete. The RPC's context is not used as it may already be done.
+const unlockTimeout = 10 * time.Second
+
+// tryLock obtains the lock and records the holder with the lock. If the
+// lock cannot be obtained before the timeout expires then the lock is
+// closed and an error with a code of Aborted is returned to indicate an
+// operation is pending. If the lock provider failed then an error with a
+// code of Unavailable is returned. Otherwise a context that is canceled if
+// the lock is lost and a function that unlocks and closes the lock are
+// returned. The function returns an error with a code of Aborted if the
+// lock was lost while it was held, or Unavailable if the lock provider
+// failed to unlock the lock. The resource argument describes the locked
+// resource in the error, ex. "VolumeID=vol-1".
+func (i *interceptor) tryLock(
 	ctx context.Context,
-	req *csi.ControllerPublishVolumeRequest,
-	info *grpc.UnaryServerInfo,
-	handler grpc.UnaryHandler) (res interface{}, resErr error) {
-
-	lock, err := i.opts.locker.GetLockWithID(ctx, req.VolumeId)
+	lock gosync.TryLocker,
+	mode mwtypes.LockMode,
+	holder mwtypes.LockHolder,
+	resource string) (context.Context, func() error, error) {
+
+	var (
+		unlock func(context.Context) error
+		locked bool
+		err    error
+		start  = time.Now()
+	)
+	if cLock, ok := lock.(mwtypes.ContextLocker); ok {
+		locked, err = cLock.TryLockContext(ctx, mode, i.opts.timeout)
+		unlock = cLock.UnlockContext
+	} else if rwLock, ok := lock.(mwtypes.TryRWLocker); ok &&
+		mode == mwtypes.LockModeShared {
+
+		locked = rwLock.TryRLock(i.opts.timeout)
+		unlock = func(context.Context) error {
+			rwLock.RUnlock()
+			return nil
+		}
+	} else {
+		locked = lock.TryLock(i.opts.timeout)
+		unlock = func(context.Context) error {
+			lock.Unlock()
+			return nil
+		}
+	}
+	acquired := time.Now()
+	if insp := i.opts.inspector; insp != nil {
+		insp.WaitDurations.Observe(acquired.Sub(start))
+	}
 	if err != nil {
-		return nil, err
+		closeLock(lock)
+		return nil, nil, i.unavailableError(resource, err)
+	}
+	if !locked {
+		err := i.pendingError(ctx, lock, resource)
+		closeLock(lock)
+		return nil, nil, err
+	}
+
+	if r, ok := lock.(mwtypes.LockHolderRecorder); ok {
+		holder.Acquired = acquired
+		if err := r.SetLockHolder(ctx, holder); err != nil {
+			log.WithError(err).WithField("resource", resource).
+				Debug("serialvolume: failed to record lock holder")
+		}
 	}
+
+	// Cancel the operation if the lock is lost, since another operation
+	// may obtain the lock while this one is in progress.
+	cancelCtx := func() {}
+	if l, ok := lock.(mwtypes.LostLocker); ok {
+		if lost := l.Lost(); lost != nil {
+			ctx, cancelCtx = context.WithCancel(ctx)
+			go func(ctx context.Context, cancel context.CancelFunc) {
+				select {
+				case <-lost:
+					log.WithField("resource", resource).
+						Error("serialvolume: lock lost")
+					cancel()
+				case <-ctx.Done():
+				}
+			}(ctx, cancelCtx)
+		}
+	}
+
+	return ctx, func() error {
+		cancelCtx()
+		ctx, cancel := context.WithTimeout(
+			context.Background(), unlockTimeout)
+		defer cancel()
+		err := unlock(ctx)
+		closeLock(lock)
+		if insp := i.opts.inspector; insp != nil {
+			insp.HoldDurations.Observe(time.Since(acquired))
+		}
+		if err == nil {
+			return nil
+		}
+		log.WithError(err).WithField("resource", resource).
+			Error("serialvolume: failed to unlock")
+		if err == mwtypes.ErrLockLost {
+			return i.lostError(resource)
+		}
+		return i.unavailableError(resource, err)
+	}, nil
+}
+
+// release unlocks the locks held for an RPC with the provided unlock
+// function. If the locks were lost or could not be unlocked then the RPC's
+// result is replaced with the unlock error, since the RPC may not have
+// been serialized with the other operations on the volume.
+func release(unlock func() error, res *interface{}, resErr *error) {
+	if err := unlock(); err != nil {
+		*res, *resErr = nil, err
+	}
+}
+
+func closeLock(lock gosync.TryLocker) {
 	if closer, ok := lock.(io.Closer); ok {
-		defer closer.Close()
+		closer.Close()
 	}
-	if !lock.TryLock(i.opts.timeout) {
-		return nil, status.Error(codes.Aborted, pending)
+}
+
+// lockMode returns the mode in which the volume locks are obtained for
+// the RPC.
+func (i *interceptor) lockMode(method string) mwtypes.LockMode {
+	if mode, ok := i.opts.lockModes[method]; ok {
+		return mode
 	}
-	defer lock.Unlock()
+	return defaultLockModes[method]
+}
 
-	return handler(ctx, req)
+// methodName returns the name of the RPC, ex. NodePublishVolume.
+func methodName(info *grpc.UnaryServerInfo) string {
+	if info == nil {
+		return ""
+	}
+	_, _, method, _ := utils.ParseMethod(info.FullMethod)
+	return method
 }
 
-func (i *interceptor) controllerUnpublishVolume(
+// tryLockName obtains the lock for the volume with the provided name.
+func (i *interceptor) tryLockName(
 	ctx context.Context,
-	req *csi.ControllerUnpublishVolumeRequest,
+	name string,
+	mode mwtypes.LockMode,
+	holder mwtypes.LockHolder) (context.Context, func() error, error) {
+
+	resource := "VolumeName=" + name
+	lock, err := i.opts.locker.GetLockWithName(ctx, name)
+	if err != nil {
+		return nil, nil, i.unavailableError(resource, err)
+	}
+	return i.tryLock(ctx, lock, mode, holder, resource)
+}
+
+// tryLockID obtains the lock for the volume with the provided ID. If the
+// name of the volume is known then the volume's name lock is obtained
+// first. Locks are always obtained in the order name, then ID, so that
+// operations that lock a volume by its name, ex. CreateVolume, and
+// operations that lock a volume by its ID cannot deadlock.
+func (i *interceptor) tryLockID(
+	ctx context.Context,
+	id string,
+	mode mwtypes.LockMode,
+	holder mwtypes.LockHolder) (context.Context, func() error, error) {
+
+	resource := "VolumeID=" + id
+	name, err := i.opts.locker.GetVolumeName(ctx, id)
+	if err != nil {
+		return nil, nil, i.unavailableError(resource, err)
+	}
+
+	var unlockName func() error
+	if name != "" {
+		ctx, unlockName, err = i.tryLockName(ctx, name, mode, holder)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lock, err := i.opts.locker.GetLockWithID(ctx, id)
+	if err != nil {
+		if unlockName != nil {
+			unlockName()
+		}
+		return nil, nil, i.unavailableError(resource, err)
+	}
+	ctx, unlockID, err := i.tryLock(ctx, lock, mode, holder, resource)
+	if err != nil {
+		if unlockName != nil {
+			unlockName()
+		}
+		return nil, nil, err
+	}
+
+	if unlockName == nil {
+		return ctx, unlockID, nil
+	}
+	return ctx, func() error {
+		err := unlockID()
+		if nerr := unlockName(); err == nil {
+			err = nerr
+		}
+		return err
+	}, nil
+}
+
+// handleWithIDLock invokes the handler while holding the locks for the
+// volume with the provided ID and, depending on the RPC's granularity,
+// the lock for the node ID or target path to which the request applies.
+func (i *interceptor) handleWithIDLock(
+	ctx context.Context,
+	id string,
+	req interface{},
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (res interface{}, resErr error) {
 
-	lock, err := i.opts.locker.GetLockWithID(ctx, req.VolumeId)
+	var (
+		method = methodName(info)
+		mode   = i.lockMode(method)
+		g      = i.lockGranularity(method)
+		key    = resourceKey(req, g)
+		holder = newLockHolder(ctx, req, method)
+	)
+
+	// A request that applies to all of the volume's nodes or target
+	// paths, ex. ControllerUnpublishVolume without a node ID, must
+	// exclude the requests serialized on a single node or target path.
+	if g != LockGranularityVolume && key == "" {
+		mode = mwtypes.LockModeExclusive
+	}
+
+	// A request serialized on only its volume is not serialized at all
+	// with a shared lock, so the default shared mode does not apply.
+	if _, ok := i.opts.lockModes[method]; !ok && g == LockGranularityVolume {
+		mode = mwtypes.LockModeExclusive
+	}
+
+	ctx, unlock, err := i.tryLockID(ctx, id, mode, holder)
 	if err != nil {
 		return nil, err
 	}
-	if closer, ok := lock.(io.Closer); ok {
-		defer closer.Close()
-	}
-	if !lock.TryLock(i.opts.timeout) {
-		return nil, status.Error(codes.Aborted, pending)
+	defer release(unlock, &res, &resErr)
+
+	if key != "" {
+		resource := "VolumeID=" + id + ", " + key
+		lock, err := i.opts.locker.GetResourceLockWithID(ctx, id, key)
+		if err != nil {
+			return nil, i.unavailableError(resource, err)
+		}
+		var unlockKey func() error
+		ctx, unlockKey, err = i.tryLock(ctx, lock,
+			mwtypes.LockModeExclusive, holder, resource)
+		if err != nil {
+			return nil, err
+		}
+		defer release(unlockKey, &res, &resErr)
 	}
-	defer lock.Unlock()
 
 	return handler(ctx, req)
 }
 
+func (i *interceptor) controllerPublishVolume(
+	ctx context.Context,
+	req *csi.ControllerPublishVolumeRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
+}
+
+func (i *interceptor) controllerUnpublishVolume(
+	ctx context.Context,
+	req *csi.ControllerUnpublishVolumeRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
+}
+
 func (i *interceptor) createVolume(
 	ctx context.Context,
 	req *csi.CreateVolumeRequest,
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (res interface{}, resErr error) {
 
-	lock, err := i.opts.locker.GetLockWithName(ctx, req.Name)
+	method := methodName(info)
+	ctx, unlock, err := i.tryLockName(ctx, req.Name,
+		i.lockMode(method), newLockHolder(ctx, req, method))
 	if err != nil {
 		return nil, err
 	}
-	if closer, ok := lock.(io.Closer); ok {
-		defer closer.Close()
-	}
-	if !lock.TryLock(i.opts.timeout) {
-		return nil, status.Error(codes.Aborted, pending)
+	defer release(unlock, &res, &resErr)
+
+	res, resErr = handler(ctx, req)
+	if resErr != nil {
+		return
 	}
-	defer lock.Unlock()
 
-	return handler(ctx, req)
+	// Record the name of the created volume while its name lock is held
+	// so that later operations on the volume by its ID obtain the name
+	// lock as well.
+	if rep, ok := res.(*csi.CreateVolumeResponse); ok &&
+		rep.Volume != nil && rep.Volume.VolumeId != "" {
+
+		if err := i.opts.locker.SetVolumeName(
+			ctx, rep.Volume.VolumeId, req.Name); err != nil {
+
+			log.WithError(err).WithField("volumeID", rep.Volume.VolumeId).
+				Warn("serialvolume: failed to record volume name")
+		}
+	}
+	return
 }
 
 func (i *interceptor) deleteVolume(
@@ -168,19 +555,44 @@ func (i *interceptor) deleteVolume(
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (res interface{}, resErr error) {
 
-	lock, err := i.opts.locker.GetLockWithID(ctx, req.VolumeId)
+	method := methodName(info)
+	ctx, unlock, err := i.tryLockID(ctx, req.VolumeId,
+		i.lockMode(method), newLockHolder(ctx, req, method))
 	if err != nil {
 		return nil, err
 	}
-	if closer, ok := lock.(io.Closer); ok {
-		defer closer.Close()
+	defer release(unlock, &res, &resErr)
+
+	res, resErr = handler(ctx, req)
+	if resErr != nil {
+		return
 	}
-	if !lock.TryLock(i.opts.timeout) {
-		return nil, status.Error(codes.Aborted, pending)
+
+	if err := i.opts.locker.DeleteVolumeName(
+		ctx, req.VolumeId); err != nil {
+
+		log.WithError(err).WithField("volumeID", req.VolumeId).
+			Warn("serialvolume: failed to delete volume name")
 	}
-	defer lock.Unlock()
+	return
+}
 
-	return handler(ctx, req)
+func (i *interceptor) nodeStageVolume(
+	ctx context.Context,
+	req *csi.NodeStageVolumeRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
+}
+
+func (i *interceptor) nodeUnstageVolume(
+	ctx context.Context,
+	req *csi.NodeUnstageVolumeRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
 }
 
 func (i *interceptor) nodePublishVolume(
@@ -189,19 +601,7 @@ func (i *interceptor) nodePublishVolume(
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (res interface{}, resErr error) {
 
-	lock, err := i.opts.locker.GetLockWithID(ctx, req.VolumeId)
-	if err != nil {
-		return nil, err
-	}
-	if closer, ok := lock.(io.Closer); ok {
-		defer closer.Close()
-	}
-	if !lock.TryLock(i.opts.timeout) {
-		return nil, status.Error(codes.Aborted, pending)
-	}
-	defer lock.Unlock()
-
-	return handler(ctx, req)
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
 }
 
 func (i *interceptor) nodeUnpublishVolume(
@@ -210,17 +610,32 @@ func (i *interceptor) nodeUnpublishVolume(
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (res interface{}, resErr error) {
 
-	lock, err := i.opts.locker.GetLockWithID(ctx, req.VolumeId)
-	if err != nil {
-		return nil, err
-	}
-	if closer, ok := lock.(io.Closer); ok {
-		defer closer.Close()
-	}
-	if !lock.TryLock(i.opts.timeout) {
-		return nil, status.Error(codes.Aborted, pending)
-	}
-	defer lock.Unlock()
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
+}
 
-	return handler(ctx, req)
+func (i *interceptor) controllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
+}
+
+func (i *interceptor) nodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.VolumeId, req, info, handler)
+}
+
+func (i *interceptor) createSnapshot(
+	ctx context.Context,
+	req *csi.CreateSnapshotRequest,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (res interface{}, resErr error) {
+
+	return i.handleWithIDLock(ctx, req.SourceVolumeId, req, info, handler)
 }
@@ -0,0 +1,523 @@
+package serialvolume
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/akutz/gosync"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	csictx "github.com/rexray/gocsi/context"
+	mwtypes "github.com/rexray/gocsi/middleware/serialvolume/types"
+)
+
+// lostLockProvider is the default lock provider, except its volume ID
+// locks are lost when lost is closed.
+type lostLockProvider struct {
+	*defaultLockProvider
+	lost chan struct{}
+}
+
+func (p *lostLockProvider) GetLockWithID(
+	ctx context.Context, id string) (gosync.TryLocker, error) {
+
+	lock, err := p.defaultLockProvider.GetLockWithID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &lostLock{lockRef: lock.(*lockRef), lost: p.lost}, nil
+}
+
+// failingLockProvider is the default lock provider, except it fails to
+// get volume ID locks.
+type failingLockProvider struct {
+	*defaultLockProvider
+}
+
+func (p *failingLockProvider) GetLockWithID(
+	ctx context.Context, id string) (gosync.TryLocker, error) {
+
+	return nil, errors.New("connection refused")
+}
+
+type lostLock struct {
+	*lockRef
+	lost chan struct{}
+}
+
+func (l *lostLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *lostLock) UnlockContext(ctx context.Context) error {
+	l.lockRef.UnlockContext(ctx)
+	select {
+	case <-l.lost:
+		return mwtypes.ErrLockLost
+	default:
+		return nil
+	}
+}
+
+// rpc is a request and the full name of its method. The request is sent
+// with the context if it is not nil.
+type rpc struct {
+	ctx    context.Context
+	method string
+	req    interface{}
+}
+
+func (r rpc) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// invokeWhileHeld invokes the interceptor with the second RPC while the
+// handler of the first RPC is running and returns the second RPC's error.
+func invokeWhileHeld(
+	t *testing.T,
+	i grpc.UnaryServerInterceptor,
+	first, second rpc) error {
+
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		done    = make(chan error)
+	)
+	go func() {
+		_, err := i(first.context(), first.req,
+			&grpc.UnaryServerInfo{FullMethod: first.method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				close(entered)
+				<-release
+				return nil, nil
+			})
+		done <- err
+	}()
+	<-entered
+
+	_, err := i(second.context(), second.req,
+		&grpc.UnaryServerInfo{FullMethod: second.method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+	return err
+}
+
+func TestInterceptor_Serialized(t *testing.T) {
+	var (
+		nodeStage = rpc{
+			method: "/csi.v1.Node/NodeStageVolume",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: "/stage",
+			},
+		}
+		nodeUnstage = rpc{
+			method: "/csi.v1.Node/NodeUnstageVolume",
+			req: &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: "/stage",
+			},
+		}
+		nodePublish = rpc{
+			method: "/csi.v1.Node/NodePublishVolume",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:   "vol-1",
+				TargetPath: "/mnt",
+			},
+		}
+		ctlrExpand = rpc{
+			method: "/csi.v1.Controller/ControllerExpandVolume",
+			req:    &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1"},
+		}
+		nodeExpand = rpc{
+			method: "/csi.v1.Node/NodeExpandVolume",
+			req: &csi.NodeExpandVolumeRequest{
+				VolumeId:   "vol-1",
+				VolumePath: "/mnt",
+			},
+		}
+		createSnap = rpc{
+			method: "/csi.v1.Controller/CreateSnapshot",
+			req: &csi.CreateSnapshotRequest{
+				SourceVolumeId: "vol-1",
+				Name:           "snap-1",
+			},
+		}
+	)
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		first    rpc
+		second   rpc
+		excludes bool
+	}{
+		{
+			name:     "stage and stage",
+			first:    nodeStage,
+			second:   nodeStage,
+			excludes: true,
+		},
+		{
+			name:     "stage and unstage",
+			first:    nodeStage,
+			second:   nodeUnstage,
+			excludes: true,
+		},
+		{
+			name:     "stage and publish",
+			first:    nodeStage,
+			second:   nodePublish,
+			excludes: true,
+		},
+		{
+			name:     "controller and node expand",
+			first:    ctlrExpand,
+			second:   nodeExpand,
+			excludes: true,
+		},
+		{
+			name:     "snapshot and expand",
+			first:    createSnap,
+			second:   ctlrExpand,
+			excludes: true,
+		},
+		{
+			name:   "skip stage",
+			opts:   []Option{WithSkipNodeStageVolume()},
+			first:  nodeStage,
+			second: nodeStage,
+		},
+		{
+			name:   "skip unstage",
+			opts:   []Option{WithSkipNodeUnstageVolume()},
+			first:  nodeStage,
+			second: nodeUnstage,
+		},
+		{
+			name:   "skip controller expand",
+			opts:   []Option{WithSkipControllerExpandVolume()},
+			first:  ctlrExpand,
+			second: nodeExpand,
+		},
+		{
+			name:   "skip node expand",
+			opts:   []Option{WithSkipNodeExpandVolume()},
+			first:  ctlrExpand,
+			second: nodeExpand,
+		},
+		{
+			name:   "skip snapshot",
+			opts:   []Option{WithSkipCreateSnapshot()},
+			first:  createSnap,
+			second: createSnap,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := invokeWhileHeld(t, New(tt.opts...), tt.first, tt.second)
+			if !tt.excludes {
+				if err != nil {
+					t.Fatalf("second request failed: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.Aborted {
+				t.Fatalf("err=%v, expected code Aborted", err)
+			}
+		})
+	}
+}
+
+func TestInterceptor_NodePublishGranularity(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		excludes bool
+	}{
+		{
+			name: "target",
+		},
+		{
+			name: "volume",
+			opts: []Option{WithLockGranularity(
+				"NodePublishVolume", LockGranularityVolume)},
+			excludes: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				i    = New(tt.opts...)
+				info = &grpc.UnaryServerInfo{
+					FullMethod: "/csi.v1.Node/NodePublishVolume",
+				}
+				entered = make(chan struct{})
+				release = make(chan struct{})
+				done    = make(chan error)
+			)
+			publish := func(target string, handler grpc.UnaryHandler) error {
+				_, err := i(context.Background(), &csi.NodePublishVolumeRequest{
+					VolumeId:   "vol-1",
+					TargetPath: target,
+				}, info, handler)
+				return err
+			}
+
+			// The first request holds its locks until it is released.
+			go func() {
+				done <- publish("/mnt/a", func(
+					ctx context.Context, req interface{}) (interface{}, error) {
+					close(entered)
+					<-release
+					return &csi.NodePublishVolumeResponse{}, nil
+				})
+			}()
+			<-entered
+
+			err := publish("/mnt/b", func(
+				ctx context.Context, req interface{}) (interface{}, error) {
+				return &csi.NodePublishVolumeResponse{}, nil
+			})
+			close(release)
+			if err := <-done; err != nil {
+				t.Fatalf("first request failed: %v", err)
+			}
+
+			if !tt.excludes {
+				if err != nil {
+					t.Fatalf("second request failed: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.Aborted {
+				t.Fatalf("err=%v, expected code Aborted", err)
+			}
+		})
+	}
+}
+
+func TestInterceptor_LockLost(t *testing.T) {
+	p := &lostLockProvider{
+		defaultLockProvider: newDefaultLockProvider(),
+		lost:                make(chan struct{}),
+	}
+	i := New(WithLockProvider(p))
+
+	// The handler runs until its context is canceled and succeeds anyway.
+	entered := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := i(context.Background(), &csi.DeleteVolumeRequest{
+			VolumeId: "vol-1",
+		}, &grpc.UnaryServerInfo{
+			FullMethod: "/csi.v1.Controller/DeleteVolume",
+		}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(entered)
+			<-ctx.Done()
+			return &csi.DeleteVolumeResponse{}, nil
+		})
+		done <- err
+	}()
+	<-entered
+	close(p.lost)
+
+	err := <-done
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("err=%v, expected code Aborted", err)
+	}
+	exp := "lock lost: VolumeID=vol-1"
+	if msg := status.Convert(err).Message(); msg != exp {
+		t.Fatalf("msg=%q, expected %q", msg, exp)
+	}
+	if d := retryDelay(t, err); d != defaultRetryDelay {
+		t.Fatalf("retry delay=%s, expected %s", d, defaultRetryDelay)
+	}
+}
+
+func TestInterceptor_VolumeName(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newDefaultLockProvider()
+		i   = New(WithLockProvider(p))
+
+		createVol = rpc{
+			method: "/csi.v1.Controller/CreateVolume",
+			req:    &csi.CreateVolumeRequest{Name: "v"},
+		}
+		deleteVol = rpc{
+			method: "/csi.v1.Controller/DeleteVolume",
+			req:    &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+		}
+	)
+	invoke := func(r rpc, rep interface{}, err error) error {
+		_, err = i(ctx, r.req, &grpc.UnaryServerInfo{FullMethod: r.method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return rep, err
+			})
+		return err
+	}
+	volumeName := func() string {
+		name, err := p.GetVolumeName(ctx, "vol-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	created := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{VolumeId: "vol-1"},
+	}
+
+	// A failed CreateVolume does not record the volume's name.
+	failed := status.Error(codes.ResourceExhausted, "out of space")
+	if err := invoke(createVol, created, failed); err != failed {
+		t.Fatalf("err=%v, expected %v", err, failed)
+	}
+	if name := volumeName(); name != "" {
+		t.Fatalf("name=%q after failed create, expected none", name)
+	}
+
+	if err := invoke(createVol, created, nil); err != nil {
+		t.Fatal(err)
+	}
+	if name := volumeName(); name != "v" {
+		t.Fatalf("name=%q, expected v", name)
+	}
+
+	// A retried CreateVolume and a DeleteVolume of the created volume
+	// exclude each other since both obtain the volume's name lock.
+	err := invokeWhileHeld(t, i, createVol, deleteVol)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("delete err=%v, expected code Aborted", err)
+	}
+	err = invokeWhileHeld(t, i, deleteVol, createVol)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("create err=%v, expected code Aborted", err)
+	}
+
+	// Deleting the volume deletes its name.
+	if err := invoke(deleteVol, &csi.DeleteVolumeResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if name := volumeName(); name != "" {
+		t.Fatalf("name=%q after delete, expected none", name)
+	}
+	if err := invokeWhileHeld(t, i, createVol, deleteVol); err != nil {
+		t.Fatalf("delete err=%v after name deleted", err)
+	}
+}
+
+// retryDelay returns the delay of the RetryInfo that is the first detail
+// of the error.
+func retryDelay(t *testing.T, err error) time.Duration {
+	details := status.Convert(err).Details()
+	if len(details) == 0 {
+		t.Fatalf("err=%v, expected details", err)
+	}
+	ri, ok := details[0].(*errdetails.RetryInfo)
+	if !ok {
+		t.Fatalf("details[0]=%T, expected RetryInfo", details[0])
+	}
+	d, err := ptypes.Duration(ri.RetryDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestInterceptor_PendingError(t *testing.T) {
+	i := New(WithRetryDelay(5 * time.Second))
+	ctx := metadata.NewIncomingContext(
+		context.Background(), metadata.Pairs(csictx.RequestIDKey, "42"))
+	stage := rpc{
+		ctx:    ctx,
+		method: "/csi.v1.Node/NodeStageVolume",
+		req: &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-1",
+			StagingTargetPath: "/stage",
+		},
+	}
+	start := time.Now().Truncate(time.Second)
+	err := invokeWhileHeld(t, i, stage, stage)
+
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("err=%v, expected code Aborted", err)
+	}
+	holderRX := regexp.MustCompile(
+		`^method=NodeStageVolume, requestID=42, acquired=(\S+)$`)
+	msg := status.Convert(err).Message()
+	const pfx = "pending: VolumeID=vol-1: held by "
+	if len(msg) < len(pfx) || msg[:len(pfx)] != pfx {
+		t.Fatalf("msg=%q, expected prefix %q", msg, pfx)
+	}
+	holder := msg[len(pfx):]
+	m := holderRX.FindStringSubmatch(holder)
+	if m == nil {
+		t.Fatalf("holder=%q, expected %s", holder, holderRX)
+	}
+	acquired, err2 := time.Parse(time.RFC3339, m[1])
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if acquired.Before(start) || acquired.After(time.Now()) {
+		t.Fatalf("acquired=%s, expected now", acquired)
+	}
+
+	if d := retryDelay(t, err); d != 5*time.Second {
+		t.Fatalf("retry delay=%s, expected 5s", d)
+	}
+	details := status.Convert(err).Details()
+	if len(details) != 2 {
+		t.Fatalf("details=%v, expected RetryInfo and ResourceInfo", details)
+	}
+	ri, ok := details[1].(*errdetails.ResourceInfo)
+	if !ok {
+		t.Fatalf("details[1]=%T, expected ResourceInfo", details[1])
+	}
+	if ri.ResourceType != "serialvolume.lock" ||
+		ri.ResourceName != "VolumeID=vol-1" ||
+		ri.Owner != "42" ||
+		ri.Description != holder {
+		t.Fatalf("resource info=%v, expected VolumeID=vol-1 held by 42", ri)
+	}
+}
+
+func TestInterceptor_UnavailableError(t *testing.T) {
+	i := New(WithLockProvider(
+		&failingLockProvider{newDefaultLockProvider()}))
+	_, err := i(context.Background(), &csi.DeleteVolumeRequest{
+		VolumeId: "vol-1",
+	}, &grpc.UnaryServerInfo{
+		FullMethod: "/csi.v1.Controller/DeleteVolume",
+	}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("handler invoked without lock")
+		return nil, nil
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("err=%v, expected code Unavailable", err)
+	}
+	exp := "lock provider failed: VolumeID=vol-1: connection refused"
+	if msg := status.Convert(err).Message(); msg != exp {
+		t.Fatalf("msg=%q, expected %q", msg, exp)
+	}
+	if d := retryDelay(t, err); d != defaultRetryDelay {
+		t.Fatalf("retry delay=%s, expected %s", d, defaultRetryDelay)
+	}
+}
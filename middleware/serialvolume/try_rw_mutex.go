@@ -0,0 +1,160 @@
+package serialvolume
+
+import (
+	"sync"
+	"time"
+)
+
+// tryRWMutex is a reader/writer mutual exclusion lock that implements the
+// TryRWLocker interface. Pending writers block new readers so that a
+// steady stream of readers cannot starve a writer. The zero value for a
+// tryRWMutex is an unlocked mutex.
+type tryRWMutex struct {
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	writers int // pending writers
+	waiters int // blocked readers and writers
+	changed chan struct{}
+}
+
+func (m *tryRWMutex) Lock() {
+	m.acquire(nil, false, -1)
+}
+
+func (m *tryRWMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.writer {
+		panic("serialvolume: unlock of unlocked mutex")
+	}
+	m.writer = false
+	m.broadcast()
+}
+
+func (m *tryRWMutex) TryLock(timeout time.Duration) bool {
+	return m.acquire(nil, false, timeout)
+}
+
+func (m *tryRWMutex) RLock() {
+	m.acquire(nil, true, -1)
+}
+
+func (m *tryRWMutex) RUnlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readers == 0 {
+		panic("serialvolume: runlock of unlocked mutex")
+	}
+	m.readers--
+	if m.readers == 0 {
+		m.broadcast()
+	}
+}
+
+func (m *tryRWMutex) TryRLock(timeout time.Duration) bool {
+	return m.acquire(nil, true, timeout)
+}
+
+// acquire obtains the lock. A negative timeout waits indefinitely, and a
+// timeout of zero does not wait at all. The wait also ends when the done
+// channel, if any, is closed.
+func (m *tryRWMutex) acquire(
+	done <-chan struct{}, shared bool, timeout time.Duration) bool {
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	m.mu.Lock()
+	if !shared {
+		m.writers++
+	}
+	waiting := false
+	defer func() {
+		if waiting {
+			m.mu.Lock()
+			m.waiters--
+			m.mu.Unlock()
+		}
+	}()
+	for {
+		if m.tryAcquire(shared) {
+			if !shared {
+				m.writers--
+			}
+			m.mu.Unlock()
+			return true
+		}
+		if timeout == 0 {
+			break
+		}
+		if !waiting {
+			waiting = true
+			m.waiters++
+		}
+		if m.changed == nil {
+			m.changed = make(chan struct{})
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+			m.mu.Lock()
+			continue
+		case <-expired:
+		case <-done:
+		}
+		m.mu.Lock()
+		break
+	}
+
+	// A writer that gives up may unblock pending readers.
+	if !shared {
+		m.writers--
+		m.broadcast()
+	}
+	m.mu.Unlock()
+	return false
+}
+
+// state returns whether or not the lock is held and the number of
+// goroutines waiting for it.
+func (m *tryRWMutex) state() (held bool, waiters int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.writer || m.readers > 0, m.waiters
+}
+
+// tryAcquire obtains the lock if it is available. The caller must hold mu.
+func (m *tryRWMutex) tryAcquire(shared bool) bool {
+	if m.writer {
+		return false
+	}
+	if shared {
+		// A pending writer blocks new readers.
+		if m.writers > 0 {
+			return false
+		}
+		m.readers++
+		return true
+	}
+	if m.readers > 0 {
+		return false
+	}
+	m.writer = true
+	return true
+}
+
+// broadcast wakes the goroutines waiting for the lock. The caller must
+// hold mu.
+func (m *tryRWMutex) broadcast() {
+	if m.changed != nil {
+		close(m.changed)
+		m.changed = nil
+	}
+}
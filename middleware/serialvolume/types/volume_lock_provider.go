@@ -2,12 +2,181 @@ package types
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
 	"github.com/akutz/gosync"
 )
 
+// LockMode is the mode in which a volume lock is obtained.
+type LockMode int
+
+const (
+	// LockModeExclusive indicates a lock is held by a single operation.
+	LockModeExclusive LockMode = iota
+
+	// LockModeShared indicates a lock may be held by several operations
+	// at once. A shared lock excludes exclusive holders.
+	LockModeShared
+)
+
+// String returns the name of the lock mode.
+func (m LockMode) String() string {
+	switch m {
+	case LockModeExclusive:
+		return "exclusive"
+	case LockModeShared:
+		return "shared"
+	}
+	return "unknown"
+}
+
+// ParseLockMode returns the lock mode with the provided name.
+func ParseLockMode(s string) (LockMode, bool) {
+	switch s {
+	case "exclusive":
+		return LockModeExclusive, true
+	case "shared":
+		return LockModeShared, true
+	}
+	return 0, false
+}
+
+// TryRWLocker is a TryLocker that may also be held in shared mode.
+type TryRWLocker interface {
+	gosync.TryLocker
+
+	// RLock locks the lock in shared mode. If the lock is held in
+	// exclusive mode, the calling goroutine blocks until the lock is
+	// available.
+	RLock()
+
+	// RUnlock undoes a single RLock call.
+	RUnlock()
+
+	// TryRLock attempts to lock the lock in shared mode and times out if
+	// no lock can be obtained in the specified duration. A flag is
+	// returned indicating whether or not the lock was obtained.
+	TryRLock(timeout time.Duration) bool
+}
+
+// ContextLocker is implemented by locks whose operations observe a
+// context and return the failures of the lock provider, ex. a lost
+// connection to etcd, as errors. The serialvolume interceptor prefers this
+// interface to gosync.TryLocker and TryRWLocker.
+type ContextLocker interface {
+	// TryLockContext attempts to lock the lock in the provided mode. If
+	// no lock can be obtained before the timeout expires or the context is
+	// done then a false value and a nil error are returned. A timeout of
+	// zero has the same meaning as it does for the lock's TryLock method.
+	// An error is returned if the lock provider failed.
+	TryLockContext(
+		ctx context.Context,
+		mode LockMode,
+		timeout time.Duration) (bool, error)
+
+	// UnlockContext unlocks the lock obtained with TryLockContext. An
+	// error is returned if the lock provider failed to unlock the lock or
+	// if the lock was lost while it was held.
+	UnlockContext(ctx context.Context) error
+}
+
+// ErrLockLost is returned by UnlockContext when the lock was lost while
+// it was held, ex. because the lease of the etcd session with which it was
+// obtained expired. Another operation may have obtained the lock since.
+var ErrLockLost = errors.New("lock lost")
+
+// LostLocker is implemented by locks that may be lost while they are held.
+// The serialvolume interceptor cancels the context of the operation that
+// holds a lock when the lock is lost.
+type LostLocker interface {
+	// Lost returns a channel that is closed when the lock obtained with
+	// this lock object is lost. The channel is valid until the lock is
+	// unlocked.
+	Lost() <-chan struct{}
+}
+
+// LockHolder describes the operation that holds a lock.
+type LockHolder struct {
+	// Method is the name of the RPC, ex. NodePublishVolume.
+	Method string `json:"method,omitempty"`
+
+	// RequestID is the ID of the request.
+	RequestID string `json:"requestID,omitempty"`
+
+	// NodeID is the ID of the node specified by the request, if any.
+	NodeID string `json:"nodeID,omitempty"`
+
+	// Acquired is the time at which the lock was obtained.
+	Acquired time.Time `json:"acquired"`
+}
+
+// String returns the holder in the form
+// "method=M, requestID=R, nodeID=N, acquired=T". Empty fields are omitted.
+func (h LockHolder) String() string {
+	var parts []string
+	if h.Method != "" {
+		parts = append(parts, "method="+h.Method)
+	}
+	if h.RequestID != "" {
+		parts = append(parts, "requestID="+h.RequestID)
+	}
+	if h.NodeID != "" {
+		parts = append(parts, "nodeID="+h.NodeID)
+	}
+	if !h.Acquired.IsZero() {
+		parts = append(parts, "acquired="+h.Acquired.Format(time.RFC3339))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LockHolderRecorder is implemented by locks that record the operations
+// that hold them.
+type LockHolderRecorder interface {
+	// SetLockHolder records the holder of the lock obtained with this
+	// lock object. The holder is removed when the lock is unlocked.
+	SetLockHolder(ctx context.Context, h LockHolder) error
+
+	// GetLockHolders gets the holders of the lock. A lock held in shared
+	// mode may have several holders.
+	GetLockHolders(ctx context.Context) ([]LockHolder, error)
+}
+
+// LockInfo describes a lock that is held or waited for.
+type LockInfo struct {
+	// Key identifies the lock, ex. volumesByID/vol-1.
+	Key string `json:"key"`
+
+	// Holders are the operations that hold the lock.
+	Holders []LockHolder `json:"holders"`
+
+	// Waiters is the number of operations waiting for the lock.
+	Waiters int `json:"waiters"`
+}
+
+// LockTableReporter is implemented by lock providers that are able to
+// report the locks that are currently held or waited for.
+type LockTableReporter interface {
+	// GetLockTable gets the locks that are held or waited for.
+	GetLockTable(ctx context.Context) ([]LockInfo, error)
+}
+
 // VolumeLockerProvider is able to provide gosync.TryLocker objects for
-// volumes by ID and name.
+// volumes by ID and name. A provider also records the names of the volumes
+// created by the SP so that operations on a volume by its ID may obtain
+// the volume's name lock as well.
+//
+// Locks that also implement TryRWLocker or ContextLocker may be obtained
+// in shared mode. Locks that do not are always obtained in exclusive mode.
+// Locks that implement ContextLocker enable failures of the provider to
+// be reported to the operations that could not obtain a lock. Locks that
+// implement LockHolderRecorder enable the errors returned for operations
+// that could not obtain a lock to describe the operations holding it.
+// Locks that implement LostLocker enable the operations whose locks are
+// lost to be canceled and reported as aborted. Providers that implement
+// LockTableReporter enable introspection of the locks that are held or
+// waited for.
 type VolumeLockerProvider interface {
 	// GetLockWithID gets a lock for a volume with provided ID. If a lock
 	// for the specified volume ID does not exist then a new lock is created
@@ -18,4 +187,23 @@ type VolumeLockerProvider interface {
 	// for the specified volume name does not exist then a new lock is created
 	// and returned.
 	GetLockWithName(ctx context.Context, name string) (gosync.TryLocker, error)
+
+	// GetResourceLockWithID gets a lock for a resource of the volume with
+	// the provided ID, ex. a node to which the volume is published. The
+	// resource key is unique among the volume's resources. If a lock for
+	// the specified resource does not exist then a new lock is created and
+	// returned.
+	GetResourceLockWithID(
+		ctx context.Context, id, key string) (gosync.TryLocker, error)
+
+	// SetVolumeName records the name of the volume with the provided ID.
+	SetVolumeName(ctx context.Context, id, name string) error
+
+	// GetVolumeName gets the name recorded for the volume with the provided
+	// ID. An empty string is returned if no name is recorded for the volume.
+	GetVolumeName(ctx context.Context, id string) (string, error)
+
+	// DeleteVolumeName removes the name recorded for the volume with the
+	// provided ID.
+	DeleteVolumeName(ctx context.Context, id string) error
 }
@@ -1,9 +1,12 @@
 package specvalidator
 
 import (
+	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +17,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
+	csictx "github.com/rexray/gocsi/context"
 	"github.com/rexray/gocsi/utils"
 )
 
@@ -33,7 +37,20 @@ type opts struct {
 	requiresCtlrUnpubVolSecrets bool
 	requiresNodeStgVolSecrets   bool
 	requiresNodePubVolSecrets   bool
+	requiresCtlrNewSnapSecrets  bool
+	requiresCtlrDelSnapSecrets  bool
+	requiresCtlrExpVolSecrets   bool
 	disableFieldLenCheck        bool
+	maxFieldString              int
+	maxFieldMap                 int
+	topology                    bool
+	topologyFunc                func(context.Context) (bool, error)
+	stats                       *Stats
+	crossValidation             bool
+	aggregate                   bool
+	remapErrCodes               bool
+	audit                       bool
+	volCapSupport               *VolumeCapabilitySupport
 }
 
 // WithRequestValidation is a Option that enables request validation.
@@ -132,6 +149,33 @@ func WithRequiresNodePublishVolumeSecrets() Option {
 	}
 }
 
+// WithRequiresControllerCreateSnapshotSecrets is a Option
+// that indicates the eponymous requests must contain non-empty credentials
+// data.
+func WithRequiresControllerCreateSnapshotSecrets() Option {
+	return func(o *opts) {
+		o.requiresCtlrNewSnapSecrets = true
+	}
+}
+
+// WithRequiresControllerDeleteSnapshotSecrets is a Option
+// that indicates the eponymous requests must contain non-empty credentials
+// data.
+func WithRequiresControllerDeleteSnapshotSecrets() Option {
+	return func(o *opts) {
+		o.requiresCtlrDelSnapSecrets = true
+	}
+}
+
+// WithRequiresControllerExpandVolumeSecrets is a Option
+// that indicates the eponymous requests must contain non-empty credentials
+// data.
+func WithRequiresControllerExpandVolumeSecrets() Option {
+	return func(o *opts) {
+		o.requiresCtlrExpVolSecrets = true
+	}
+}
+
 // WithDisableFieldLenCheck is a Option
 // that indicates that the length of fields should not be validated
 func WithDisableFieldLenCheck() Option {
@@ -140,8 +184,108 @@ func WithDisableFieldLenCheck() Option {
 	}
 }
 
+// WithMaxFieldStringSize is a Option that sets the maximum size of string
+// fields. The default value is DefaultMaxFieldString.
+func WithMaxFieldStringSize(size int) Option {
+	return func(o *opts) {
+		o.maxFieldString = size
+	}
+}
+
+// WithMaxFieldMapSize is a Option that sets the maximum size of map
+// fields, the sum of the sizes of a map's keys and values. The default
+// value is DefaultMaxFieldMap.
+func WithMaxFieldMapSize(size int) Option {
+	return func(o *opts) {
+		o.maxFieldMap = size
+	}
+}
+
+// WithTopologyValidation is a Option that enables validation of topology
+// fields, ex. CreateVolumeRequest.AccessibilityRequirements and
+// Volume.AccessibleTopology. This option should be enabled when the
+// plug-in advertises the VOLUME_ACCESSIBILITY_CONSTRAINTS capability.
+func WithTopologyValidation() Option {
+	return func(o *opts) {
+		o.topology = true
+	}
+}
+
+// WithTopologyValidationFunc is a Option that enables validation of
+// topology fields if the provided function returns true, ex. a function
+// that checks whether the plug-in advertises the
+// VOLUME_ACCESSIBILITY_CONSTRAINTS capability. The function is invoked
+// on the first validated RPC, and on later RPCs until it succeeds, so
+// it may depend on services that are not ready until the plug-in is
+// served. This option has no effect if WithTopologyValidation is set.
+func WithTopologyValidationFunc(f func(context.Context) (bool, error)) Option {
+	return func(o *opts) {
+		o.topologyFunc = f
+	}
+}
+
+// WithCrossValidation is a Option that enables validating that responses
+// honor their requests, ex. a created volume's capacity must be within
+// the requested capacity range. This option has no effect unless response
+// validation is enabled.
+func WithCrossValidation() Option {
+	return func(o *opts) {
+		o.crossValidation = true
+	}
+}
+
+// WithErrorCodeRemap is a Option that replaces errors with codes the CSI
+// specification does not permit an RPC to return with errors that have a
+// code of Internal. Without this option such errors are logged and passed
+// through as-is. This option has no effect unless response validation is
+// enabled.
+func WithErrorCodeRemap() Option {
+	return func(o *opts) {
+		o.remapErrCodes = true
+	}
+}
+
+// WithAuditMode is a Option that logs and counts request and response
+// violations instead of failing the RPC. The original request or response
+// passes through unchanged, and error codes are never remapped.
+func WithAuditMode() Option {
+	return func(o *opts) {
+		o.audit = true
+	}
+}
+
+// WithSupportedVolumeCapabilities is a Option that rejects requests with
+// volume capabilities the SP does not support. The CreateVolume,
+// ControllerPublishVolume, NodeStageVolume, and NodePublishVolume
+// requests are validated.
+func WithSupportedVolumeCapabilities(vcs VolumeCapabilitySupport) Option {
+	return func(o *opts) {
+		o.volCapSupport = &vcs
+	}
+}
+
+// WithAggregatedViolations is a Option that reports all of a request's
+// spec violations instead of only the first one. Each violation is
+// included in the error's status details as a google.rpc.BadRequest
+// field violation.
+func WithAggregatedViolations() Option {
+	return func(o *opts) {
+		o.aggregate = true
+	}
+}
+
 type interceptor struct {
 	opts opts
+
+	// stats counts the violations. It is allocated separately from the
+	// interceptor so its counters are 64-bit aligned.
+	stats *Stats
+
+	// topology indicates whether topology validation is enabled once
+	// topologyOK is set by the topology validation function.
+	topologyL  sync.RWMutex
+	topology   bool
+	topologyOK bool
 }
 
 // NewServerSpecValidator returns a new UnaryServerInterceptor that validates
@@ -165,6 +309,10 @@ func newSpecValidator(opts ...Option) *interceptor {
 	for _, withOpts := range opts {
 		withOpts(&i.opts)
 	}
+	i.stats = i.opts.stats
+	if i.stats == nil {
+		i.stats = &Stats{}
+	}
 	return i
 }
 
@@ -205,10 +353,17 @@ func (s *interceptor) handle(
 		return next()
 	}
 
+	if s.opts.reqValidation || s.opts.repValidation {
+		s.initTopologyValidation(ctx)
+	}
+
 	if s.opts.reqValidation {
 		// Validate the request against the CSI specification.
 		if err := s.validateRequest(ctx, method, req); err != nil {
-			return nil, err
+			if !s.opts.audit {
+				return nil, err
+			}
+			s.auditViolation(ctx, method, "request", err)
 		}
 	}
 
@@ -218,13 +373,25 @@ func (s *interceptor) handle(
 	rep, err := next()
 
 	if err != nil {
+		if s.opts.repValidation {
+			// Validate the error's code against the codes the CSI
+			// specification permits the method to return.
+			err = s.validateErrorCode(method, err)
+		}
 		return nil, err
 	}
 
 	if s.opts.repValidation {
 		log.Debug("response validation enabled")
 		// Validate the response against the CSI specification.
-		if err := s.validateResponse(ctx, method, rep); err != nil {
+		if err := s.validateResponse(ctx, method, req, rep); err != nil {
+
+			// In audit mode the violation is recorded and the response
+			// is returned unchanged.
+			if s.opts.audit {
+				s.auditViolation(ctx, method, "response", err)
+				return rep, nil
+			}
 
 			// If an error occurred while validating the response, it is
 			// imperative the response not be discarded as it could be
@@ -234,6 +401,11 @@ func (s *interceptor) handle(
 				st = status.New(codes.Internal, err.Error())
 			}
 
+			// A nil response cannot be added to the error details.
+			if utils.IsNilResponse(rep) {
+				return nil, st.Err()
+			}
+
 			// Add the response to the error details.
 			st, err2 := st.WithDetails(rep.(proto.Message))
 
@@ -260,6 +432,88 @@ func (s *interceptor) handle(
 	return rep, err
 }
 
+// initTopologyValidation invokes the topology validation function until it
+// succeeds. The function is invoked without holding the topology lock so
+// a slow or re-entrant function, ex. one that sends GetPluginCapabilities
+// through the interceptor chain, does not block other RPCs.
+func (s *interceptor) initTopologyValidation(ctx context.Context) {
+	if s.opts.topology || s.opts.topologyFunc == nil {
+		return
+	}
+	s.topologyL.RLock()
+	ok := s.topologyOK
+	s.topologyL.RUnlock()
+	if ok {
+		return
+	}
+
+	enabled, err := s.opts.topologyFunc(ctx)
+	if err != nil {
+		log.WithError(err).Warn(
+			"failed to determine whether to validate topology")
+		return
+	}
+
+	s.topologyL.Lock()
+	defer s.topologyL.Unlock()
+	if s.topologyOK {
+		return
+	}
+	s.topology, s.topologyOK = enabled, true
+	log.WithField("enabled", enabled).Debug("initialized topology validation")
+}
+
+// validateTopology returns a flag indicating whether topology fields
+// are validated.
+func (s *interceptor) validateTopology() bool {
+	if s.opts.topology {
+		return true
+	}
+	s.topologyL.RLock()
+	defer s.topologyL.RUnlock()
+	return s.topology
+}
+
+// auditViolation logs and counts a violation found in audit mode.
+func (s *interceptor) auditViolation(
+	ctx context.Context, method, kind string, err error) {
+
+	violation := status.Convert(err).Message()
+	name := method
+	if _, _, n, err := utils.ParseMethod(method); err == nil {
+		name = n
+	}
+	count := s.stats.addAuditViolation(name, auditKey(violation))
+	fields := map[string]interface{}{
+		"method":    method,
+		"kind":      kind,
+		"violation": violation,
+		"count":     count,
+	}
+	if id, ok := csictx.GetRequestIDString(ctx); ok {
+		fields["requestID"] = id
+	}
+	log.WithFields(fields).Warn("spec violation")
+}
+
+// auditKey returns the key that counts a violation in audit mode. The key
+// is the violation's kind and the leading part of its field path, ex.
+// "exceeds size limit: Parameters" for the violation "exceeds size limit:
+// Parameters[key]: max=128, size=130". Request-specific data such as
+// map keys, list indices, values, and sizes is omitted so the number of
+// keys is bounded. Only the first of aggregated violations is counted.
+func auditKey(violation string) string {
+	i := strings.Index(violation, ": ")
+	if i < 0 {
+		return violation
+	}
+	kind, path := violation[:i], violation[i+2:]
+	if j := strings.IndexAny(path, "[=:; "); j >= 0 {
+		path = path[:j]
+	}
+	return kind + ": " + path
+}
+
 type interceptorHasVolumeID interface {
 	GetVolumeId() string
 }
@@ -284,19 +538,20 @@ func (s *interceptor) validateRequest(
 		return nil
 	}
 
+	// All of the request's violations are collected, but unless the
+	// aggregate option is enabled only the first one is returned.
+	var v violations
+
 	// Validate field sizes.
 	if !s.opts.disableFieldLenCheck {
-		if err := validateFieldSizes(req); err != nil {
-			return err
-		}
+		s.validateFieldSizes(req, &v)
 	}
 
 	// Check to see if the request has a volume ID and if it is set.
 	// If the volume ID is not set then return an error.
 	if treq, ok := req.(interceptorHasVolumeID); ok {
 		if treq.GetVolumeId() == "" {
-			return status.Error(
-				codes.InvalidArgument, "required: VolumeID")
+			v.required("VolumeID")
 		}
 	}
 
@@ -306,8 +561,7 @@ func (s *interceptor) validateRequest(
 	if s.opts.requiresVolContext {
 		if treq, ok := req.(interceptorHasVolumeContext); ok {
 			if len(treq.GetVolumeContext()) == 0 {
-				return status.Error(
-					codes.InvalidArgument, "required: VolumeContext")
+				v.required("VolumeContext")
 			}
 		}
 	}
@@ -318,8 +572,7 @@ func (s *interceptor) validateRequest(
 	if s.opts.requiresPubContext {
 		if treq, ok := req.(interceptorHasPublishContext); ok {
 			if len(treq.GetPublishContext()) == 0 {
-				return status.Error(
-					codes.InvalidArgument, "required: PublishContext")
+				v.required("PublishContext")
 			}
 		}
 	}
@@ -333,37 +586,47 @@ func (s *interceptor) validateRequest(
 	// Controller Service
 	//
 	case *csi.CreateVolumeRequest:
-		return s.validateCreateVolumeRequest(ctx, *tobj)
+		s.validateCreateVolumeRequest(ctx, *tobj, &v)
 	case *csi.DeleteVolumeRequest:
-		return s.validateDeleteVolumeRequest(ctx, *tobj)
+		s.validateDeleteVolumeRequest(ctx, *tobj, &v)
 	case *csi.ControllerPublishVolumeRequest:
-		return s.validateControllerPublishVolumeRequest(ctx, *tobj)
+		s.validateControllerPublishVolumeRequest(ctx, *tobj, &v)
 	case *csi.ControllerUnpublishVolumeRequest:
-		return s.validateControllerUnpublishVolumeRequest(ctx, *tobj)
+		s.validateControllerUnpublishVolumeRequest(ctx, *tobj, &v)
 	case *csi.ValidateVolumeCapabilitiesRequest:
-		return s.validateValidateVolumeCapabilitiesRequest(ctx, *tobj)
+		s.validateValidateVolumeCapabilitiesRequest(ctx, *tobj, &v)
 	case *csi.GetCapacityRequest:
-		return s.validateGetCapacityRequest(ctx, *tobj)
+		s.validateGetCapacityRequest(ctx, *tobj, &v)
+	case *csi.CreateSnapshotRequest:
+		s.validateCreateSnapshotRequest(ctx, *tobj, &v)
+	case *csi.DeleteSnapshotRequest:
+		s.validateDeleteSnapshotRequest(ctx, *tobj, &v)
+	case *csi.ControllerExpandVolumeRequest:
+		s.validateControllerExpandVolumeRequest(ctx, *tobj, &v)
 		//
 		// Node Service
 		//
 	case *csi.NodeStageVolumeRequest:
-		return s.validateNodeStageVolumeRequest(ctx, *tobj)
+		s.validateNodeStageVolumeRequest(ctx, *tobj, &v)
 	case *csi.NodeUnstageVolumeRequest:
-		return s.validateNodeUnstageVolumeRequest(ctx, *tobj)
+		s.validateNodeUnstageVolumeRequest(ctx, *tobj, &v)
 	case *csi.NodePublishVolumeRequest:
-		return s.validateNodePublishVolumeRequest(ctx, *tobj)
+		s.validateNodePublishVolumeRequest(ctx, *tobj, &v)
 	case *csi.NodeUnpublishVolumeRequest:
-		return s.validateNodeUnpublishVolumeRequest(ctx, *tobj)
+		s.validateNodeUnpublishVolumeRequest(ctx, *tobj, &v)
+	case *csi.NodeGetVolumeStatsRequest:
+		s.validateNodeGetVolumeStatsRequest(ctx, *tobj, &v)
+	case *csi.NodeExpandVolumeRequest:
+		s.validateNodeExpandVolumeRequest(ctx, *tobj, &v)
 	}
 
-	return nil
+	return v.err(codes.InvalidArgument, s.opts.aggregate)
 }
 
 func (s *interceptor) validateResponse(
 	ctx context.Context,
 	method string,
-	rep interface{}) error {
+	req, rep interface{}) error {
 
 	if utils.IsNilResponse(rep) {
 		return status.Error(codes.Internal, "nil response")
@@ -371,7 +634,16 @@ func (s *interceptor) validateResponse(
 
 	// Validate the field sizes.
 	if !s.opts.disableFieldLenCheck {
-		if err := validateFieldSizes(rep); err != nil {
+		var v violations
+		s.validateFieldSizes(rep, &v)
+		if err := v.err(codes.InvalidArgument, false); err != nil {
+			return err
+		}
+	}
+
+	// Validate the response honors the request.
+	if s.opts.crossValidation {
+		if err := crossValidate(req, rep); err != nil {
 			return err
 		}
 	}
@@ -381,18 +653,31 @@ func (s *interceptor) validateResponse(
 	// Controller Service
 	//
 	case *csi.CreateVolumeResponse:
-		return s.validateCreateVolumeResponse(ctx, *tobj)
+		creq, _ := req.(*csi.CreateVolumeRequest)
+		return s.validateCreateVolumeResponse(ctx, creq, *tobj)
 	case *csi.ControllerPublishVolumeResponse:
 		return s.validateControllerPublishVolumeResponse(ctx, *tobj)
 	case *csi.ListVolumesResponse:
 		return s.validateListVolumesResponse(ctx, *tobj)
 	case *csi.ControllerGetCapabilitiesResponse:
 		return s.validateControllerGetCapabilitiesResponse(ctx, *tobj)
+	case *csi.GetCapacityResponse:
+		return s.validateGetCapacityResponse(ctx, *tobj)
+	case *csi.CreateSnapshotResponse:
+		return s.validateCreateSnapshotResponse(ctx, *tobj)
+	case *csi.ListSnapshotsResponse:
+		return s.validateListSnapshotsResponse(ctx, *tobj)
+	case *csi.ControllerExpandVolumeResponse:
+		return s.validateControllerExpandVolumeResponse(ctx, *tobj)
 	//
 	// Identity Service
 	//
 	case *csi.GetPluginInfoResponse:
 		return s.validateGetPluginInfoResponse(ctx, *tobj)
+	case *csi.GetPluginCapabilitiesResponse:
+		return s.validateGetPluginCapabilitiesResponse(ctx, *tobj)
+	// ProbeResponse has no required fields; its field sizes and a nil
+	// response are validated above.
 	//
 	// Node Service
 	//
@@ -400,6 +685,10 @@ func (s *interceptor) validateResponse(
 		return s.validateNodeGetInfoResponse(ctx, *tobj)
 	case *csi.NodeGetCapabilitiesResponse:
 		return s.validateNodeGetCapabilitiesResponse(ctx, *tobj)
+	case *csi.NodeGetVolumeStatsResponse:
+		return s.validateNodeGetVolumeStatsResponse(ctx, *tobj)
+	case *csi.NodeExpandVolumeResponse:
+		return s.validateNodeExpandVolumeResponse(ctx, *tobj)
 	}
 
 	return nil
@@ -407,152 +696,234 @@ func (s *interceptor) validateResponse(
 
 func (s *interceptor) validateCreateVolumeRequest(
 	ctx context.Context,
-	req csi.CreateVolumeRequest) error {
+	req csi.CreateVolumeRequest,
+	v *violations) {
 
 	if req.Name == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: Name")
+		v.required("Name")
 	}
 	if s.opts.requiresCtlrNewVolSecrets {
 		if len(req.Secrets) == 0 {
-			return status.Error(
-				codes.InvalidArgument, "required: Secrets")
+			v.required("Secrets")
 		}
 	}
 
-	return validateVolumeCapabilitiesArg(req.VolumeCapabilities, true)
+	if s.validateTopology() {
+		validateCreateVolumeAccessibilityRequirements(
+			req.AccessibilityRequirements, v)
+	}
+
+	validateVolumeCapabilitiesArg(req.VolumeCapabilities, true, v)
+	for i, c := range req.VolumeCapabilities {
+		s.validateSupportedVolumeCapability(
+			c, fmt.Sprintf("VolumeCapabilities[%d]", i), v)
+	}
 }
 
 func (s *interceptor) validateDeleteVolumeRequest(
 	ctx context.Context,
-	req csi.DeleteVolumeRequest) error {
+	req csi.DeleteVolumeRequest,
+	v *violations) {
 
 	if s.opts.requiresCtlrDelVolSecrets {
 		if len(req.Secrets) == 0 {
-			return status.Error(
-				codes.InvalidArgument, "required: Secrets")
+			v.required("Secrets")
 		}
 	}
-
-	return nil
 }
 
 func (s *interceptor) validateControllerPublishVolumeRequest(
 	ctx context.Context,
-	req csi.ControllerPublishVolumeRequest) error {
+	req csi.ControllerPublishVolumeRequest,
+	v *violations) {
 
 	if s.opts.requiresCtlrPubVolSecrets {
 		if len(req.Secrets) == 0 {
-			return status.Error(
-				codes.InvalidArgument, "required: Secrets")
+			v.required("Secrets")
 		}
 	}
 
 	if req.NodeId == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: NodeID")
+		v.required("NodeID")
 	}
 
-	return validateVolumeCapabilityArg(req.VolumeCapability, true)
+	validateVolumeCapabilityArg(req.VolumeCapability, true, v)
+	s.validateSupportedVolumeCapability(
+		req.VolumeCapability, "VolumeCapability", v)
 }
 
 func (s *interceptor) validateControllerUnpublishVolumeRequest(
 	ctx context.Context,
-	req csi.ControllerUnpublishVolumeRequest) error {
+	req csi.ControllerUnpublishVolumeRequest,
+	v *violations) {
 
 	if s.opts.requiresCtlrUnpubVolSecrets {
 		if len(req.Secrets) == 0 {
-			return status.Error(
-				codes.InvalidArgument, "required: Secrets")
+			v.required("Secrets")
 		}
 	}
-
-	return nil
 }
 
 func (s *interceptor) validateValidateVolumeCapabilitiesRequest(
 	ctx context.Context,
-	req csi.ValidateVolumeCapabilitiesRequest) error {
+	req csi.ValidateVolumeCapabilitiesRequest,
+	v *violations) {
 
-	return validateVolumeCapabilitiesArg(req.VolumeCapabilities, true)
+	validateVolumeCapabilitiesArg(req.VolumeCapabilities, true, v)
 }
 
 func (s *interceptor) validateGetCapacityRequest(
 	ctx context.Context,
-	req csi.GetCapacityRequest) error {
+	req csi.GetCapacityRequest,
+	v *violations) {
+
+	validateVolumeCapabilitiesArg(req.VolumeCapabilities, false, v)
+}
+
+func (s *interceptor) validateCreateSnapshotRequest(
+	ctx context.Context,
+	req csi.CreateSnapshotRequest,
+	v *violations) {
+
+	if req.SourceVolumeId == "" {
+		v.required("SourceVolumeID")
+	}
+
+	if req.Name == "" {
+		v.required("Name")
+	}
+
+	if s.opts.requiresCtlrNewSnapSecrets {
+		if len(req.Secrets) == 0 {
+			v.required("Secrets")
+		}
+	}
+}
+
+func (s *interceptor) validateDeleteSnapshotRequest(
+	ctx context.Context,
+	req csi.DeleteSnapshotRequest,
+	v *violations) {
 
-	return validateVolumeCapabilitiesArg(req.VolumeCapabilities, false)
+	if req.SnapshotId == "" {
+		v.required("SnapshotID")
+	}
+
+	if s.opts.requiresCtlrDelSnapSecrets {
+		if len(req.Secrets) == 0 {
+			v.required("Secrets")
+		}
+	}
+}
+
+func (s *interceptor) validateControllerExpandVolumeRequest(
+	ctx context.Context,
+	req csi.ControllerExpandVolumeRequest,
+	v *violations) {
+
+	if req.CapacityRange == nil {
+		v.required("CapacityRange")
+	}
+
+	if s.opts.requiresCtlrExpVolSecrets {
+		if len(req.Secrets) == 0 {
+			v.required("Secrets")
+		}
+	}
 }
 
 func (s *interceptor) validateNodeStageVolumeRequest(
 	ctx context.Context,
-	req csi.NodeStageVolumeRequest) error {
+	req csi.NodeStageVolumeRequest,
+	v *violations) {
 
 	if req.StagingTargetPath == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: StagingTargetPath")
+		v.required("StagingTargetPath")
 	}
 
 	if s.opts.requiresNodeStgVolSecrets {
 		if len(req.Secrets) == 0 {
-			return status.Error(
-				codes.InvalidArgument, "required: Secrets")
+			v.required("Secrets")
 		}
 	}
 
-	return validateVolumeCapabilityArg(req.VolumeCapability, true)
+	validateVolumeCapabilityArg(req.VolumeCapability, true, v)
+	s.validateSupportedVolumeCapability(
+		req.VolumeCapability, "VolumeCapability", v)
 }
 
 func (s *interceptor) validateNodeUnstageVolumeRequest(
 	ctx context.Context,
-	req csi.NodeUnstageVolumeRequest) error {
+	req csi.NodeUnstageVolumeRequest,
+	v *violations) {
 
 	if req.StagingTargetPath == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: StagingTargetPath")
+		v.required("StagingTargetPath")
 	}
-
-	return nil
 }
 
 func (s *interceptor) validateNodePublishVolumeRequest(
 	ctx context.Context,
-	req csi.NodePublishVolumeRequest) error {
+	req csi.NodePublishVolumeRequest,
+	v *violations) {
 
 	if s.opts.requiresStagingTargetPath && req.StagingTargetPath == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: StagingTargetPath")
+		v.required("StagingTargetPath")
 	}
 
 	if req.TargetPath == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: TargetPath")
+		v.required("TargetPath")
 	}
 
 	if s.opts.requiresNodePubVolSecrets {
 		if len(req.Secrets) == 0 {
-			return status.Error(
-				codes.InvalidArgument, "required: Secrets")
+			v.required("Secrets")
 		}
 	}
 
-	return validateVolumeCapabilityArg(req.VolumeCapability, true)
+	validateVolumeCapabilityArg(req.VolumeCapability, true, v)
+	s.validateSupportedVolumeCapability(
+		req.VolumeCapability, "VolumeCapability", v)
 }
 
 func (s *interceptor) validateNodeUnpublishVolumeRequest(
 	ctx context.Context,
-	req csi.NodeUnpublishVolumeRequest) error {
+	req csi.NodeUnpublishVolumeRequest,
+	v *violations) {
 
 	if req.TargetPath == "" {
-		return status.Error(
-			codes.InvalidArgument, "required: TargetPath")
+		v.required("TargetPath")
 	}
+}
 
-	return nil
+func (s *interceptor) validateNodeGetVolumeStatsRequest(
+	ctx context.Context,
+	req csi.NodeGetVolumeStatsRequest,
+	v *violations) {
+
+	if req.VolumePath == "" {
+		v.required("VolumePath")
+	}
+}
+
+func (s *interceptor) validateNodeExpandVolumeRequest(
+	ctx context.Context,
+	req csi.NodeExpandVolumeRequest,
+	v *violations) {
+
+	if req.VolumePath == "" {
+		v.required("VolumePath")
+	}
+
+	// The volume capability is optional, but must be valid if specified.
+	if req.VolumeCapability != nil {
+		validateVolumeCapabilityArg(req.VolumeCapability, false, v)
+	}
 }
 
 func (s *interceptor) validateCreateVolumeResponse(
 	ctx context.Context,
+	req *csi.CreateVolumeRequest,
 	rep csi.CreateVolumeResponse) error {
 
 	if rep.Volume == nil {
@@ -568,6 +939,18 @@ func (s *interceptor) validateCreateVolumeResponse(
 			codes.Internal, "non-nil, empty: Volume.VolumeContext")
 	}
 
+	if s.validateTopology() {
+		err := validateAccessibleTopology(
+			rep.Volume.AccessibleTopology, "Volume.AccessibleTopology")
+		if err != nil {
+			return err
+		}
+		if req != nil {
+			return validateRequisiteTopology(
+				req.AccessibilityRequirements, rep.Volume)
+		}
+	}
+
 	return nil
 }
 
@@ -602,6 +985,14 @@ func (s *interceptor) validateListVolumesResponse(
 				codes.Internal,
 				"non-nil, empty: Entries[%d].Volume.VolumeContext", i)
 		}
+		if s.validateTopology() {
+			err := validateAccessibleTopology(
+				vol.AccessibleTopology,
+				fmt.Sprintf("Entries[%d].Volume.AccessibleTopology", i))
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -617,6 +1008,76 @@ func (s *interceptor) validateControllerGetCapabilitiesResponse(
 	return nil
 }
 
+func (s *interceptor) validateGetCapacityResponse(
+	ctx context.Context,
+	rep csi.GetCapacityResponse) error {
+
+	if rep.AvailableCapacity < 0 {
+		return status.Errorf(codes.Internal,
+			"negative: AvailableCapacity=%d", rep.AvailableCapacity)
+	}
+	return nil
+}
+
+func (s *interceptor) validateCreateSnapshotResponse(
+	ctx context.Context,
+	rep csi.CreateSnapshotResponse) error {
+
+	return validateSnapshot(rep.Snapshot, "Snapshot")
+}
+
+func (s *interceptor) validateListSnapshotsResponse(
+	ctx context.Context,
+	rep csi.ListSnapshotsResponse) error {
+
+	for i, e := range rep.Entries {
+		if e == nil {
+			return status.Errorf(codes.Internal, "nil: Entries[%d]", i)
+		}
+		err := validateSnapshot(
+			e.Snapshot, fmt.Sprintf("Entries[%d].Snapshot", i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *interceptor) validateControllerExpandVolumeResponse(
+	ctx context.Context,
+	rep csi.ControllerExpandVolumeResponse) error {
+
+	if rep.CapacityBytes < 0 {
+		return status.Errorf(codes.Internal,
+			"negative: CapacityBytes=%d", rep.CapacityBytes)
+	}
+	return nil
+}
+
+// validateSnapshot validates the fields of a snapshot that the CSI
+// specification requires the SP to set. The path argument is the
+// snapshot's location in the response and is used in error messages.
+func validateSnapshot(snap *csi.Snapshot, path string) error {
+	if snap == nil {
+		return status.Errorf(codes.Internal, "nil: %s", path)
+	}
+	if snap.SnapshotId == "" {
+		return status.Errorf(codes.Internal, "empty: %s.SnapshotId", path)
+	}
+	if snap.SourceVolumeId == "" {
+		return status.Errorf(codes.Internal,
+			"empty: %s.SourceVolumeId", path)
+	}
+	if snap.CreationTime == nil {
+		return status.Errorf(codes.Internal, "nil: %s.CreationTime", path)
+	}
+	if snap.SizeBytes < 0 {
+		return status.Errorf(codes.Internal,
+			"negative: %s.SizeBytes=%d", path, snap.SizeBytes)
+	}
+	return nil
+}
+
 const (
 	pluginNameMax           = 63
 	pluginNamePatt          = `^[\w\d]+\.[\w\d\.\-_]*[\w\d]$`
@@ -665,6 +1126,36 @@ func (s *interceptor) validateGetPluginInfoResponse(
 	return nil
 }
 
+func (s *interceptor) validateGetPluginCapabilitiesResponse(
+	ctx context.Context,
+	rep csi.GetPluginCapabilitiesResponse) error {
+
+	for i, c := range rep.Capabilities {
+		if c == nil {
+			return status.Errorf(codes.Internal, "nil: Capabilities[%d]", i)
+		}
+		switch tt := c.Type.(type) {
+		case *csi.PluginCapability_Service_:
+			if tt.Service == nil || tt.Service.Type ==
+				csi.PluginCapability_Service_UNKNOWN {
+				return status.Errorf(codes.Internal,
+					"invalid: Capabilities[%d].Service.Type=UNKNOWN", i)
+			}
+		case *csi.PluginCapability_VolumeExpansion_:
+			if tt.VolumeExpansion == nil || tt.VolumeExpansion.Type ==
+				csi.PluginCapability_VolumeExpansion_UNKNOWN {
+				return status.Errorf(codes.Internal,
+					"invalid: Capabilities[%d].VolumeExpansion.Type=UNKNOWN",
+					i)
+			}
+		default:
+			return status.Errorf(codes.Internal,
+				"nil: Capabilities[%d].Type", i)
+		}
+	}
+	return nil
+}
+
 func (s *interceptor) validateNodeGetInfoResponse(
 	ctx context.Context,
 	rep csi.NodeGetInfoResponse) error {
@@ -672,6 +1163,12 @@ func (s *interceptor) validateNodeGetInfoResponse(
 		return status.Error(codes.Internal, "empty: NodeID")
 	}
 
+	if s.validateTopology() && rep.AccessibleTopology != nil {
+		var v violations
+		validateTopology(rep.AccessibleTopology, "AccessibleTopology", &v)
+		return v.err(codes.Internal, false)
+	}
+
 	return nil
 }
 
@@ -685,143 +1182,250 @@ func (s *interceptor) validateNodeGetCapabilitiesResponse(
 	return nil
 }
 
+func (s *interceptor) validateNodeGetVolumeStatsResponse(
+	ctx context.Context,
+	rep csi.NodeGetVolumeStatsResponse) error {
+
+	for i, u := range rep.Usage {
+		if u == nil {
+			return status.Errorf(codes.Internal, "nil: Usage[%d]", i)
+		}
+		if u.Unit == csi.VolumeUsage_UNKNOWN {
+			return status.Errorf(codes.Internal,
+				"invalid: Usage[%d].Unit=UNKNOWN", i)
+		}
+		if u.Available < 0 {
+			return status.Errorf(codes.Internal,
+				"negative: Usage[%d].Available=%d", i, u.Available)
+		}
+		if u.Total < 0 {
+			return status.Errorf(codes.Internal,
+				"negative: Usage[%d].Total=%d", i, u.Total)
+		}
+		if u.Used < 0 {
+			return status.Errorf(codes.Internal,
+				"negative: Usage[%d].Used=%d", i, u.Used)
+		}
+	}
+	return nil
+}
+
+func (s *interceptor) validateNodeExpandVolumeResponse(
+	ctx context.Context,
+	rep csi.NodeExpandVolumeResponse) error {
+
+	if rep.CapacityBytes < 0 {
+		return status.Errorf(codes.Internal,
+			"negative: CapacityBytes=%d", rep.CapacityBytes)
+	}
+	return nil
+}
+
 func validateVolumeCapabilityArg(
 	volCap *csi.VolumeCapability,
-	required bool) error {
+	required bool,
+	v *violations) {
 
-	if required && volCap == nil {
-		return status.Error(codes.InvalidArgument, "required: VolumeCapability")
+	if volCap == nil {
+		if required {
+			v.required("VolumeCapability")
+		}
+		return
 	}
 
 	if volCap.AccessMode == nil {
-		return status.Error(codes.InvalidArgument, "required: AccessMode")
+		v.required("AccessMode")
 	}
 
 	atype := volCap.GetAccessType()
 	if atype == nil {
-		return status.Error(codes.InvalidArgument, "required: AccessType")
+		v.required("AccessType")
+		return
 	}
 
 	switch tatype := atype.(type) {
 	case *csi.VolumeCapability_Block:
 		if tatype.Block == nil {
-			return status.Error(codes.InvalidArgument,
-				"required: AccessType.Block")
+			v.required("AccessType.Block")
 		}
 	case *csi.VolumeCapability_Mount:
 		if tatype.Mount == nil {
-			return status.Error(codes.InvalidArgument,
-				"required: AccessType.Mount")
+			v.required("AccessType.Mount")
 		}
 	default:
-		return status.Errorf(codes.InvalidArgument,
-			"invalid: AccessType=%T", atype)
+		v.add("invalid", fmt.Sprintf("AccessType=%T", atype), "")
 	}
-
-	return nil
 }
 
 func validateVolumeCapabilitiesArg(
 	volCaps []*csi.VolumeCapability,
-	required bool) error {
+	required bool,
+	v *violations) {
 
 	if len(volCaps) == 0 {
 		if required {
-			return status.Error(
-				codes.InvalidArgument, "required: VolumeCapabilities")
+			v.required("VolumeCapabilities")
 		}
-		return nil
+		return
 	}
 
 	for i, cap := range volCaps {
+		if cap == nil {
+			v.required(fmt.Sprintf("VolumeCapabilities[%d]", i))
+			continue
+		}
 		if cap.AccessMode == nil {
-			return status.Errorf(
-				codes.InvalidArgument,
-				"required: VolumeCapabilities[%d].AccessMode", i)
+			v.required(fmt.Sprintf("VolumeCapabilities[%d].AccessMode", i))
 		}
 		atype := cap.GetAccessType()
 		if atype == nil {
-			return status.Errorf(
-				codes.InvalidArgument,
-				"required: VolumeCapabilities[%d].AccessType", i)
+			v.required(fmt.Sprintf("VolumeCapabilities[%d].AccessType", i))
+			continue
 		}
 		switch tatype := atype.(type) {
 		case *csi.VolumeCapability_Block:
 			if tatype.Block == nil {
-				return status.Errorf(
-					codes.InvalidArgument,
-					"required: VolumeCapabilities[%d].AccessType.Block", i)
-
+				v.required(fmt.Sprintf(
+					"VolumeCapabilities[%d].AccessType.Block", i))
 			}
 		case *csi.VolumeCapability_Mount:
 			if tatype.Mount == nil {
-				return status.Errorf(
-					codes.InvalidArgument,
-					"required: VolumeCapabilities[%d].AccessType.Mount", i)
+				v.required(fmt.Sprintf(
+					"VolumeCapabilities[%d].AccessType.Mount", i))
 			}
 		default:
-			return status.Errorf(
-				codes.InvalidArgument,
-				"invalid: VolumeCapabilities[%d].AccessType=%T", i, atype)
+			v.add("invalid", fmt.Sprintf(
+				"VolumeCapabilities[%d].AccessType=%T", i, atype), "")
 		}
 	}
-
-	return nil
 }
 
 const (
-	maxFieldString = 128
-	maxFieldMap    = 4096
+	// DefaultMaxFieldString is the default maximum size of a string field
+	// as defined by the CSI specification.
+	DefaultMaxFieldString = 128
+
+	// DefaultMaxFieldMap is the default maximum size of a map field, the
+	// sum of the sizes of its keys and values, as defined by the CSI
+	// specification.
+	DefaultMaxFieldMap = 4096
 )
 
-func validateFieldSizes(msg interface{}) error {
-	rv := reflect.ValueOf(msg).Elem()
-	tv := rv.Type()
-	nf := tv.NumField()
-	for i := 0; i < nf; i++ {
-		f := rv.Field(i)
-		switch f.Kind() {
-		case reflect.String:
-			if l := f.Len(); l > maxFieldString {
-				return status.Errorf(
-					codes.InvalidArgument,
-					"exceeds size limit: %s: max=%d, size=%d",
-					tv.Field(i).Name, maxFieldString, l)
-			}
-		case reflect.Map:
-			if f.Len() == 0 {
+// validateFieldSizes recursively validates the sizes of the string and map
+// fields of the provided message, including the fields of nested messages,
+// repeated fields, and oneof fields. Violations are reported with the
+// full path of the field, ex. Volume.VolumeContext[foo].
+func (s *interceptor) validateFieldSizes(msg interface{}, v *violations) {
+	s.validateFieldSizesOf(reflect.ValueOf(msg), "", v)
+}
+
+func (s *interceptor) validateFieldSizesOf(
+	rv reflect.Value, path string, v *violations) {
+
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !rv.IsNil() {
+			s.validateFieldSizesOf(rv.Elem(), path, v)
+		}
+	case reflect.Struct:
+		tv := rv.Type()
+		for i := 0; i < tv.NumField(); i++ {
+			tf := tv.Field(i)
+
+			// Skip the protobuf bookkeeping fields and unexported fields.
+			if tf.PkgPath != "" || strings.HasPrefix(tf.Name, "XXX_") {
 				continue
 			}
-			size := 0
-			for _, k := range f.MapKeys() {
-				if k.Kind() == reflect.String {
-					kl := k.Len()
-					if kl > maxFieldString {
-						return status.Errorf(
-							codes.InvalidArgument,
-							"exceeds size limit: %s[%s]: max=%d, size=%d",
-							tv.Field(i).Name, k.String(), maxFieldString, kl)
-					}
-					size = size + kl
-				}
-				if v := f.MapIndex(k); v.Kind() == reflect.String {
-					vl := v.Len()
-					if vl > maxFieldString {
-						return status.Errorf(
-							codes.InvalidArgument,
-							"exceeds size limit: %s[%s]=: max=%d, size=%d",
-							tv.Field(i).Name, k.String(), maxFieldString, vl)
-					}
-					size = size + vl
-				}
-			}
-			if size > maxFieldMap {
-				return status.Errorf(
-					codes.InvalidArgument,
-					"exceeds size limit: %s: max=%d, size=%d",
-					tv.Field(i).Name, maxFieldMap, size)
-			}
+			s.validateFieldSizesOf(rv.Field(i), joinPath(path, tf.Name), v)
 		}
+	case reflect.String:
+		s.validateStringSize(path, false, rv.String(), v)
+	case reflect.Slice:
+		// Byte slices are not strings and have no size limit.
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < rv.Len(); i++ {
+			s.validateFieldSizesOf(
+				rv.Index(i), fmt.Sprintf("%s[%d]", path, i), v)
+		}
+	case reflect.Map:
+		s.validateMapSize(rv, path, v)
 	}
-	return nil
+}
+
+func (s *interceptor) validateMapSize(
+	rv reflect.Value, path string, v *violations) {
+
+	if rv.Len() == 0 {
+		return
+	}
+	size := 0
+	for _, k := range rv.MapKeys() {
+		var ks string
+		if k.Kind() == reflect.String {
+			ks = k.String()
+			size = size + s.validateStringSize(
+				fmt.Sprintf("%s[%s]", path, ks), false, ks, v)
+		}
+		if e := rv.MapIndex(k); e.Kind() == reflect.String {
+			size = size + s.validateStringSize(
+				fmt.Sprintf("%s[%s]", path, ks), true, e.String(), v)
+		} else {
+			s.validateFieldSizesOf(e, fmt.Sprintf("%s[%s]", path, ks), v)
+		}
+	}
+	if max := s.maxFieldMap(); size > max {
+		v.addf("exceeds size limit", path, "max=%d, size=%d", max, size)
+	}
+}
+
+// validateStringSize returns the size of the string and records a
+// violation if the string exceeds the size limit. The mapValue flag
+// indicates the string is the value of the map entry identified by path.
+func (s *interceptor) validateStringSize(
+	path string, mapValue bool, str string, v *violations) int {
+
+	// Protobuf strings must be valid UTF-8.
+	if !utf8.ValidString(str) {
+		*v = append(*v, violation{
+			kind:     "invalid UTF-8",
+			field:    path,
+			mapValue: mapValue,
+		})
+	}
+
+	// The size of a string is the number of bytes in its encoding, as
+	// defined by the spec.
+	l := len(str)
+	if max := s.maxFieldString(); l > max {
+		*v = append(*v, violation{
+			kind:     "exceeds size limit",
+			field:    path,
+			detail:   fmt.Sprintf("max=%d, size=%d", max, l),
+			mapValue: mapValue,
+		})
+	}
+	return l
+}
+
+func (s *interceptor) maxFieldString() int {
+	if s.opts.maxFieldString > 0 {
+		return s.opts.maxFieldString
+	}
+	return DefaultMaxFieldString
+}
+
+func (s *interceptor) maxFieldMap() int {
+	if s.opts.maxFieldMap > 0 {
+		return s.opts.maxFieldMap
+	}
+	return DefaultMaxFieldMap
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
 }
@@ -0,0 +1,159 @@
+package specvalidator
+
+import (
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rexray/gocsi/utils"
+)
+
+// generalErrCodes are the codes any RPC may return. They include the
+// codes for the general error conditions defined by the CSI specification
+// as well as the codes produced by gRPC itself, ex. ResourceExhausted when
+// a message is too large.
+var generalErrCodes = []codes.Code{
+	codes.Canceled,
+	codes.Unknown,
+	codes.InvalidArgument,
+	codes.DeadlineExceeded,
+	codes.PermissionDenied,
+	codes.ResourceExhausted,
+	codes.Aborted,
+	codes.Unimplemented,
+	codes.Internal,
+	codes.Unavailable,
+	codes.Unauthenticated,
+}
+
+// methodErrCodes are the codes, in addition to the general codes, that
+// the CSI specification defines for each RPC.
+var methodErrCodes = map[string][]codes.Code{
+	// Controller Service
+	"CreateVolume": {
+		codes.AlreadyExists,
+		codes.NotFound,
+		codes.OutOfRange,
+		codes.ResourceExhausted,
+	},
+	"DeleteVolume": {
+		codes.FailedPrecondition,
+	},
+	"ControllerPublishVolume": {
+		codes.AlreadyExists,
+		codes.FailedPrecondition,
+		codes.NotFound,
+		codes.ResourceExhausted,
+	},
+	"ControllerUnpublishVolume": {
+		codes.NotFound,
+	},
+	"ValidateVolumeCapabilities": {
+		codes.NotFound,
+	},
+	"ListVolumes":               nil,
+	"GetCapacity":               nil,
+	"ControllerGetCapabilities": nil,
+	"CreateSnapshot": {
+		codes.AlreadyExists,
+		codes.ResourceExhausted,
+	},
+	"DeleteSnapshot": {
+		codes.FailedPrecondition,
+	},
+	"ListSnapshots": nil,
+	"ControllerExpandVolume": {
+		codes.FailedPrecondition,
+		codes.NotFound,
+		codes.OutOfRange,
+	},
+
+	// Identity Service
+	"GetPluginInfo":         nil,
+	"GetPluginCapabilities": nil,
+	"Probe": {
+		codes.FailedPrecondition,
+	},
+
+	// Node Service
+	"NodeStageVolume": {
+		codes.AlreadyExists,
+		codes.FailedPrecondition,
+		codes.NotFound,
+	},
+	"NodeUnstageVolume": {
+		codes.NotFound,
+	},
+	"NodePublishVolume": {
+		codes.AlreadyExists,
+		codes.FailedPrecondition,
+		codes.NotFound,
+	},
+	"NodeUnpublishVolume": {
+		codes.NotFound,
+	},
+	"NodeGetVolumeStats": {
+		codes.NotFound,
+	},
+	"NodeExpandVolume": {
+		codes.FailedPrecondition,
+		codes.NotFound,
+		codes.OutOfRange,
+	},
+	"NodeGetCapabilities": nil,
+	"NodeGetInfo":         nil,
+}
+
+// isAllowedErrCode returns a flag indicating whether or not the CSI
+// specification permits the method to return the code. Codes returned
+// by unknown methods are always allowed.
+func isAllowedErrCode(methodName string, code codes.Code) bool {
+	allowed, ok := methodErrCodes[methodName]
+	if !ok {
+		return true
+	}
+	for _, c := range generalErrCodes {
+		if c == code {
+			return true
+		}
+	}
+	for _, c := range allowed {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// validateErrorCode validates the code of an error returned by a handler
+// against the codes the CSI specification permits the method to return.
+// Violations are logged and counted. If the remap option is enabled, and
+// audit mode is not, the error is replaced with an error with a code of
+// Internal, otherwise the error is returned as-is.
+func (s *interceptor) validateErrorCode(method string, err error) error {
+	_, _, methodName, perr := utils.ParseMethod(method)
+	if perr != nil {
+		return err
+	}
+
+	code := status.Code(err)
+	if isAllowedErrCode(methodName, code) {
+		return err
+	}
+
+	count := s.stats.addErrCodeViolation()
+	log.WithFields(map[string]interface{}{
+		"method": methodName,
+		"code":   code,
+		"error":  err,
+		"count":  count,
+	}).Warn("error code not permitted by the CSI specification")
+
+	// Errors are never remapped in audit mode.
+	if !s.opts.remapErrCodes || s.opts.audit {
+		return err
+	}
+	return status.Errorf(
+		codes.Internal,
+		"invalid: error code: %s: %s", code, status.Convert(err).Message())
+}
@@ -0,0 +1,150 @@
+package specvalidator
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/rexray/gocsi/utils"
+)
+
+// crossValidate validates that a response honors the request that
+// produced it.
+func crossValidate(req, rep interface{}) error {
+	switch trep := rep.(type) {
+	case *csi.CreateVolumeResponse:
+		if treq, ok := req.(*csi.CreateVolumeRequest); ok {
+			return crossValidateCreateVolume(treq, trep)
+		}
+	case *csi.ControllerExpandVolumeResponse:
+		if treq, ok := req.(*csi.ControllerExpandVolumeRequest); ok {
+			return crossValidateControllerExpandVolume(treq, trep)
+		}
+	case *csi.CreateSnapshotResponse:
+		if treq, ok := req.(*csi.CreateSnapshotRequest); ok {
+			return crossValidateCreateSnapshot(treq, trep)
+		}
+	case *csi.ListVolumesResponse:
+		if treq, ok := req.(*csi.ListVolumesRequest); ok {
+			return crossValidateListVolumes(treq, trep)
+		}
+	case *csi.ValidateVolumeCapabilitiesResponse:
+		if treq, ok := req.(*csi.ValidateVolumeCapabilitiesRequest); ok {
+			return crossValidateValidateVolumeCapabilities(treq, trep)
+		}
+	}
+	return nil
+}
+
+func crossValidateCreateVolume(
+	req *csi.CreateVolumeRequest,
+	rep *csi.CreateVolumeResponse) error {
+
+	vol := rep.Volume
+	if vol == nil {
+		return nil
+	}
+
+	// A capacity of zero indicates the capacity is unknown.
+	if cr := req.CapacityRange; cr != nil && vol.CapacityBytes > 0 {
+		if rb := cr.RequiredBytes; rb > 0 && vol.CapacityBytes < rb {
+			return status.Errorf(codes.Internal,
+				"invalid: Volume.CapacityBytes=%d: < RequiredBytes=%d",
+				vol.CapacityBytes, rb)
+		}
+		if lb := cr.LimitBytes; lb > 0 && vol.CapacityBytes > lb {
+			return status.Errorf(codes.Internal,
+				"invalid: Volume.CapacityBytes=%d: > LimitBytes=%d",
+				vol.CapacityBytes, lb)
+		}
+	}
+
+	if cs := req.VolumeContentSource; cs != nil {
+		if vol.ContentSource == nil {
+			return status.Error(codes.Internal,
+				"required: Volume.ContentSource")
+		}
+		if !proto.Equal(cs, vol.ContentSource) {
+			return status.Error(codes.Internal,
+				"invalid: Volume.ContentSource: != VolumeContentSource")
+		}
+	}
+
+	return nil
+}
+
+func crossValidateControllerExpandVolume(
+	req *csi.ControllerExpandVolumeRequest,
+	rep *csi.ControllerExpandVolumeResponse) error {
+
+	// Unlike Volume.CapacityBytes, the response's capacity is required,
+	// so a capacity of zero does not indicate the capacity is unknown.
+	cr := req.CapacityRange
+	if cr == nil {
+		return nil
+	}
+	if rb := cr.RequiredBytes; rep.CapacityBytes < rb {
+		return status.Errorf(codes.Internal,
+			"invalid: CapacityBytes=%d: < RequiredBytes=%d",
+			rep.CapacityBytes, rb)
+	}
+	return nil
+}
+
+func crossValidateCreateSnapshot(
+	req *csi.CreateSnapshotRequest,
+	rep *csi.CreateSnapshotResponse) error {
+
+	snap := rep.Snapshot
+	if snap == nil {
+		return nil
+	}
+	if snap.SourceVolumeId != req.SourceVolumeId {
+		return status.Errorf(codes.Internal,
+			"invalid: Snapshot.SourceVolumeId=%s: != SourceVolumeId=%s",
+			snap.SourceVolumeId, req.SourceVolumeId)
+	}
+	return nil
+}
+
+func crossValidateListVolumes(
+	req *csi.ListVolumesRequest,
+	rep *csi.ListVolumesResponse) error {
+
+	if req.MaxEntries > 0 && len(rep.Entries) > int(req.MaxEntries) {
+		return status.Errorf(codes.Internal,
+			"invalid: len(Entries)=%d: > MaxEntries=%d",
+			len(rep.Entries), req.MaxEntries)
+	}
+	return nil
+}
+
+func crossValidateValidateVolumeCapabilities(
+	req *csi.ValidateVolumeCapabilitiesRequest,
+	rep *csi.ValidateVolumeCapabilitiesResponse) error {
+
+	if rep.Confirmed == nil {
+		return nil
+	}
+	for i, c := range rep.Confirmed.VolumeCapabilities {
+		if !containsVolumeCapability(req.VolumeCapabilities, c) {
+			return status.Errorf(codes.Internal,
+				"invalid: Confirmed.VolumeCapabilities[%d]: "+
+					"not in VolumeCapabilities", i)
+		}
+	}
+	return nil
+}
+
+func containsVolumeCapability(
+	list []*csi.VolumeCapability, c *csi.VolumeCapability) bool {
+
+	for _, e := range list {
+		if utils.EqualVolumeCapability(e, c) {
+			return true
+		}
+	}
+	return false
+}
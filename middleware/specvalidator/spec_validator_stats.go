@@ -0,0 +1,78 @@
+package specvalidator
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats counts the spec violations found by the interceptor. A Stats is
+// associated with an interceptor by the WithStats option, or with the
+// spec validator of a gocsi.StoragePlugin by its SpecValidatorStats field.
+type Stats struct {
+	// errCodeViolations and auditViolations are accessed atomically and
+	// must remain the first words of the struct so they are 64-bit
+	// aligned on 32-bit platforms.
+	errCodeViolations uint64
+	auditViolations   uint64
+
+	// audit is the number of violations recorded in audit mode by method
+	// and violation kind and field path.
+	auditL sync.Mutex
+	audit  map[string]map[string]uint64
+}
+
+// WithStats is an Option that associates a Stats with the interceptor.
+func WithStats(s *Stats) Option {
+	return func(o *opts) {
+		o.stats = s
+	}
+}
+
+// ErrCodeViolations returns the number of errors returned by handlers
+// with codes the CSI specification does not permit.
+func (s *Stats) ErrCodeViolations() uint64 {
+	return atomic.LoadUint64(&s.errCodeViolations)
+}
+
+// AuditViolations returns the number of request and response violations
+// recorded in audit mode.
+func (s *Stats) AuditViolations() uint64 {
+	return atomic.LoadUint64(&s.auditViolations)
+}
+
+// AuditViolationsByMethod returns the number of request and response
+// violations recorded in audit mode keyed by method name and violation
+// kind and field path, ex. counts["CreateVolume"]["required: Name"]. The
+// field path omits map keys, list indices, and values, ex. violations of
+// Parameters[a] and Parameters[b] are both counted as "Parameters".
+func (s *Stats) AuditViolationsByMethod() map[string]map[string]uint64 {
+	s.auditL.Lock()
+	defer s.auditL.Unlock()
+	counts := make(map[string]map[string]uint64, len(s.audit))
+	for method, m := range s.audit {
+		counts[method] = make(map[string]uint64, len(m))
+		for violation, n := range m {
+			counts[method][violation] = n
+		}
+	}
+	return counts
+}
+
+func (s *Stats) addErrCodeViolation() uint64 {
+	return atomic.AddUint64(&s.errCodeViolations, 1)
+}
+
+func (s *Stats) addAuditViolation(method, violation string) uint64 {
+	s.auditL.Lock()
+	if s.audit == nil {
+		s.audit = map[string]map[string]uint64{}
+	}
+	m, ok := s.audit[method]
+	if !ok {
+		m = map[string]uint64{}
+		s.audit[method] = m
+	}
+	m[violation]++
+	s.auditL.Unlock()
+	return atomic.AddUint64(&s.auditViolations, 1)
+}
@@ -0,0 +1,673 @@
+package specvalidator
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validate sends the request through the spec validator and returns the
+// validation error.
+func validate(
+	i *interceptor,
+	method string,
+	req, rep interface{}) error {
+
+	_, err := i.handleServer(
+		context.Background(),
+		req,
+		&grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return rep, nil
+		})
+	return err
+}
+
+func TestFieldSize(t *testing.T) {
+	// "é" is one character encoded as two bytes.
+	tests := []struct {
+		name  string
+		id    string
+		valid bool
+		msg   string
+	}{
+		{
+			name:  "bytes at limit",
+			id:    strings.Repeat("é", 64),
+			valid: true,
+		},
+		{
+			name: "bytes over limit",
+			id:   strings.Repeat("é", 64) + "a",
+			msg:  "exceeds size limit: VolumeId: max=128, size=129",
+		},
+		{
+			name: "invalid utf-8",
+			id:   "\xff",
+			msg:  "invalid UTF-8: VolumeId",
+		},
+		{
+			name: "invalid utf-8 within valid",
+			id:   "a\xffb",
+			msg:  "invalid UTF-8: VolumeId",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(
+				newSpecValidator(WithRequestValidation()),
+				"/csi.v1.Controller/DeleteVolume",
+				&csi.DeleteVolumeRequest{VolumeId: tt.id},
+				&csi.DeleteVolumeResponse{})
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("err=%v, expected code InvalidArgument", err)
+			}
+			if msg := status.Convert(err).Message(); msg != tt.msg {
+				t.Fatalf("msg=%q, expected %q", msg, tt.msg)
+			}
+		})
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	snap := func(f func(*csi.Snapshot)) *csi.Snapshot {
+		s := &csi.Snapshot{
+			SnapshotId:     "snap-1",
+			SourceVolumeId: "vol-1",
+			CreationTime:   ptypes.TimestampNow(),
+		}
+		if f != nil {
+			f(s)
+		}
+		return s
+	}
+	usage := func(f func(*csi.VolumeUsage)) *csi.VolumeUsage {
+		u := &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES}
+		if f != nil {
+			f(u)
+		}
+		return u
+	}
+	pluginCaps := func(
+		c *csi.PluginCapability) *csi.GetPluginCapabilitiesResponse {
+
+		return &csi.GetPluginCapabilitiesResponse{
+			Capabilities: []*csi.PluginCapability{c},
+		}
+	}
+
+	const (
+		createSnapshot = "/csi.v1.Controller/CreateSnapshot"
+		listSnapshots  = "/csi.v1.Controller/ListSnapshots"
+		getCapacity    = "/csi.v1.Controller/GetCapacity"
+		ctlrExpandVol  = "/csi.v1.Controller/ControllerExpandVolume"
+		nodeExpandVol  = "/csi.v1.Node/NodeExpandVolume"
+		nodeVolStats   = "/csi.v1.Node/NodeGetVolumeStats"
+		getPluginCaps  = "/csi.v1.Identity/GetPluginCapabilities"
+		volPath        = "/mnt/vol-1"
+	)
+	var (
+		createSnapshotReq = &csi.CreateSnapshotRequest{
+			SourceVolumeId: "vol-1",
+			Name:           "snap-1",
+		}
+		expandReq = &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1"}
+		statsReq  = &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "vol-1",
+			VolumePath: volPath,
+		}
+	)
+
+	tests := []struct {
+		name   string
+		method string
+		req    interface{}
+		rep    interface{}
+		msg    string
+	}{
+		{
+			name:   "CreateSnapshot valid",
+			method: createSnapshot,
+			req:    createSnapshotReq,
+			rep:    &csi.CreateSnapshotResponse{Snapshot: snap(nil)},
+		},
+		{
+			name:   "CreateSnapshot nil snapshot",
+			method: createSnapshot,
+			req:    createSnapshotReq,
+			rep:    &csi.CreateSnapshotResponse{},
+			msg:    "nil: Snapshot",
+		},
+		{
+			name:   "CreateSnapshot missing ID",
+			method: createSnapshot,
+			req:    createSnapshotReq,
+			rep: &csi.CreateSnapshotResponse{Snapshot: snap(
+				func(s *csi.Snapshot) { s.SnapshotId = "" })},
+			msg: "empty: Snapshot.SnapshotId",
+		},
+		{
+			name:   "CreateSnapshot missing source volume ID",
+			method: createSnapshot,
+			req:    createSnapshotReq,
+			rep: &csi.CreateSnapshotResponse{Snapshot: snap(
+				func(s *csi.Snapshot) { s.SourceVolumeId = "" })},
+			msg: "empty: Snapshot.SourceVolumeId",
+		},
+		{
+			name:   "CreateSnapshot missing creation time",
+			method: createSnapshot,
+			req:    createSnapshotReq,
+			rep: &csi.CreateSnapshotResponse{Snapshot: snap(
+				func(s *csi.Snapshot) { s.CreationTime = nil })},
+			msg: "nil: Snapshot.CreationTime",
+		},
+		{
+			name:   "CreateSnapshot negative size",
+			method: createSnapshot,
+			req:    createSnapshotReq,
+			rep: &csi.CreateSnapshotResponse{Snapshot: snap(
+				func(s *csi.Snapshot) { s.SizeBytes = -1 })},
+			msg: "negative: Snapshot.SizeBytes=-1",
+		},
+		{
+			name:   "ListSnapshots valid",
+			method: listSnapshots,
+			req:    &csi.ListSnapshotsRequest{},
+			rep: &csi.ListSnapshotsResponse{
+				Entries: []*csi.ListSnapshotsResponse_Entry{
+					{Snapshot: snap(nil)},
+				},
+			},
+		},
+		{
+			name:   "ListSnapshots missing creation time",
+			method: listSnapshots,
+			req:    &csi.ListSnapshotsRequest{},
+			rep: &csi.ListSnapshotsResponse{
+				Entries: []*csi.ListSnapshotsResponse_Entry{
+					{Snapshot: snap(nil)},
+					{Snapshot: snap(
+						func(s *csi.Snapshot) { s.CreationTime = nil })},
+				},
+			},
+			msg: "nil: Entries[1].Snapshot.CreationTime",
+		},
+		{
+			name:   "ListSnapshots negative size",
+			method: listSnapshots,
+			req:    &csi.ListSnapshotsRequest{},
+			rep: &csi.ListSnapshotsResponse{
+				Entries: []*csi.ListSnapshotsResponse_Entry{
+					{Snapshot: snap(
+						func(s *csi.Snapshot) { s.SizeBytes = -2 })},
+				},
+			},
+			msg: "negative: Entries[0].Snapshot.SizeBytes=-2",
+		},
+		{
+			name:   "GetCapacity valid",
+			method: getCapacity,
+			req:    &csi.GetCapacityRequest{},
+			rep:    &csi.GetCapacityResponse{},
+		},
+		{
+			name:   "GetCapacity negative",
+			method: getCapacity,
+			req:    &csi.GetCapacityRequest{},
+			rep:    &csi.GetCapacityResponse{AvailableCapacity: -1},
+			msg:    "negative: AvailableCapacity=-1",
+		},
+		{
+			name:   "ControllerExpandVolume negative",
+			method: ctlrExpandVol,
+			req:    expandReq,
+			rep:    &csi.ControllerExpandVolumeResponse{CapacityBytes: -1},
+			msg:    "negative: CapacityBytes=-1",
+		},
+		{
+			name:   "NodeExpandVolume negative",
+			method: nodeExpandVol,
+			req: &csi.NodeExpandVolumeRequest{
+				VolumeId:   "vol-1",
+				VolumePath: volPath,
+			},
+			rep: &csi.NodeExpandVolumeResponse{CapacityBytes: -1},
+			msg: "negative: CapacityBytes=-1",
+		},
+		{
+			name:   "NodeGetVolumeStats valid",
+			method: nodeVolStats,
+			req:    statsReq,
+			rep: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{usage(nil)},
+			},
+		},
+		{
+			name:   "NodeGetVolumeStats missing unit",
+			method: nodeVolStats,
+			req:    statsReq,
+			rep: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{usage(
+					func(u *csi.VolumeUsage) { u.Unit = csi.VolumeUsage_UNKNOWN })},
+			},
+			msg: "invalid: Usage[0].Unit=UNKNOWN",
+		},
+		{
+			name:   "NodeGetVolumeStats negative available",
+			method: nodeVolStats,
+			req:    statsReq,
+			rep: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{usage(
+					func(u *csi.VolumeUsage) { u.Available = -1 })},
+			},
+			msg: "negative: Usage[0].Available=-1",
+		},
+		{
+			name:   "NodeGetVolumeStats negative total",
+			method: nodeVolStats,
+			req:    statsReq,
+			rep: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{usage(
+					func(u *csi.VolumeUsage) { u.Total = -1 })},
+			},
+			msg: "negative: Usage[0].Total=-1",
+		},
+		{
+			name:   "NodeGetVolumeStats negative used",
+			method: nodeVolStats,
+			req:    statsReq,
+			rep: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{usage(
+					func(u *csi.VolumeUsage) { u.Used = -1 })},
+			},
+			msg: "negative: Usage[0].Used=-1",
+		},
+		{
+			name:   "GetPluginCapabilities valid",
+			method: getPluginCaps,
+			req:    &csi.GetPluginCapabilitiesRequest{},
+			rep: pluginCaps(&csi.PluginCapability{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			}),
+		},
+		{
+			name:   "GetPluginCapabilities empty capability",
+			method: getPluginCaps,
+			req:    &csi.GetPluginCapabilitiesRequest{},
+			rep:    pluginCaps(&csi.PluginCapability{}),
+			msg:    "nil: Capabilities[0].Type",
+		},
+		{
+			name:   "GetPluginCapabilities unknown service",
+			method: getPluginCaps,
+			req:    &csi.GetPluginCapabilitiesRequest{},
+			rep: pluginCaps(&csi.PluginCapability{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{},
+				},
+			}),
+			msg: "invalid: Capabilities[0].Service.Type=UNKNOWN",
+		},
+		{
+			name:   "GetPluginCapabilities unknown volume expansion",
+			method: getPluginCaps,
+			req:    &csi.GetPluginCapabilitiesRequest{},
+			rep: pluginCaps(&csi.PluginCapability{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{},
+				},
+			}),
+			msg: "invalid: Capabilities[0].VolumeExpansion.Type=UNKNOWN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(
+				newSpecValidator(WithResponseValidation()),
+				tt.method, tt.req, tt.rep)
+			if tt.msg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.Internal {
+				t.Fatalf("err=%v, expected code Internal", err)
+			}
+			if msg := status.Convert(err).Message(); msg != tt.msg {
+				t.Fatalf("msg=%q, expected %q", msg, tt.msg)
+			}
+		})
+	}
+}
+
+func TestCrossValidateControllerExpandVolume(t *testing.T) {
+	req := &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "vol-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100},
+	}
+	tests := []struct {
+		name  string
+		bytes int64
+		msg   string
+	}{
+		{
+			name:  "zero",
+			bytes: 0,
+			msg:   "invalid: CapacityBytes=0: < RequiredBytes=100",
+		},
+		{name: "required", bytes: 100},
+		{
+			name:  "less than required",
+			bytes: 99,
+			msg:   "invalid: CapacityBytes=99: < RequiredBytes=100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(
+				newSpecValidator(
+					WithResponseValidation(), WithCrossValidation()),
+				"/csi.v1.Controller/ControllerExpandVolume",
+				req,
+				&csi.ControllerExpandVolumeResponse{CapacityBytes: tt.bytes})
+			if tt.msg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if msg := status.Convert(err).Message(); msg != tt.msg {
+				t.Fatalf("err=%v, expected %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestCrossValidateCreateSnapshot(t *testing.T) {
+	req := &csi.CreateSnapshotRequest{
+		Name:           "snap-1",
+		SourceVolumeId: "vol-1",
+	}
+	tests := []struct {
+		name   string
+		source string
+		msg    string
+	}{
+		{name: "same source", source: "vol-1"},
+		{
+			name:   "other source",
+			source: "4",
+			msg:    "invalid: Snapshot.SourceVolumeId=4: != SourceVolumeId=vol-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(
+				newSpecValidator(
+					WithResponseValidation(), WithCrossValidation()),
+				"/csi.v1.Controller/CreateSnapshot",
+				req,
+				&csi.CreateSnapshotResponse{
+					Snapshot: &csi.Snapshot{
+						SnapshotId:     "12",
+						SourceVolumeId: tt.source,
+						CreationTime:   ptypes.TimestampNow(),
+					},
+				})
+			if tt.msg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if msg := status.Convert(err).Message(); msg != tt.msg {
+				t.Fatalf("err=%v, expected %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestTopologyValidationFunc(t *testing.T) {
+	var (
+		calls       int
+		errNotReady = errors.New("not ready")
+	)
+	i := newSpecValidator(
+		WithRequestValidation(),
+		WithTopologyValidationFunc(func(ctx context.Context) (bool, error) {
+			calls++
+			if calls == 1 {
+				return false, errNotReady
+			}
+			return true, nil
+		}))
+	if calls != 0 {
+		t.Fatalf("calls=%d, expected 0 before the first RPC", calls)
+	}
+
+	req := &csi.CreateVolumeRequest{
+		Name: "v",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{
+				Segments: map[string]string{"zone": ""},
+			}},
+		},
+	}
+	validateCreateVolume := func() error {
+		return validate(i, "/csi.v1.Controller/CreateVolume",
+			req, &csi.CreateVolumeResponse{})
+	}
+
+	// The topology is not validated until the func succeeds.
+	if err := validateCreateVolume(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := "empty: AccessibilityRequirements.Requisite[0].Segments[zone]"
+	for n := 0; n < 2; n++ {
+		err := validateCreateVolume()
+		if msg := status.Convert(err).Message(); msg != exp {
+			t.Fatalf("err=%v, expected %q", err, exp)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("calls=%d, expected 2", calls)
+	}
+}
+
+func TestTopologyValidationFunc_Unlocked(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+	)
+	i := newSpecValidator(
+		WithRequestValidation(),
+		WithTopologyValidationFunc(func(ctx context.Context) (bool, error) {
+			close(entered)
+			<-release
+			return true, nil
+		}))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- validate(i, "/csi.v1.Identity/Probe",
+			&csi.ProbeRequest{}, &csi.ProbeResponse{})
+	}()
+	<-entered
+
+	// Other RPCs read the topology flag while the func is running.
+	read := make(chan bool, 1)
+	go func() { read <- i.validateTopology() }()
+	select {
+	case ok := <-read:
+		if ok {
+			t.Fatal("topology validated before the func returned")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("topology lock held while the func is running")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !i.validateTopology() {
+		t.Fatal("topology not validated after the func returned")
+	}
+}
+
+func TestStats_ErrCodeViolations(t *testing.T) {
+	var stats Stats
+	i := newSpecValidator(WithResponseValidation(), WithStats(&stats))
+
+	invoke := func(err error) error {
+		_, err = i.handleServer(
+			context.Background(),
+			&csi.DeleteVolumeRequest{VolumeId: "v"},
+			&grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, err
+			})
+		return err
+	}
+
+	// FailedPrecondition is permitted, as is ResourceExhausted, which gRPC
+	// returns for messages that are too large. NotFound is not permitted
+	// since DeleteVolume must be idempotent.
+	invoke(status.Error(codes.FailedPrecondition, "in use"))
+	invoke(status.Error(codes.ResourceExhausted, "message too large"))
+	if n := stats.ErrCodeViolations(); n != 0 {
+		t.Fatalf("violations=%d, expected 0", n)
+	}
+	for n := uint64(1); n <= 2; n++ {
+		err := invoke(status.Error(codes.NotFound, "not found"))
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("err=%v, expected code NotFound", err)
+		}
+		if v := stats.ErrCodeViolations(); v != n {
+			t.Fatalf("violations=%d, expected %d", v, n)
+		}
+	}
+}
+
+func TestStats_AuditViolations(t *testing.T) {
+	var stats Stats
+	i := newSpecValidator(
+		WithRequestValidation(),
+		WithResponseValidation(),
+		WithAuditMode(),
+		WithStats(&stats))
+
+	// The request and the response are passed through unchanged.
+	for n := 0; n < 2; n++ {
+		req := &csi.DeleteVolumeRequest{}
+		_, err := i.handleServer(
+			context.Background(),
+			req,
+			&grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"},
+			func(ctx context.Context, r interface{}) (interface{}, error) {
+				if r != req {
+					t.Fatal("request modified")
+				}
+				return nil, nil
+			})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if n := stats.AuditViolations(); n != 4 {
+		t.Fatalf("violations=%d, expected 4", n)
+	}
+	exp := map[string]map[string]uint64{
+		"DeleteVolume": {
+			"required: VolumeID": 2,
+			"nil response":       2,
+		},
+	}
+	if got := stats.AuditViolationsByMethod(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("violations=%v, expected %v", got, exp)
+	}
+}
+
+func TestStats_AuditViolationsBounded(t *testing.T) {
+	var stats Stats
+	i := newSpecValidator(WithAuditMode(), WithStats(&stats))
+
+	// Violations that differ only in request-specific data are counted
+	// under the same key.
+	for n := 0; n < 100; n++ {
+		i.auditViolation(
+			context.Background(),
+			"/csi.v1.Controller/CreateVolume",
+			"request",
+			status.Errorf(codes.InvalidArgument,
+				"exceeds size limit: Parameters[key%d]: max=128, size=%d",
+				n, 129+n))
+	}
+
+	exp := map[string]map[string]uint64{
+		"CreateVolume": {"exceeds size limit: Parameters": 100},
+	}
+	if got := stats.AuditViolationsByMethod(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("violations=%v, expected %v", got, exp)
+	}
+}
+
+func TestAuditKey(t *testing.T) {
+	tests := []struct {
+		violation string
+		exp       string
+	}{
+		{"nil response", "nil response"},
+		{"required: Name", "required: Name"},
+		{"non-nil, empty: Capabilities", "non-nil, empty: Capabilities"},
+		{"empty: Snapshot.SnapshotId", "empty: Snapshot.SnapshotId"},
+		{"negative: CapacityBytes=-1", "negative: CapacityBytes"},
+		{
+			"invalid: Volume.CapacityBytes=99: < RequiredBytes=100",
+			"invalid: Volume.CapacityBytes",
+		},
+		{
+			"empty: AccessibilityRequirements.Requisite[0].Segments[zone]",
+			"empty: AccessibilityRequirements.Requisite",
+		},
+		{
+			"required: Name; required: VolumeCapabilities",
+			"required: Name",
+		},
+	}
+	for _, tt := range tests {
+		if got := auditKey(tt.violation); got != tt.exp {
+			t.Errorf("auditKey(%q)=%q, expected %q", tt.violation, got, tt.exp)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package specvalidator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+var (
+	// topologyKeyNameRX matches the name of a topology segment key. The
+	// name must be 63 characters or less, begin and end with an
+	// alphanumeric character, and contain only dashes, underscores, dots,
+	// or alphanumerics in between.
+	topologyKeyNameRX = regexp.MustCompile(
+		`^[a-zA-Z0-9]([-_.a-zA-Z0-9]{0,61}[a-zA-Z0-9])?$`)
+
+	// topologyKeyPrefixRX matches the optional prefix of a topology segment
+	// key. The prefix must be 63 characters or less, begin and end with a
+	// lower-case alphanumeric character, contain only dashes, dots, or
+	// lower-case alphanumerics in between, and follow domain name notation.
+	topologyKeyPrefixRX = regexp.MustCompile(
+		`^[a-z0-9]([-.a-z0-9]{0,61}[a-z0-9])?$`)
+)
+
+func validateCreateVolumeAccessibilityRequirements(
+	req *csi.TopologyRequirement, v *violations) {
+
+	if req == nil {
+		return
+	}
+
+	for i, t := range req.Requisite {
+		validateTopology(
+			t, fmt.Sprintf("AccessibilityRequirements.Requisite[%d]", i), v)
+	}
+
+	for i, t := range req.Preferred {
+		path := fmt.Sprintf("AccessibilityRequirements.Preferred[%d]", i)
+		validateTopology(t, path, v)
+
+		// If the requisite topologies are specified then all of the
+		// preferred topologies must also be in the requisite list.
+		if len(req.Requisite) > 0 && !containsTopology(req.Requisite, t) {
+			v.add("invalid", path,
+				"not in AccessibilityRequirements.Requisite")
+		}
+	}
+}
+
+// validateAccessibleTopology validates a list of topologies returned
+// by the SP, ex. Volume.AccessibleTopology.
+func validateAccessibleTopology(topology []*csi.Topology, path string) error {
+	var v violations
+	for i, t := range topology {
+		validateTopology(t, fmt.Sprintf("%s[%d]", path, i), &v)
+	}
+	return v.err(codes.Internal, false)
+}
+
+// validateRequisiteTopology validates that a created volume is accessible
+// from at least one of the requisite topologies. A volume with no
+// accessible topology is accessible equally from all nodes.
+func validateRequisiteTopology(
+	req *csi.TopologyRequirement, vol *csi.Volume) error {
+
+	if req == nil || len(req.Requisite) == 0 ||
+		len(vol.AccessibleTopology) == 0 {
+		return nil
+	}
+
+	// A volume that is accessible from a topology is also accessible from
+	// all topologies that contain the same segments, ex. a volume
+	// accessible from {zone: a} is accessible from {zone: a, rack: 1}.
+	for _, t := range vol.AccessibleTopology {
+		for _, r := range req.Requisite {
+			if isTopologySubset(t, r) {
+				return nil
+			}
+		}
+	}
+
+	return status.Error(
+		codes.Internal,
+		"invalid: Volume.AccessibleTopology: "+
+			"does not satisfy AccessibilityRequirements.Requisite")
+}
+
+func validateTopology(t *csi.Topology, path string, v *violations) {
+	if t == nil {
+		v.add("nil", path, "")
+		return
+	}
+	if len(t.Segments) == 0 {
+		v.add("empty", path+".Segments", "")
+		return
+	}
+	for k, sv := range t.Segments {
+		field := fmt.Sprintf("%s.Segments[%s]", path, k)
+		if !isValidTopologyKey(k) {
+			v.add("invalid", field, "key format")
+		}
+		if sv == "" {
+			v.add("empty", field, "")
+		}
+	}
+}
+
+// isValidTopologyKey returns a flag indicating whether or not the key
+// has the format "[prefix/]name" as defined by the CSI specification.
+func isValidTopologyKey(k string) bool {
+	name := k
+	if i := strings.IndexByte(k, '/'); i >= 0 {
+		if !topologyKeyPrefixRX.MatchString(k[:i]) {
+			return false
+		}
+		name = k[i+1:]
+	}
+	return topologyKeyNameRX.MatchString(name)
+}
+
+func containsTopology(list []*csi.Topology, t *csi.Topology) bool {
+	for _, e := range list {
+		if e != nil && isTopologySubset(e, t) && isTopologySubset(t, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTopologySubset returns a flag indicating whether or not all of the
+// segments of a are also segments of b.
+func isTopologySubset(a, b *csi.Topology) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	for k, v := range a.Segments {
+		if bv, ok := b.Segments[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
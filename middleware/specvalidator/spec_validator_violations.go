@@ -0,0 +1,93 @@
+package specvalidator
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// violation is a single spec violation, ex. "required: VolumeID".
+type violation struct {
+	kind   string
+	field  string
+	detail string
+
+	// mapValue indicates the violation applies to the value of the map
+	// entry identified by field instead of its key.
+	mapValue bool
+}
+
+// String returns the violation in the form "kind: field[=][: detail]".
+func (v violation) String() string {
+	field := v.field
+	if v.mapValue {
+		field = field + "="
+	}
+	if v.detail == "" {
+		return fmt.Sprintf("%s: %s", v.kind, field)
+	}
+	return fmt.Sprintf("%s: %s: %s", v.kind, field, v.detail)
+}
+
+// description returns the violation without the field path.
+func (v violation) description() string {
+	kind := v.kind
+	if v.mapValue {
+		kind = kind + ": value"
+	}
+	if v.detail == "" {
+		return kind
+	}
+	return fmt.Sprintf("%s: %s", kind, v.detail)
+}
+
+// violations collects the spec violations found while validating a
+// message.
+type violations []violation
+
+func (v *violations) add(kind, field, detail string) {
+	*v = append(*v, violation{kind: kind, field: field, detail: detail})
+}
+
+func (v *violations) addf(kind, field, format string, args ...interface{}) {
+	v.add(kind, field, fmt.Sprintf(format, args...))
+}
+
+func (v *violations) required(field string) {
+	v.add("required", field, "")
+}
+
+// err returns nil if there are no violations. Otherwise a gRPC status
+// error with the provided code is returned. If aggregate is false the
+// error describes only the first violation. If aggregate is true the
+// error describes all of the violations, and each violation is included
+// in the status details as a google.rpc.BadRequest field violation.
+func (v violations) err(code codes.Code, aggregate bool) error {
+	if len(v) == 0 {
+		return nil
+	}
+	if !aggregate {
+		return status.Error(code, v[0].String())
+	}
+
+	msgs := make([]string, len(v))
+	details := &errdetails.BadRequest{
+		FieldViolations: make([]*errdetails.BadRequest_FieldViolation, len(v)),
+	}
+	for i, e := range v {
+		msgs[i] = e.String()
+		details.FieldViolations[i] = &errdetails.BadRequest_FieldViolation{
+			Field:       e.field,
+			Description: e.description(),
+		}
+	}
+
+	st := status.New(code, strings.Join(msgs, "; "))
+	if std, err := st.WithDetails(details); err == nil {
+		st = std
+	}
+	return st.Err()
+}
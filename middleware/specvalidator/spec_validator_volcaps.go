@@ -0,0 +1,130 @@
+package specvalidator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/rexray/gocsi/utils"
+)
+
+// VolumeCapabilitySupport describes the volume capabilities supported by
+// an SP. Empty fields do not restrict the corresponding part of a volume
+// capability.
+type VolumeCapabilitySupport struct {
+	// AccessModes is a list of the supported access modes.
+	AccessModes []csi.VolumeCapability_AccessMode_Mode
+
+	// Block and Mount indicate whether or not the eponymous access types
+	// are supported. If both are false then all access types are supported.
+	Block bool
+	Mount bool
+
+	// FsTypes is a list of the supported filesystem types. A mount
+	// capability without a filesystem type, which requests the SP's
+	// default filesystem type, is always supported.
+	FsTypes []string
+
+	// MountFlags is a list of the allowed mount flags. A flag with a value,
+	// ex. "uid=1000", is allowed if its name, ex. "uid", is in the list.
+	MountFlags []string
+}
+
+// capabilities returns the volume capabilities, without mount flags,
+// that are supported and that have the same access mode, access type,
+// and filesystem type as the provided volume capability where those
+// parts of a volume capability are not restricted.
+func (vcs *VolumeCapabilitySupport) capabilities(
+	volCap *csi.VolumeCapability) []*csi.VolumeCapability {
+
+	modes := vcs.AccessModes
+	if len(modes) == 0 {
+		modes = []csi.VolumeCapability_AccessMode_Mode{
+			volCap.GetAccessMode().GetMode(),
+		}
+	}
+
+	// An empty filesystem type requests the SP's default filesystem type
+	// and is always supported.
+	fsTypes := vcs.FsTypes
+	if fsType := volCap.GetMount().GetFsType(); len(fsTypes) == 0 ||
+		fsType == "" {
+		fsTypes = []string{fsType}
+	}
+
+	allTypes := !vcs.Block && !vcs.Mount
+
+	var caps []*csi.VolumeCapability
+	for _, m := range modes {
+		if allTypes || vcs.Block {
+			caps = append(caps, utils.NewBlockCapability(m))
+		}
+		if allTypes || vcs.Mount {
+			for _, fs := range fsTypes {
+				caps = append(caps, utils.NewMountCapability(m, fs))
+			}
+		}
+	}
+	return caps
+}
+
+// isMountFlagAllowed returns a flag indicating whether or not the mount
+// flag is in the list of allowed mount flags.
+func (vcs *VolumeCapabilitySupport) isMountFlagAllowed(flag string) bool {
+	if len(vcs.MountFlags) == 0 {
+		return true
+	}
+	name := flag
+	if i := strings.IndexByte(flag, '='); i >= 0 {
+		name = flag[:i]
+	}
+	for _, f := range vcs.MountFlags {
+		if f == flag || f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSupportedVolumeCapability records a violation if the volume
+// capability is not supported by the SP. The path argument is the volume
+// capability's location in the request.
+func (s *interceptor) validateSupportedVolumeCapability(
+	volCap *csi.VolumeCapability, path string, v *violations) {
+
+	vcs := s.opts.volCapSupport
+	if vcs == nil || volCap == nil || volCap.AccessMode == nil ||
+		volCap.AccessType == nil {
+		return
+	}
+
+	// Compare the volume capability without its mount flags to the
+	// supported capabilities. The mount flags are validated separately
+	// as they need only be a subset of the allowed mount flags.
+	var flags []string
+	stripped := volCap
+	if m := volCap.GetMount(); m != nil {
+		flags = m.MountFlags
+		stripped = utils.NewMountCapability(volCap.AccessMode.Mode, m.FsType)
+	}
+	ok, _ := utils.IsVolumeCapabilityCompatible(
+		stripped, vcs.capabilities(volCap))
+	if !ok {
+		detail := fmt.Sprintf("mode=%s", volCap.AccessMode.Mode)
+		if m := volCap.GetMount(); m != nil {
+			detail = fmt.Sprintf("%s, mount, fsType=%s", detail, m.FsType)
+		} else {
+			detail = detail + ", block"
+		}
+		v.add("unsupported", path, detail)
+	}
+
+	for i, f := range flags {
+		if !vcs.isMountFlagAllowed(f) {
+			v.add("unsupported",
+				fmt.Sprintf("%s.AccessType.Mount.MountFlags[%d]", path, i),
+				f)
+		}
+	}
+}
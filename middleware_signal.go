@@ -0,0 +1,41 @@
+// +build !windows
+
+package gocsi
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/rexray/gocsi/middleware/serialvolume"
+)
+
+// trapLockTableSignal logs the serial volume access middleware's lock
+// table each time the process receives SIGUSR1. The returned function
+// removes the signal handler.
+func trapLockTableSignal(
+	ctx context.Context, insp *serialvolume.Inspector) func() {
+
+	sigc := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigc, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case s := <-sigc:
+				log.WithField("signal", s).Info(
+					"received signal; logging volume locks")
+				insp.LogLockTable(ctx)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigc)
+		close(done)
+	}
+}
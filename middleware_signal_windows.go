@@ -0,0 +1,14 @@
+package gocsi
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/rexray/gocsi/middleware/serialvolume"
+)
+
+// trapLockTableSignal is a no-op on Windows, which lacks SIGUSR1.
+func trapLockTableSignal(
+	ctx context.Context, insp *serialvolume.Inspector) func() {
+
+	return func() {}
+}
@@ -39,6 +39,9 @@ func New() gocsi.StoragePluginProvider {
 			// Enable request and response validation.
 			gocsi.EnvVarSpecValidation + "=true",
 
+			// Validate that responses honor their requests.
+			gocsi.EnvVarSpecCrossValidation + "=true",
+
 			// Treat the following fields as required:
 			//   * ControllerPublishVolumeResponse.PublishContext
 			//   * NodeStageVolumeRequest.PublishContext
@@ -13,6 +13,8 @@ import (
 	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	csictx "github.com/rexray/gocsi/context"
 )
 
 func (s *service) CreateVolume(
@@ -65,7 +67,7 @@ func (s *service) DeleteVolume(
 	copy(s.vols[i:], s.vols[i+1:])
 	s.vols[len(s.vols)-1] = csi.Volume{}
 	s.vols = s.vols[:len(s.vols)-1]
-	log.WithField("volumeID", req.VolumeId).Debug("mock delete volume")
+	csictx.GetLogger(ctx).Debug("mock delete volume")
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -306,7 +308,7 @@ func (s *service) CreateSnapshot(
 	req *csi.CreateSnapshotRequest) (
 	*csi.CreateSnapshotResponse, error) {
 
-	snap := s.newSnapshot(req.Name, tib)
+	snap := s.newSnapshot(req.Name, req.SourceVolumeId, tib)
 	s.snapsRWL.Lock()
 	defer s.snapsRWL.Unlock()
 	s.snaps = append(s.snaps, snap)
@@ -71,12 +71,12 @@ func (s *service) newVolume(name string, capcity int64) csi.Volume {
 	}
 }
 
-func (s *service) newSnapshot(name string, size int64) csi.Snapshot {
+func (s *service) newSnapshot(
+	name, sourceVolumeID string, size int64) csi.Snapshot {
+
 	return csi.Snapshot{
-		// We set the id to "<volume-id>:<snapshot-id>" since during delete requests
-		// we are not given the parent volume id
-		SnapshotId:     "12",
-		SourceVolumeId: "4",
+		SnapshotId:     fmt.Sprintf("%d", atomic.AddUint64(&s.snapsNID, 1)),
+		SourceVolumeId: sourceVolumeID,
 		SizeBytes:      size,
 		CreationTime:   ptypes.TimestampNow(),
 		ReadyToUse:     true,
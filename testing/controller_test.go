@@ -5,13 +5,19 @@ import (
 	"fmt"
 	"math"
 	"path"
+	"regexp"
 	"sync"
 
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
 	"github.com/rexray/gocsi/mock/service"
 	"github.com/rexray/gocsi/utils"
 )
@@ -27,7 +33,6 @@ var _ = Describe("Controller", func() {
 		vol      *csi.Volume
 		snap     *csi.Snapshot
 		volID    string
-		snapID   string
 		volName  string
 		snapName string
 		reqBytes int64
@@ -44,7 +49,6 @@ var _ = Describe("Controller", func() {
 	BeforeEach(func() {
 		ctx = context.Background()
 		volID = "4"
-		snapID = "12"
 		volName = "Test Volume"
 		snapName = "Test Snap"
 		reqBytes = 1.074e+10 //  10GiB
@@ -185,12 +189,47 @@ var _ = Describe("Controller", func() {
 		capBytes, err = expandVolumeWithResult()
 	}
 
+	// validatePending validates the error of an operation that could not
+	// obtain the lock for one of the resources, ex. "VolumeName=v", because
+	// another call to the method held it. If the lock's holders are known
+	// the message describes them, ex. "pending: VolumeName=v: held by ...",
+	// and so do the error's details. Operations that lock a volume by its
+	// ID lock the volume's name first if it is known.
+	validatePending := func(err error, method string, resources ...string) {
+		st := status.Convert(err)
+		Ω(st.Code()).Should(Equal(codes.Aborted))
+
+		details := st.Details()
+		Ω(details).ShouldNot(BeEmpty())
+		ri, ok := details[0].(*errdetails.RetryInfo)
+		Ω(ok).Should(BeTrue())
+		delay, err := ptypes.Duration(ri.RetryDelay)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(delay).Should(BeNumerically(">", 0))
+
+		// The holder is recorded after the lock is obtained, so the
+		// error may not describe it.
+		if st.Message() == "pending" {
+			Ω(details).Should(HaveLen(1))
+			return
+		}
+		Ω(details).Should(HaveLen(2))
+		res, ok := details[1].(*errdetails.ResourceInfo)
+		Ω(ok).Should(BeTrue())
+		Ω(res.ResourceType).Should(Equal("serialvolume.lock"))
+		Ω(resources).Should(ContainElement(res.ResourceName))
+		Ω(st.Message()).Should(MatchRegexp(
+			"^pending: %s: held by method=%s, requestID=\\S+, acquired=",
+			regexp.QuoteMeta(res.ResourceName), method))
+		Ω(st.Message()).Should(HaveSuffix(": held by " + res.Description))
+	}
+
 	validateNewVolumeResult := func(
 		vol *csi.Volume,
 		err error) bool {
 
 		if err != nil {
-			Ω(err).Should(ΣCM(codes.Aborted, "pending"))
+			validatePending(err, "CreateVolume", "VolumeName="+volName)
 			return true
 		}
 
@@ -206,12 +245,13 @@ var _ = Describe("Controller", func() {
 		err error) bool {
 
 		if err != nil {
-			Ω(err).Should(ΣCM(codes.Aborted, "pending"))
+			validatePending(err, "CreateSnapshot",
+				"VolumeName="+volName, "VolumeID="+volID)
 			return true
 		}
 
 		Ω(snap).ShouldNot(BeNil())
-		Ω(snap.SnapshotId).Should(Equal(snapID))
+		Ω(snap.SnapshotId).ShouldNot(BeEmpty())
 		Ω(snap.SourceVolumeId).Should(Equal(volID))
 		return false
 	}
@@ -221,7 +261,8 @@ var _ = Describe("Controller", func() {
 		err error) bool {
 
 		if err != nil {
-			Ω(err).Should(ΣCM(codes.Aborted, "pending"))
+			validatePending(err, "ControllerExpandVolume",
+				"VolumeName="+volName, "VolumeID="+volID)
 			return true
 		}
 
@@ -249,6 +290,25 @@ var _ = Describe("Controller", func() {
 		Context("Normal Create Volume Call", func() {
 			It("Should Be Valid", validateNewSnapshot)
 		})
+		Context("Missing Name", func() {
+			BeforeEach(func() {
+				snapName = ""
+			})
+			It("Should Be Invalid", func() {
+				Ω(snap).Should(BeNil())
+				Ω(err).Should(ΣCM(codes.InvalidArgument, "required: Name"))
+			})
+		})
+		Context("Missing Source Volume ID", func() {
+			BeforeEach(func() {
+				volID = ""
+			})
+			It("Should Be Invalid", func() {
+				Ω(snap).Should(BeNil())
+				Ω(err).Should(ΣCM(
+					codes.InvalidArgument, "required: SourceVolumeID"))
+			})
+		})
 	})
 
 	Describe("CreateVolume", func() {
@@ -311,6 +371,20 @@ var _ = Describe("Controller", func() {
 						"exceeds size limit: Parameters: max=4096, size=6237"))
 				})
 			})
+			Context("Invalid Nested Mount Flag", func() {
+				BeforeEach(func() {
+					mntFlags = []string{string129}
+				})
+				It("Should Be Invalid", func() {
+					Ω(err).Should(HaveOccurred())
+					Ω(vol).Should(BeNil())
+					Ω(err).Should(ΣCM(
+						codes.InvalidArgument,
+						"exceeds size limit: "+
+							"VolumeCapabilities[0].AccessType.Mount.MountFlags[0]: "+
+							"max=128, size=129"))
+				})
+			})
 		})
 		Context("No LimitBytes", func() {
 			BeforeEach(func() {
@@ -333,6 +407,117 @@ var _ = Describe("Controller", func() {
 				Ω(vol).Should(BeNil())
 			})
 		})
+		Context("Aggregated Violations", func() {
+			BeforeEach(func() {
+				ctx = csictx.WithEnviron(ctx, []string{
+					gocsi.EnvVarSpecAggregateViolations + "=true",
+				})
+				volName = ""
+				mntFlags = []string{string129}
+			})
+			It("Should Report Every Violation", func() {
+				Ω(err).Should(HaveOccurred())
+				Ω(vol).Should(BeNil())
+				Ω(err).Should(ΣCM(
+					codes.InvalidArgument,
+					"exceeds size limit: "+
+						"VolumeCapabilities[0].AccessType.Mount.MountFlags[0]: "+
+						"max=128, size=129; required: Name"))
+
+				var fields []*errdetails.BadRequest_FieldViolation
+				for _, d := range status.Convert(err).Details() {
+					if br, ok := d.(*errdetails.BadRequest); ok {
+						fields = append(fields, br.FieldViolations...)
+					}
+				}
+				Ω(fields).Should(HaveLen(2))
+				Ω(fields[0].Field).Should(Equal(
+					"VolumeCapabilities[0].AccessType.Mount.MountFlags[0]"))
+				Ω(fields[0].Description).Should(Equal(
+					"exceeds size limit: max=128, size=129"))
+				Ω(fields[1].Field).Should(Equal("Name"))
+				Ω(fields[1].Description).Should(Equal("required"))
+			})
+		})
+		Context("Unsupported Volume Capability", func() {
+			Context("Fs Type", func() {
+				BeforeEach(func() {
+					ctx = csictx.WithEnviron(ctx, []string{
+						gocsi.EnvVarSupportedFsTypes + "=xfs",
+					})
+				})
+				It("Should Be Invalid", func() {
+					Ω(err).Should(HaveOccurred())
+					Ω(vol).Should(BeNil())
+					Ω(err).Should(ΣCM(
+						codes.InvalidArgument,
+						"unsupported: VolumeCapabilities[0]: "+
+							"mode=UNKNOWN, mount, fsType=ext4"))
+				})
+			})
+			Context("Default Fs Type", func() {
+				BeforeEach(func() {
+					ctx = csictx.WithEnviron(ctx, []string{
+						gocsi.EnvVarSupportedFsTypes + "=xfs",
+					})
+					fsType = ""
+				})
+				It("Should Be Valid", func() {
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(vol).ShouldNot(BeNil())
+					Ω(vol.VolumeContext["name"]).Should(Equal(volName))
+				})
+			})
+			Context("Mount Flag", func() {
+				BeforeEach(func() {
+					ctx = csictx.WithEnviron(ctx, []string{
+						gocsi.EnvVarSupportedMountFlags + "=ro",
+					})
+				})
+				It("Should Be Invalid", func() {
+					Ω(err).Should(HaveOccurred())
+					Ω(vol).Should(BeNil())
+					Ω(err).Should(ΣCM(
+						codes.InvalidArgument,
+						"unsupported: "+
+							"VolumeCapabilities[0].AccessType.Mount.MountFlags[0]: "+
+							"-o noexec"))
+				})
+			})
+		})
+		Context("Cross Validation", func() {
+			Context("Capacity Below RequiredBytes", func() {
+				BeforeEach(func() {
+					// The existing volume's capacity is returned.
+					volName = "Mock Volume 1"
+					reqBytes = expBytes
+					limBytes = 0
+				})
+				It("Should Be Invalid", func() {
+					Ω(err).Should(HaveOccurred())
+					Ω(vol).Should(BeNil())
+					Ω(err).Should(ΣCM(
+						codes.Internal,
+						"invalid: Volume.CapacityBytes=107374182400: "+
+							"< RequiredBytes=1074000000000"))
+				})
+			})
+			Context("Capacity Above LimitBytes", func() {
+				BeforeEach(func() {
+					volName = "Mock Volume 1"
+					reqBytes = 0
+					limBytes = 1.074e+9 // 1GiB
+				})
+				It("Should Be Invalid", func() {
+					Ω(err).Should(HaveOccurred())
+					Ω(vol).Should(BeNil())
+					Ω(err).Should(ΣCM(
+						codes.Internal,
+						"invalid: Volume.CapacityBytes=107374182400: "+
+							"> LimitBytes=1074000000"))
+				})
+			})
+		})
 		Context("Idempotent Create", func() {
 
 			const bucketSize = 250
@@ -722,5 +907,13 @@ var _ = Describe("Controller", func() {
 		Context("ExpandVolume", func() {
 			It("Should be expanded", validateVolumeExpand)
 		})
+		Context("Missing CapacityRange", func() {
+			It("Should Be Invalid", func() {
+				_, err := client.ControllerExpandVolume(
+					ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volID})
+				Ω(err).Should(ΣCM(
+					codes.InvalidArgument, "required: CapacityRange"))
+			})
+		})
 	})
 })
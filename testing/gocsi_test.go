@@ -13,13 +13,19 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/rexray/gocsi"
 	"github.com/rexray/gocsi/mock/provider"
 )
 
 func startMockServer(ctx context.Context) (*grpc.ClientConn, func(), error) {
+	return startServer(ctx, provider.New())
+}
+
+// startServer serves the SP with a piped connection.
+func startServer(
+	ctx context.Context,
+	sp gocsi.StoragePluginProvider) (*grpc.ClientConn, func(), error) {
 
-	// Create a new Mock SP instance and serve it with a piped connection.
-	sp := provider.New()
 	lis, err := memconn.Listen("memu", "csi-test")
 	Ω(err).Should(BeNil())
 	go func() {
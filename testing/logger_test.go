@@ -0,0 +1,86 @@
+package gocsi_test
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/mock/provider"
+)
+
+// loggerController is the mock Controller service, except DeleteVolume
+// records the logger of the request's context.
+type loggerController struct {
+	csi.ControllerServer
+	logger *log.Entry
+}
+
+func (s *loggerController) DeleteVolume(
+	ctx context.Context,
+	req *csi.DeleteVolumeRequest) (
+	*csi.DeleteVolumeResponse, error) {
+
+	s.logger = csictx.GetLogger(ctx)
+	return s.ControllerServer.DeleteVolume(ctx, req)
+}
+
+var _ = Describe("Logger", func() {
+	var (
+		err      error
+		stopMock func()
+		ctx      context.Context
+		gclient  *grpc.ClientConn
+		client   csi.ControllerClient
+		ctrl     *loggerController
+	)
+	BeforeEach(func() {
+		ctx = csictx.WithEnviron(context.Background(), []string{
+			gocsi.EnvVarReqIDInjection + "=true",
+		})
+		sp := provider.New().(*gocsi.StoragePlugin)
+		ctrl = &loggerController{ControllerServer: sp.Controller}
+		sp.Controller = ctrl
+		gclient, stopMock, err = startServer(ctx, sp)
+		Ω(err).ShouldNot(HaveOccurred())
+		client = csi.NewControllerClient(gclient)
+	})
+	AfterEach(func() {
+		ctx = nil
+		gclient.Close()
+		gclient = nil
+		client = nil
+		stopMock()
+	})
+
+	It("Should Carry the Request Fields", func() {
+		ctx := metadata.AppendToOutgoingContext(
+			ctx, csictx.RequestIDKey, "42")
+		_, err := client.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+			VolumeId: "1",
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ctrl.logger).ShouldNot(BeNil())
+		Ω(ctrl.logger.Data).Should(Equal(log.Fields{
+			"method":    "/csi.v1.Controller/DeleteVolume",
+			"requestID": "42",
+			"volumeID":  "1",
+		}))
+	})
+
+	It("Should Carry a Generated Request ID", func() {
+		_, err := client.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+			VolumeId: "1",
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ctrl.logger).ShouldNot(BeNil())
+		Ω(ctrl.logger.Data).Should(HaveKeyWithValue("requestID", "1"))
+		Ω(ctrl.logger.Data).Should(HaveKeyWithValue(
+			"method", "/csi.v1.Controller/DeleteVolume"))
+	})
+})
@@ -0,0 +1,59 @@
+// +build !windows
+
+package gocsi_test
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+)
+
+var _ = Describe("Serial Volume Access Lock Table Signal", func() {
+	var (
+		stopMock func()
+		gclient  *grpc.ClientConn
+		hook     *logtest.Hook
+	)
+	BeforeEach(func() {
+		hook = logtest.NewGlobal()
+		gclient, stopMock, _ = startLockTableServer()
+	})
+	AfterEach(func() {
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		gclient.Close()
+		gclient = nil
+		stopMock()
+	})
+
+	It("Should Log the Lock Table on SIGUSR1", func() {
+		Ω(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).Should(Succeed())
+		Eventually(func() []string {
+			var msgs []string
+			for _, e := range hook.AllEntries() {
+				msgs = append(msgs, e.Message)
+			}
+			return msgs
+		}, 5*time.Second).Should(ContainElement("serialvolume: lock table"))
+	})
+
+	It("Should Remove the Handler When Stopped", func() {
+		// Receive SIGUSR1 here so the process is not terminated once the
+		// handler is removed.
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGUSR1)
+		defer signal.Stop(sigc)
+
+		stopMock()
+		hook.Reset()
+		Ω(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).Should(Succeed())
+		Eventually(sigc, 5*time.Second).Should(Receive())
+		Consistently(func() []*log.Entry {
+			return hook.AllEntries()
+		}, 500*time.Millisecond).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,169 @@
+package gocsi_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/akutz/memconn"
+	"google.golang.org/grpc"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/mock/provider"
+)
+
+// lockTableReport is the part of the serial volume access middleware's
+// lock table report that is validated.
+type lockTableReport struct {
+	Locks         []interface{} `json:"locks"`
+	WaitDurations struct {
+		Count   uint64        `json:"count"`
+		Buckets []interface{} `json:"buckets"`
+	} `json:"waitDurations"`
+	HoldDurations struct {
+		Count   uint64        `json:"count"`
+		Buckets []interface{} `json:"buckets"`
+	} `json:"holdDurations"`
+}
+
+// lockTablePort is the port the lock table is served on. Every test
+// reuses it since the debug endpoint is stopped with the server.
+var lockTablePort string
+
+// startLockTableServer starts the mock server with the serial volume
+// access middleware's lock table served at the provided address without
+// a host, ex. ":6060", and returns the port of the address.
+func startLockTableServer() (*grpc.ClientConn, func(), string) {
+	if lockTablePort == "" {
+		lockTablePort = freePort()
+	}
+	port := lockTablePort
+
+	ctx := csictx.WithEnviron(context.Background(), []string{
+		gocsi.EnvVarSerialVolAccessDebugAddr + "=:" + port,
+	})
+	gclient, stopMock, err := startMockServer(ctx)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	// The endpoint is served once the middleware is initialized.
+	Eventually(func() error {
+		_, err := getLockTable("127.0.0.1", port)
+		return err
+	}, 5*time.Second).Should(Succeed())
+
+	return gclient, stopMock, port
+}
+
+// freePort returns a loopback port that is not in use.
+func freePort() string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Ω(err).ShouldNot(HaveOccurred())
+	defer lis.Close()
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	Ω(err).ShouldNot(HaveOccurred())
+	return port
+}
+
+// getLockTable gets the lock table served at host:port.
+func getLockTable(host, port string) (*lockTableReport, error) {
+	c := &http.Client{Timeout: time.Second}
+	res, err := c.Get("http://" + net.JoinHostPort(host, port) +
+		"/debug/serialvolume/locks")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var rep lockTableReport
+	if err := json.NewDecoder(res.Body).Decode(&rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+var _ = Describe("Serial Volume Access Lock Table", func() {
+	var (
+		stopMock func()
+		gclient  *grpc.ClientConn
+		port     string
+	)
+	BeforeEach(func() {
+		gclient, stopMock, port = startLockTableServer()
+	})
+	AfterEach(func() {
+		gclient.Close()
+		gclient = nil
+		stopMock()
+	})
+
+	It("Should Stop Serving When the Server Stops", func() {
+		stopMock()
+		_, err := getLockTable("127.0.0.1", port)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("Should Report the Lock Durations", func() {
+		rep, err := getLockTable("127.0.0.1", port)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rep.Locks).Should(BeEmpty())
+		Ω(rep.WaitDurations.Count).Should(BeZero())
+		Ω(rep.HoldDurations.Count).Should(BeZero())
+
+		client := csi.NewControllerClient(gclient)
+		_, err = client.DeleteVolume(
+			context.Background(), &csi.DeleteVolumeRequest{VolumeId: "1"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		rep, err = getLockTable("127.0.0.1", port)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rep.Locks).Should(BeEmpty())
+		Ω(rep.WaitDurations.Count).Should(Equal(uint64(1)))
+		Ω(rep.HoldDurations.Count).Should(Equal(uint64(1)))
+		Ω(rep.HoldDurations.Buckets).Should(HaveLen(12))
+	})
+
+	It("Should Be Served Only on the Loopback Interface", func() {
+		addrs, err := net.InterfaceAddrs()
+		Ω(err).ShouldNot(HaveOccurred())
+		var host string
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() &&
+				n.IP.To4() != nil {
+				host = n.IP.String()
+				break
+			}
+		}
+		if host == "" {
+			Skip("no non-loopback interface")
+		}
+		_, err = getLockTable(host, port)
+		Ω(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("Serial Volume Access Lock Table Address", func() {
+	It("Should Fail to Start When the Address Is in Use", func() {
+		used, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer used.Close()
+
+		ctx := csictx.WithEnviron(context.Background(), []string{
+			gocsi.EnvVarSerialVolAccessDebugAddr + "=" +
+				used.Addr().String(),
+		})
+		lis, err := memconn.Listen("memu", "csi-test-lock-table")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer lis.Close()
+
+		sp := provider.New()
+		defer sp.Stop(ctx)
+		err = sp.Serve(ctx, lis)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(
+			"failed to serve volume lock table"))
+	})
+})
@@ -0,0 +1,135 @@
+package gocsi_test
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/middleware/specvalidator"
+	"github.com/rexray/gocsi/mock/provider"
+	"github.com/rexray/gocsi/utils"
+)
+
+// nilRepController is the mock Controller service, except ListSnapshots
+// returns a nil response and DeleteSnapshot returns NotFound, a code the
+// CSI specification does not permit.
+type nilRepController struct {
+	csi.ControllerServer
+}
+
+func (s *nilRepController) DeleteSnapshot(
+	ctx context.Context,
+	req *csi.DeleteSnapshotRequest) (
+	*csi.DeleteSnapshotResponse, error) {
+
+	return nil, status.Error(codes.NotFound, req.SnapshotId)
+}
+
+func (s *nilRepController) ListSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse, error) {
+
+	return nil, nil
+}
+
+var _ = Describe("SpecValidator", func() {
+	var (
+		err      error
+		stopMock func()
+		ctx      context.Context
+		gclient  *grpc.ClientConn
+		client   csi.ControllerClient
+		stats    *specvalidator.Stats
+	)
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+	JustBeforeEach(func() {
+		sp := provider.New().(*gocsi.StoragePlugin)
+		sp.Controller = &nilRepController{sp.Controller}
+		stats = &specvalidator.Stats{}
+		sp.SpecValidatorStats = stats
+		gclient, stopMock, err = startServer(ctx, sp)
+		Ω(err).ShouldNot(HaveOccurred())
+		client = csi.NewControllerClient(gclient)
+	})
+	AfterEach(func() {
+		ctx = nil
+		gclient.Close()
+		gclient = nil
+		client = nil
+		stopMock()
+	})
+
+	createVolume := func(
+		name string, reqBytes int64) (*csi.CreateVolumeResponse, error) {
+
+		return client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: reqBytes,
+			},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				utils.NewMountCapability(0, "ext4"),
+			},
+		})
+	}
+
+	Context("Nil Response", func() {
+		It("Should Be Invalid", func() {
+			rep, err := client.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+			Ω(err).Should(HaveOccurred())
+			Ω(rep).Should(BeNil())
+			Ω(err).Should(ΣCM(codes.Internal, "nil response"))
+		})
+	})
+
+	Context("Error Code Violation", func() {
+		It("Should Be Counted", func() {
+			_, err := client.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{
+				SnapshotId: "1",
+			})
+			Ω(err).Should(ΣCM(codes.NotFound, "1"))
+			Ω(stats.ErrCodeViolations()).Should(BeEquivalentTo(1))
+		})
+	})
+
+	Context("Audit Mode", func() {
+		BeforeEach(func() {
+			ctx = csictx.WithEnviron(ctx, []string{
+				gocsi.EnvVarSpecAudit + "=true",
+			})
+		})
+		It("Should Pass Invalid Request Through", func() {
+			rep, err := createVolume("", 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rep.Volume).ShouldNot(BeNil())
+			Ω(rep.Volume.VolumeContext["name"]).Should(Equal(""))
+			Ω(stats.AuditViolations()).Should(BeEquivalentTo(1))
+		})
+		It("Should Pass Invalid Response Through", func() {
+			// The existing volume's capacity is less than required.
+			rep, err := createVolume("Mock Volume 1", 1.074e+12)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rep.Volume).ShouldNot(BeNil())
+			Ω(rep.Volume.VolumeId).Should(Equal("1"))
+			Ω(rep.Volume.CapacityBytes).Should(BeEquivalentTo(107374182400))
+		})
+		It("Should Pass Nil Response Through", func() {
+			// gRPC fails to marshal the nil response instead of the
+			// validator rejecting it.
+			rep, err := client.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+			Ω(err).Should(HaveOccurred())
+			Ω(rep).Should(BeNil())
+			Ω(status.Code(err)).Should(Equal(codes.Internal))
+			Ω(err).ShouldNot(ΣCM(codes.Internal, "nil response"))
+		})
+	})
+})
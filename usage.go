@@ -101,33 +101,154 @@ GLOBAL OPTIONS
 
         Enabling this option sets X_CSI_REQ_ID_INJECTION=true.
 
+    X_CSI_LOG_REP_STATUS
+        A flag that enables logging the gRPC result code of each response
+        and the time it took to complete the RPC, ex.:
+
+            REP 0001: code=OK, duration=1.2ms
+
+        Only takes effect if Reply logging is enabled.
+
     X_CSI_LOG_DISABLE_VOL_CTX
         A flag that disables the logging of the VolumeContext field.
 
         Only takes effect if Request or Reply logging is enabled.
 
+    X_CSI_LOG_REDACT_KEYS
+        A comma-separated list of regular expressions. The values of map
+        entries with keys that match one of the patterns, ex. entries in
+        Parameters, VolumeContext, or PublishContext, are logged as "***".
+        The other entries remain visible.
+
+        The values of the redacted entries, and of all secrets, are also
+        replaced wherever they appear in logged errors and slow RPC
+        warnings.
+
+        Only takes effect if Request or Reply logging, or the slow RPC
+        warning, is enabled.
+
+    X_CSI_LOG_MAX_LIST_LEN
+        The maximum number of elements logged for each list in a request
+        or response, ex. ListVolumesResponse.Entries. Longer lists are
+        truncated. A value of 0, the default, disables truncation.
+
+        Only takes effect if Request or Reply logging is enabled.
+
+    X_CSI_LOG_AS_JSON
+        A flag that enables logging complete requests and responses as
+        JSON objects instead of lists of their top-level fields. Nested
+        messages are always logged as JSON using their protobuf JSON
+        field names.
+
+        Only takes effect if Request or Reply logging is enabled.
+
+    X_CSI_LOG_SLOW_RPC_THRESHOLD
+        A time.Duration string. RPCs that take longer than this duration to
+        complete are logged at the WARN level with their method, request ID,
+        result code, and duration. The warning is logged even if Reply
+        logging is disabled.
+
+    X_CSI_LOG_EXCLUDE_METHODS
+        A comma-separated list of methods to exclude from request and
+        response logging, ex. methods the CO polls such as:
+
+            Probe,NodeGetCapabilities
+
+        Methods may be specified by name or by full name, ex.
+        /csi.v1.Identity/Probe. Excluded methods are still subject to
+        X_CSI_LOG_SLOW_RPC_THRESHOLD.
+
     X_CSI_REQ_ID_INJECTION
         A flag that enables request ID injection. The ID is parsed from
         the incoming request's metadata with a key of "csi.requestid".
         If no value for that key is found then a new request ID is
-        generated using an atomic sequence counter.
+        generated using an atomic sequence counter. Request IDs may be
+        numbers or strings, ex. UUIDs. The request ID is echoed to the
+        client with the key "csi.requestid" in the response header, or
+        the response trailer if the header was already sent.
+
+    X_CSI_REQ_ID_UPSTREAM_KEY
+        The gRPC metadata key of an upstream ID, ex. a CO's correlation ID,
+        that is adopted as the request ID. The upstream key takes
+        precedence over "csi.requestid".
+
+        Only takes effect if request ID injection is enabled.
 
     X_CSI_SPEC_VALIDATION
         Setting X_CSI_SPEC_VALIDATION=true is the same as:
             X_CSI_SPEC_REQ_VALIDATION=true
             X_CSI_SPEC_REP_VALIDATION=true
 
+    X_CSI_SPEC_AUDIT
+        A flag that enables audit mode. Request and response violations are
+        logged with the method, request ID, and violation, and counted, but
+        the original request or response passes through unchanged. Errors
+        are never remapped in audit mode.
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true and
+        X_CSI_SPEC_REP_VALIDATION=true unless they are set explicitly.
+
     X_CSI_SPEC_REQ_VALIDATION
         A flag that enables the validation of CSI request messages.
+        Topology fields are validated if the SP advertises the
+        VOLUME_ACCESSIBILITY_CONSTRAINTS plug-in capability.
 
     X_CSI_SPEC_REP_VALIDATION
         A flag that enables the validation of CSI response messages.
         Invalid responses are marshalled into a gRPC error with a code
-        of "Internal."
+        of "Internal." The codes of errors returned by RPCs are validated
+        against the codes the CSI specification permits each RPC to
+        return, and violations are logged.
+
+    X_CSI_SPEC_REP_REMAP_ERR_CODES
+        A flag that replaces errors with codes the CSI specification does
+        not permit an RPC to return with errors that have a code of
+        "Internal." Without this option such errors are logged and passed
+        through as-is. Only takes effect if response validation is enabled.
+
+    X_CSI_SPEC_CROSS_VALIDATION
+        A flag that enables validating that CSI responses honor their
+        requests:
+            * CreateVolumeResponse.Volume.CapacityBytes is within the
+              requested CapacityRange
+            * CreateVolumeResponse.Volume.ContentSource echoes the
+              requested VolumeContentSource
+            * ControllerExpandVolumeResponse.CapacityBytes is at least
+              the requested RequiredBytes
+            * ListVolumesResponse.Entries honors the requested MaxEntries
+            * ValidateVolumeCapabilitiesResponse.Confirmed contains only
+              the requested VolumeCapabilities
+
+        A Volume.CapacityBytes of zero indicates the capacity is unknown
+        and is not checked. The CapacityBytes of a
+        ControllerExpandVolumeResponse is required and is always checked.
+
+        Enabling this option sets X_CSI_SPEC_REP_VALIDATION=true.
+
+    X_CSI_SPEC_AGGREGATE_VIOLATIONS
+        A flag that reports all of a request's spec violations instead of
+        only the first one. Each violation is included in the error's
+        status details as a google.rpc.BadRequest field violation.
+
+    X_CSI_SPEC_TOPOLOGY
+        A flag that enables or disables validation of CSI topology
+        fields, ex. CreateVolumeRequest.AccessibilityRequirements and
+        Volume.AccessibleTopology. If unset, topology fields are validated
+        if the SP advertises the VOLUME_ACCESSIBILITY_CONSTRAINTS
+        capability. The capability is checked on the first validated RPC.
 
     X_CSI_SPEC_DISABLE_LEN_CHECK
         A flag that disables validation of CSI message field lengths.
 
+    X_CSI_SPEC_LEN_MAX_STRING
+        The maximum size of CSI message string fields, including the strings
+        in nested messages, lists, and maps, in bytes. The default value
+        is 128. Strings that are not valid UTF-8 are rejected.
+
+    X_CSI_SPEC_LEN_MAX_MAP
+        The maximum size of CSI message map fields, the sum of the sizes
+        of a map's keys and values. The default value is 4096.
+
     X_CSI_REQUIRE_STAGING_TARGET_PATH
         A flag that enables treating the following fields as required:
             * NodePublishVolumeRequest.StagingTargetPath
@@ -158,6 +279,9 @@ GLOBAL OPTIONS
             X_CSI_REQUIRE_CREDS_CTRLR_UNPUB_VOL=true
             X_CSI_REQUIRE_CREDS_NODE_PUB_VOL=true
             X_CSI_REQUIRE_CREDS_NODE_UNPUB_VOL=true
+            X_CSI_REQUIRE_CREDS_CREATE_SNAP=true
+            X_CSI_REQUIRE_CREDS_DELETE_SNAP=true
+            X_CSI_REQUIRE_CREDS_CTRLR_EXPAND_VOL=true
 
         Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
 
@@ -195,6 +319,81 @@ GLOBAL OPTIONS
 
         Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
 
+    X_CSI_REQUIRE_CREDS_CREATE_SNAP
+        A flag that enables treating the following fields as required:
+            * CreateSnapshotRequest.Secrets
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_REQUIRE_CREDS_DELETE_SNAP
+        A flag that enables treating the following fields as required:
+            * DeleteSnapshotRequest.Secrets
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_REQUIRE_CREDS_CTRLR_EXPAND_VOL
+        A flag that enables treating the following fields as required:
+            * ControllerExpandVolumeRequest.Secrets
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_SUPPORTED_ACCESS_MODES
+        A comma-separated list of the access modes supported by the SP,
+        ex. SINGLE_NODE_WRITER. Requests with volume capabilities that
+        have other access modes are rejected.
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_SUPPORTED_ACCESS_TYPES
+        A comma-separated list of the access types supported by the SP:
+        block, mount. Requests with volume capabilities that have other
+        access types are rejected.
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_SUPPORTED_FS_TYPES
+        A comma-separated list of the filesystem types supported by the SP.
+        Requests with mount volume capabilities that have other filesystem
+        types are rejected. Mount volume capabilities without a filesystem
+        type request the SP's default filesystem type and are accepted.
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_SUPPORTED_MOUNT_FLAGS
+        A comma-separated list of the mount flags allowed by the SP. A
+        flag with a value, ex. uid=1000, is allowed if its name, ex. uid,
+        is in the list. Requests with mount volume capabilities that have
+        other mount flags are rejected.
+
+        Enabling this option sets X_CSI_SPEC_REQ_VALIDATION=true.
+
+    X_CSI_SECRETS_DIR
+        The path to a directory from which secrets are read and injected
+        into requests that accept secrets but have none. Each file in the
+        directory is a secret whose key is the file's name and whose value
+        is the file's contents, ex. a mounted Kubernetes secret. Files with
+        names that begin with "." are ignored. The files are re-read when
+        they change, and the injected values are never logged.
+
+        This value may be overridden for specific RPCs with:
+            X_CSI_SECRETS_DIR_CREATE_VOL
+            X_CSI_SECRETS_DIR_DELETE_VOL
+            X_CSI_SECRETS_DIR_CTRLR_PUB_VOL
+            X_CSI_SECRETS_DIR_CTRLR_UNPUB_VOL
+            X_CSI_SECRETS_DIR_VALIDATE_VOL_CAPS
+            X_CSI_SECRETS_DIR_CREATE_SNAP
+            X_CSI_SECRETS_DIR_DELETE_SNAP
+            X_CSI_SECRETS_DIR_LIST_SNAP
+            X_CSI_SECRETS_DIR_CTRLR_EXPAND_VOL
+            X_CSI_SECRETS_DIR_NODE_STG_VOL
+            X_CSI_SECRETS_DIR_NODE_PUB_VOL
+
+    X_CSI_SECRETS_STAT_INTERVAL
+        The minimum interval between checks of the secrets directories for
+        changes. Requests received within the interval of the previous
+        check are injected with the cached secrets. A value of zero checks
+        the directories on every request. Defaults to 1s.
+
     X_CSI_SERIAL_VOL_ACCESS
         A flag that enables the serial volume access middleware.
 
@@ -204,13 +403,96 @@ GLOBAL OPTIONS
         returning a the gRPC error code FailedPrecondition (5) to indicate
         an operation is already pending for the specified volume.
 
+    X_CSI_SERIAL_VOL_ACCESS_RETRY_DELAY
+        A time.Duration string that sets the retry delay suggested to
+        clients when an operation is already pending for the request's
+        volume. The gRPC error for a pending operation describes the
+        operations holding the volume's locks and includes the delay as a
+        google.rpc.RetryInfo status detail. The default is the value of
+        X_CSI_SERIAL_VOL_ACCESS_TIMEOUT or one second, whichever is greater.
+
+    X_CSI_SERIAL_VOL_ACCESS_LOCK_MODES
+        A comma-separated list of RPC=MODE pairs that set the modes in which
+        the serial volume access middleware obtains volume locks, ex.
+        NodePublishVolume=exclusive. The modes are "shared" and "exclusive".
+        By default ControllerPublishVolume, ControllerUnpublishVolume,
+        NodePublishVolume, and NodeUnpublishVolume obtain shared locks and
+        all other RPCs obtain exclusive locks.
+
+    X_CSI_SERIAL_VOL_ACCESS_LOCK_GRANULARITY
+        A comma-separated list of RPC=GRANULARITY pairs that set the
+        resources on which the serial volume access middleware serializes
+        RPCs, ex. ControllerPublishVolume=volume. The granularities are:
+
+            volume  The volume
+            node    The volume and the node ID
+            target  The volume and the target path
+
+        By default ControllerPublishVolume and ControllerUnpublishVolume are
+        serialized on the node ID, NodePublishVolume and NodeUnpublishVolume
+        on the target path, and all other RPCs on the volume. RPCs that
+        obtain exclusive volume locks, ex. DeleteVolume, are serialized
+        against all of the volume's nodes and target paths. A publish or
+        unpublish RPC serialized on the volume obtains exclusive volume
+        locks unless its mode is set with X_CSI_SERIAL_VOL_ACCESS_LOCK_MODES.
+
+    X_CSI_SERIAL_VOL_ACCESS_SKIP_NODE_STG_VOL
+        A flag that excludes the NodeStageVolume RPC from the serial volume
+        access middleware.
+
+    X_CSI_SERIAL_VOL_ACCESS_SKIP_NODE_UNSTG_VOL
+        A flag that excludes the NodeUnstageVolume RPC from the serial volume
+        access middleware.
+
+    X_CSI_SERIAL_VOL_ACCESS_SKIP_CTRLR_EXPAND_VOL
+        A flag that excludes the ControllerExpandVolume RPC from the serial volume
+        access middleware.
+
+    X_CSI_SERIAL_VOL_ACCESS_SKIP_NODE_EXPAND_VOL
+        A flag that excludes the NodeExpandVolume RPC from the serial volume
+        access middleware.
+
+    X_CSI_SERIAL_VOL_ACCESS_SKIP_CREATE_SNAP
+        A flag that excludes the CreateSnapshot RPC from the serial volume
+        access middleware.
+
+    X_CSI_SERIAL_VOL_ACCESS_FLOCK_DIR
+        A directory in which the serial volume access middleware creates
+        lock files locked with flock(2). If specified then the middleware
+        serializes access to volumes across all of the processes on the
+        host that use the same directory, ex. several instances of a node
+        plugin during a rolling update. Locks held by a process are released
+        when the process exits. This option is ignored if
+        X_CSI_SERIAL_VOL_ACCESS_ETCD_ENDPOINTS is specified.
+
+    X_CSI_SERIAL_VOL_ACCESS_DEBUG_ADDR
+        The address of a local debug HTTP endpoint, ex. 127.0.0.1:6060, that
+        reports the volume locks that are held or waited for at the path
+        /debug/serialvolume/locks. The report includes each lock's key,
+        holders, and number of waiters as well as histograms of the
+        durations for which locks were waited for and held. The same report
+        is logged when the process receives SIGUSR1.
+
+        The endpoint is not authenticated, so the address's host must be a
+        loopback address. An address without a host, ex. :6060, is served
+        on 127.0.0.1. The flock lock provider reports only the locks held
+        or waited for by the process, not those of the other processes
+        that use the same directory.
+
     X_CSI_SERIAL_VOL_ACCESS_ETCD_DOMAIN
         The name of the environment variable that defines the etcd lock
-        provider's concurrency domain.
+        provider's concurrency domain. The locks are stored under
+        /DOMAIN/v2, and since earlier versions stored them under /DOMAIN
+        with a layout that does not exclude the current one, all of the
+        SPs that share a domain must be upgraded together.
 
     X_CSI_SERIAL_VOL_ACCESS_ETCD_TTL
         The length of time etcd will wait before  releasing ownership of a
-        distributed lock if the lock's session has not been renewed.
+        distributed lock if the lock's session has not been renewed. All of
+        the locks of a process share one session, which is renewed until
+        the process exits and is replaced if it expires. The context of an
+        RPC whose lock expires is canceled, and the RPC fails with the
+        error code Aborted. Defaults to 60s.
 
     X_CSI_SERIAL_VOL_ACCESS_ETCD_ENDPOINTS
         A comma-separated list of etcd endpoints. If specified then the